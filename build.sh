@@ -2,9 +2,9 @@ echo 'Building images...'
 
 GIT_COMMIT_SHA=$(git rev-parse HEAD)
 
-docker image build --build-arg ACCESS_TOKEN_USR=$ACCESS_TOKEN_USR --build-arg ACCESS_TOKEN_PWD=$ACCESS_TOKEN_PWD -t bogdanrat/webserver_coreservice:latest -t bogdanrat/webserver_coreservice:$GIT_COMMIT_SHA ./service/core
+docker image build --build-arg ACCESS_TOKEN_USR=$ACCESS_TOKEN_USR --build-arg ACCESS_TOKEN_PWD=$ACCESS_TOKEN_PWD -t bogdanrat/webserver_coreservice:latest -t bogdanrat/webserver_coreservice:$GIT_COMMIT_SHA -f ./service/core/Dockerfile .
 docker image build --build-arg ACCESS_TOKEN_USR=$ACCESS_TOKEN_USR --build-arg ACCESS_TOKEN_PWD=$ACCESS_TOKEN_PWD -t bogdanrat/webserver_authservicelatest -t bogdanrat/webserver_authservice:$GIT_COMMIT_SHA ./service/auth
-docker image build --build-arg ACCESS_TOKEN_USR=$ACCESS_TOKEN_USR --build-arg ACCESS_TOKEN_PWD=$ACCESS_TOKEN_PWD -t bogdanrat/webserver_storageservice:latest -t bogdanrat/webserver_storageservice:$GIT_COMMIT_SHA ./service/storage
+docker image build --build-arg ACCESS_TOKEN_USR=$ACCESS_TOKEN_USR --build-arg ACCESS_TOKEN_PWD=$ACCESS_TOKEN_PWD -t bogdanrat/webserver_storageservice:latest -t bogdanrat/webserver_storageservice:$GIT_COMMIT_SHA -f ./service/storage/Dockerfile .
 docker image build -t bogdanrat/webserver_web:latest -t bogdanrat/webserver_web:$GIT_COMMIT_SHA ./web
 
 echo 'Pushing images...'
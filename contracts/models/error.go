@@ -76,3 +76,25 @@ func NewUnprocessableEntityError(description string, field ...string) *JSONError
 	}
 	return err
 }
+
+func NewInsufficientStorageError(description string, field ...string) *JSONError {
+	err := &JSONError{
+		StatusCode:  http.StatusInsufficientStorage,
+		Description: description,
+	}
+	if len(field) > 0 {
+		err.Field = strings.Join(field, ";")
+	}
+	return err
+}
+
+func NewConflictError(description string, field ...string) *JSONError {
+	err := &JSONError{
+		StatusCode:  http.StatusConflict,
+		Description: description,
+	}
+	if len(field) > 0 {
+		err.Field = strings.Join(field, ";")
+	}
+	return err
+}
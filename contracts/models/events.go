@@ -4,6 +4,9 @@ const (
 	UserSignUpEventName         = "userSignUp"
 	NewKeyValuePairEventName    = "newKeyValuePair"
 	DeleteKeyValuePairEventName = "deleteKeyValuePair"
+	FileUploadedEventName       = "fileUploaded"
+	FileDeletedEventName        = "fileDeleted"
+	PrefixDeletedEventName      = "prefixDeleted"
 )
 
 type UserSignUpEvent struct {
@@ -31,3 +34,38 @@ type DeleteKeyValuePairEvent struct {
 func (e *DeleteKeyValuePairEvent) Name() string {
 	return DeleteKeyValuePairEventName
 }
+
+// FileUploadedEvent is emitted when a file is written, e.g. uploaded, copied, moved, restored or its metadata changed
+type FileUploadedEvent struct {
+	Key         string `json:"key"`
+	Size        uint64 `json:"size"`
+	Owner       string `json:"owner,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+func (e *FileUploadedEvent) Name() string {
+	return FileUploadedEventName
+}
+
+// FileDeletedEvent is emitted when a file is deleted, moved or trashed. Only the key is set if the file could not be
+// read before its deletion.
+type FileDeletedEvent struct {
+	Key    string `json:"key"`
+	Size   uint64 `json:"size"`
+	Owner  string `json:"owner,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func (e *FileDeletedEvent) Name() string {
+	return FileDeletedEventName
+}
+
+// PrefixDeletedEvent is emitted when all files with a prefix are deleted, the prefix is empty if all files were
+type PrefixDeletedEvent struct {
+	Prefix string `json:"prefix"`
+}
+
+func (e *PrefixDeletedEvent) Name() string {
+	return PrefixDeletedEventName
+}
@@ -3,10 +3,13 @@ package models
 import "time"
 
 type GetFilesResponse struct {
-	Key          string     `json:"key" csv:"Key" excel:"Key"`
-	LastModified *time.Time `json:"last_modified,omitempty" csv:"Last modified" excel:"Last modified"`
-	Size         uint64     `json:"size" csv:"Size" excel:"Size"`
-	StorageClass string     `json:"storage_class" csv:"Storage Class" excel:"Storage Class"`
+	Key          string            `json:"key" csv:"Key" excel:"Key"`
+	LastModified *time.Time        `json:"last_modified,omitempty" csv:"Last modified" excel:"Last modified"`
+	Size         uint64            `json:"size" csv:"Size" excel:"Size"`
+	StorageClass string            `json:"storage_class" csv:"Storage Class" excel:"Storage Class"`
+	ContentType  string            `json:"content_type,omitempty" csv:"Content Type" excel:"Content Type"`
+	SHA256       string            `json:"sha256,omitempty" csv:"SHA-256" excel:"SHA-256"`
+	Metadata     map[string]string `json:"metadata,omitempty" csv:"Metadata" excel:"Metadata"`
 }
 
 type DeleteFileRequest struct {
@@ -14,9 +17,147 @@ type DeleteFileRequest struct {
 }
 
 type DeleteFilesRequest struct {
+	Prefix            *string `json:"prefix,omitempty"`
+	ConfirmationToken string  `json:"confirmation_token"`
+}
+
+type ConfirmDeleteFilesRequest struct {
 	Prefix *string `json:"prefix,omitempty"`
 }
 
+type ConfirmDeleteFilesResponse struct {
+	ConfirmationToken string     `json:"confirmation_token"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+}
+
+type TrashedFile struct {
+	TrashID   string     `json:"trash_id"`
+	Key       string     `json:"key"`
+	Size      uint64     `json:"size"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type TrashRequest struct {
+	TrashID string `json:"trash_id"`
+	// Overwrite restores the file over the one stored at its original key since
+	Overwrite bool `json:"overwrite"`
+	// All purges the whole trash, instead of the file with the trash id
+	All bool `json:"all"`
+}
+
 type GetFileRequest struct {
-	FileName string `json:"file_name" form:"file_name"`
+	FileName  string `json:"file_name" form:"file_name"`
+	VersionID string `json:"version_id,omitempty" form:"version_id"`
+	// Width and Height request a resized variant of an image, 0 keeps the aspect ratio
+	Width  uint32 `json:"w,omitempty" form:"w"`
+	Height uint32 `json:"h,omitempty" form:"h"`
+	// Fit is contain (default), cover or fill
+	Fit string `json:"fit,omitempty" form:"fit"`
+}
+
+type ListFileVersionsRequest struct {
+	Key string `json:"key" form:"key" binding:"required"`
+}
+
+type FileVersion struct {
+	Key            string     `json:"key"`
+	VersionID      string     `json:"version_id"`
+	LastModified   *time.Time `json:"last_modified,omitempty"`
+	Size           uint64     `json:"size"`
+	IsLatest       bool       `json:"is_latest"`
+	IsDeleteMarker bool       `json:"is_delete_marker,omitempty"`
+}
+
+type FileVersionRequest struct {
+	Key       string `json:"key" binding:"required"`
+	VersionID string `json:"version_id" binding:"required"`
+}
+
+// TransferFileRequest copies or moves a file, or all files with a prefix if the source key ends with a slash
+type TransferFileRequest struct {
+	SrcKey string `json:"src_key" binding:"required"`
+	DstKey string `json:"dst_key" binding:"required"`
+	// Overwrite replaces the existing files at the destination
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+type TransferFileResponse struct {
+	Keys []string `json:"keys"`
+}
+
+type FolderRequest struct {
+	Path string `json:"path" binding:"required"`
+}
+
+type RenameFolderRequest struct {
+	Path    string `json:"path" binding:"required"`
+	NewPath string `json:"new_path" binding:"required"`
+	// Overwrite replaces the existing files at the destination
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+// DeleteFolderRequest deletes an empty folder, or a folder along with its files if Recursive is set and the deletion
+// is confirmed with the token issued for the prefix of the folder, path/
+type DeleteFolderRequest struct {
+	Path              string `json:"path" binding:"required"`
+	Recursive         bool   `json:"recursive,omitempty"`
+	ConfirmationToken string `json:"confirmation_token,omitempty"`
+}
+
+// Folder holds the size and number of files of the folder, including its sub-folders
+type Folder struct {
+	Path    string `json:"path"`
+	Size    uint64 `json:"size"`
+	Objects uint64 `json:"objects"`
+}
+
+// FolderResponse lists the immediate sub-folders and files of a folder
+type FolderResponse struct {
+	Folder
+	Folders []*Folder           `json:"folders"`
+	Files   []*GetFilesResponse `json:"files"`
+}
+
+type UploadURLRequest struct {
+	FileName    string `json:"file_name" binding:"required"`
+	ContentType string `json:"content_type"`
+	Size        uint32 `json:"size"`
+}
+
+type PresignedURLResponse struct {
+	Key       string     `json:"key"`
+	URL       string     `json:"url"`
+	Method    string     `json:"method"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type CompleteUploadRequest struct {
+	Key         string            `json:"key" binding:"required"`
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+type Usage struct {
+	Bytes   uint64 `json:"bytes"`
+	Objects uint64 `json:"objects"`
+	// 0 if unlimited
+	MaxBytes   uint64 `json:"max_bytes"`
+	MaxObjects uint64 `json:"max_objects"`
+}
+
+type PrefixUsage struct {
+	Prefix string `json:"prefix"`
+	Usage
+}
+
+type UsageResponse struct {
+	Owner    Usage          `json:"owner"`
+	Prefixes []*PrefixUsage `json:"prefixes"`
+}
+
+// ArchiveRequest selects the files downloaded as a zip archive: all files with the prefix, or the listed keys
+type ArchiveRequest struct {
+	Prefix string   `json:"prefix,omitempty" form:"prefix"`
+	Keys   []string `json:"keys,omitempty"`
 }
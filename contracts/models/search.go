@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// IndexedFile is a file as indexed for the search, along with the tags and the description given by the users
+type IndexedFile struct {
+	Key          string     `json:"key"`
+	Name         string     `json:"name"`
+	ContentType  string     `json:"content_type,omitempty"`
+	Size         uint64     `json:"size"`
+	Owner        string     `json:"owner,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	Tags         []string   `json:"tags"`
+	Description  string     `json:"description,omitempty"`
+	// Content is the text extracted from a text document, indexed but not returned
+	Content string `json:"-"`
+}
+
+type TagFileRequest struct {
+	Key         string   `json:"key" binding:"required"`
+	Tags        []string `json:"tags"`
+	Description string   `json:"description"`
+}
+
+type SearchFilesRequest struct {
+	Query string   `form:"q"`
+	Tags  []string `form:"tag"`
+	// Type matches a content type, e.g. text/csv, a media type, e.g. image, or an extension, e.g. pdf
+	Type string `form:"type"`
+	// From and To bound the last modification, as dates or RFC 3339 times
+	From  string `form:"from"`
+	To    string `form:"to"`
+	Limit int    `form:"limit"`
+}
+
+// FileQuery is a parsed SearchFilesRequest
+type FileQuery struct {
+	Text  string
+	Tags  []string
+	Type  string
+	From  *time.Time
+	To    *time.Time
+	Limit int
+}
+
+type SearchFilesResult struct {
+	*IndexedFile
+	Rank float64 `json:"rank"`
+	// Headline is the matching excerpt of the name, description or content
+	Headline string `json:"headline,omitempty"`
+}
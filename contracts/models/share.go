@@ -0,0 +1,61 @@
+package models
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+// Share gives public access to a file, or to the files with a prefix if the key ends with a slash, through a token
+type Share struct {
+	ID    int64  `json:"id"`
+	Owner string `json:"-"`
+	// TokenHash is the SHA-256 checksum of the token, which is only returned when the share is created
+	TokenHash    string     `json:"-"`
+	Key          string     `json:"key"`
+	PasswordHash *string    `json:"-"`
+	HasPassword  bool       `json:"has_password"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (share *Share) HashPassword(password string) error {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	hash := string(bytes)
+	share.PasswordHash = &hash
+	share.HasPassword = true
+
+	return nil
+}
+
+// CheckPassword succeeds if the share is not protected by a password, or if the password matches
+func (share *Share) CheckPassword(password string) error {
+	if share.PasswordHash == nil {
+		return nil
+	}
+	return bcrypt.CompareHashAndPassword([]byte(*share.PasswordHash), []byte(password))
+}
+
+type CreateShareRequest struct {
+	Key string `json:"key" binding:"required"`
+	// ExpiresIn is in seconds, 0 uses the default expiration
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	Password     string `json:"password,omitempty"`
+	MaxDownloads int    `json:"max_downloads,omitempty"`
+}
+
+type CreateShareResponse struct {
+	*Share
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+type RevokeShareRequest struct {
+	ID int64 `json:"id" binding:"required"`
+}
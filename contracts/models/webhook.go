@@ -0,0 +1,124 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookEvents are the names of the events which can be delivered to the webhooks
+var WebhookEvents = []string{
+	UserSignUpEventName,
+	FileUploadedEventName,
+	FileDeletedEventName,
+	PrefixDeletedEventName,
+}
+
+// AdminWebhookEvents are not owned by a user, so they are only delivered to the webhooks of the administrators.
+// The file events are delivered to the webhooks of the files' owners.
+var AdminWebhookEvents = []string{
+	UserSignUpEventName,
+	PrefixDeletedEventName,
+}
+
+func IsAdminWebhookEvent(name string) bool {
+	for _, event := range AdminWebhookEvents {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
+
+func IsWebhookEvent(name string) bool {
+	for _, event := range WebhookEvents {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook delivers the events it is subscribed to by posting them to its url, signed with its secret
+type Webhook struct {
+	ID    int64  `json:"id"`
+	Owner string `json:"-"`
+	URL   string `json:"url"`
+	// Events are the names of the delivered events, all of the WebhookEvents its owner may receive if empty
+	Events []string `json:"events"`
+	// Prefix restricts the file events to the keys starting with it
+	Prefix string `json:"prefix,omitempty"`
+	// Secret signs the deliveries, it is only returned when the webhook is created or its secret rotated
+	Secret    string    `json:"-"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events"`
+	Prefix string   `json:"prefix"`
+	// Active defaults to true
+	Active *bool `json:"active"`
+}
+
+// UpdateWebhookRequest replaces the url, events and prefix of the webhook, keeping its state if active is omitted
+type UpdateWebhookRequest struct {
+	ID           int64    `json:"id" binding:"required"`
+	URL          string   `json:"url" binding:"required"`
+	Events       []string `json:"events"`
+	Prefix       string   `json:"prefix"`
+	Active       *bool    `json:"active"`
+	RotateSecret bool     `json:"rotate_secret"`
+}
+
+type DeleteWebhookRequest struct {
+	ID int64 `json:"id" binding:"required"`
+}
+
+type WebhookResponse struct {
+	*Webhook
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookDelivery is an event queued to be posted to a webhook, along with the outcome of its last attempt
+type WebhookDelivery struct {
+	ID        int64           `json:"id"`
+	WebhookID int64           `json:"webhook_id"`
+	EventID   string          `json:"event_id"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	// ResponseStatus is the status code returned by the webhook, if it responded
+	ResponseStatus *int       `json:"response_status,omitempty"`
+	LastError      *string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+type GetWebhookDeliveriesRequest struct {
+	WebhookID int64  `form:"webhook_id" binding:"required"`
+	Status    string `form:"status"`
+	Limit     int    `form:"limit"`
+}
+
+type RedeliverWebhookRequest struct {
+	ID int64 `json:"id" binding:"required"`
+}
+
+// WebhookPayload is the body posted to the webhooks
+type WebhookPayload struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
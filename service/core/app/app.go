@@ -12,10 +12,13 @@ import (
 	"github.com/bogdanrat/web-server/service/core/i18n/kvtranslator"
 	"github.com/bogdanrat/web-server/service/core/listener"
 	"github.com/bogdanrat/web-server/service/core/mail"
+	"github.com/bogdanrat/web-server/service/core/outbox"
 	"github.com/bogdanrat/web-server/service/core/render"
 	"github.com/bogdanrat/web-server/service/core/router"
+	"github.com/bogdanrat/web-server/service/core/search"
 	"github.com/bogdanrat/web-server/service/core/store/dynamo"
 	"github.com/bogdanrat/web-server/service/core/store/postgres"
+	"github.com/bogdanrat/web-server/service/core/webhook"
 	"github.com/bogdanrat/web-server/service/queue"
 	amqp_queue "github.com/bogdanrat/web-server/service/queue/amqp"
 	sqs_queue "github.com/bogdanrat/web-server/service/queue/sqs"
@@ -99,6 +102,10 @@ func Init() error {
 	}
 	log.Printf("Message Broker %s initialized.\n", config.AppConfig.MessageBroker.Broker)
 
+	// relay events written to the outbox alongside database writes
+	outboxRelay := outbox.NewRelay(postgresDB, eventEmitter, config.AppConfig.Outbox)
+	go outboxRelay.Start()
+
 	// init store
 	keyValueStore, err := dynamo.NewStore(config.AppConfig.I18N.TableName)
 	if err != nil {
@@ -110,7 +117,24 @@ func Init() error {
 		return err
 	}
 
-	processor := listener.NewEventProcessor(eventListener, translator)
+	var deduplicator *listener.Deduplicator
+	if config.AppConfig.MessageBroker.Deduplication.Enabled {
+		deduplicator = listener.NewDeduplicator(redisCache, config.AppConfig.MessageBroker.Deduplication.TTL)
+	}
+
+	// index the files for the search, as the storage events tell they change
+	indexer := search.NewIndexer(postgresDB, storageClient, config.AppConfig.Services.Storage.GRPC.Deadline, config.AppConfig.Search)
+	go indexer.Start()
+
+	// deliver the events to the webhooks of the users
+	dispatcher := webhook.NewDispatcher(postgresDB, config.AppConfig.Webhooks)
+	go dispatcher.Start()
+
+	processor := listener.NewEventProcessor(eventListener, translator, deduplicator, indexer, dispatcher)
+	// auth events are handled by a dedicated group handler, keeping their order within the message group
+	if groupRouter, ok := eventListener.(sqs_queue.GroupRouter); ok {
+		groupRouter.RouteGroup(sqs_queue.MessageGroupIDAuth, processor.HandleEvent)
+	}
 	go func() {
 		err := processor.ProcessEvent()
 		if err != nil {
@@ -179,7 +203,15 @@ func initMessageBroker(brokerConfig config.MessageBrokerConfig) (eventEmitter qu
 			return
 		}
 
-		eventEmitter, err = amqp_queue.NewEventEmitter(conn, brokerConfig.RabbitMQ.Exchange)
+		eventEmitter, err = amqp_queue.NewEventEmitter(conn, amqp_queue.EmitterConfig{
+			URI:             amqpUri,
+			Exchange:        brokerConfig.RabbitMQ.Exchange,
+			Source:          brokerConfig.Source,
+			ChannelPoolSize: brokerConfig.RabbitMQ.ChannelPoolSize,
+			MaxRetries:      brokerConfig.RabbitMQ.MaxRetries,
+			RetryInterval:   brokerConfig.RabbitMQ.RetryInterval,
+			ConfirmTimeout:  brokerConfig.RabbitMQ.ConfirmTimeout,
+		})
 		if err != nil {
 			return
 		}
@@ -196,6 +228,9 @@ func initMessageBroker(brokerConfig config.MessageBrokerConfig) (eventEmitter qu
 			MaxNumberOfMessages:       brokerConfig.SQS.MaxNumberOfMessages,
 			VisibilityTimeout:         brokerConfig.SQS.VisibilityTimeout,
 			WaitTimeSeconds:           brokerConfig.SQS.WaitTimeSeconds,
+			UnrequestedEventPolicy:    brokerConfig.SQS.UnrequestedEventPolicy,
+			DeadLetterQueueName:       brokerConfig.SQS.DeadLetterQueueName,
+			Source:                    brokerConfig.Source,
 		}
 		eventEmitter, err = sqs_queue.NewEventEmitter(config.AWSSession, sqsConfig)
 		if err != nil {
@@ -2,6 +2,8 @@ package cache
 
 type Client interface {
 	Set(key string, value interface{}, timeoutSeconds int) error
+	// SetIfAbsent sets the key only if it does not exist, returning whether it was set
+	SetIfAbsent(key string, value interface{}, timeoutSeconds int) (bool, error)
 	Get(key string) (interface{}, error)
 	Delete(key string) error
 }
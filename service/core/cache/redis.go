@@ -64,6 +64,14 @@ func (c *Redis) Set(key string, value interface{}, timeoutSeconds int) error {
 	return err
 }
 
+func (c *Redis) SetIfAbsent(key string, value interface{}, timeoutSeconds int) (bool, error) {
+	set, err := c.redis.SetNX(key, value, time.Duration(timeoutSeconds)*time.Second).Result()
+	if err != nil {
+		log.Printf("error writing to redis: %s", err)
+	}
+	return set, err
+}
+
 func (c *Redis) Get(key string) (interface{}, error) {
 	result, err := c.redis.Get(key).Result()
 	if err != nil {
@@ -45,6 +45,10 @@ type RabbitMQConfig struct {
 	Port            string
 	Exchange        string
 	Queue           string
+	ChannelPoolSize int
+	MaxRetries      int
+	RetryInterval   int64 // milliseconds
+	ConfirmTimeout  int64 // milliseconds
 }
 
 type SQSConfig struct {
@@ -55,12 +59,21 @@ type SQSConfig struct {
 	MaxNumberOfMessages       int64
 	VisibilityTimeout         int64
 	WaitTimeSeconds           int64
+	UnrequestedEventPolicy    string
+	DeadLetterQueueName       string
+}
+
+type DeduplicationConfig struct {
+	Enabled bool
+	TTL     int // seconds
 }
 
 type MessageBrokerConfig struct {
-	Broker   string
-	RabbitMQ RabbitMQConfig
-	SQS      SQSConfig
+	Broker        string
+	Source        string
+	RabbitMQ      RabbitMQConfig
+	SQS           SQSConfig
+	Deduplication DeduplicationConfig
 }
 
 type DynamoDBConfig struct {
@@ -103,6 +116,97 @@ type StorageConfig struct {
 	GRPC            GRPCConfig
 	ImagesPrefix    string
 	DocumentsPrefix string
+	Archive         ArchiveConfig
+}
+
+// ArchiveConfig limits the zip archives extracted on upload, 0 if unlimited
+type ArchiveConfig struct {
+	MaxEntries       int
+	MaxExtractedSize int64 // bytes
+}
+
+// ShareConfig bounds the expiration of the share links, and prefixes their urls
+type ShareConfig struct {
+	DefaultExpiration int64 // seconds
+	MaxExpiration     int64 // seconds, 0 for the longest allowed, 100 years
+	// BaseURL prefixes the share urls, e.g. https://example.com; empty yields relative urls
+	BaseURL string
+}
+
+// SearchConfig configures the indexing of the files for the search
+type SearchConfig struct {
+	// QueueSize bounds the changes waiting to be indexed, the changes beyond it are dropped
+	QueueSize int
+	// MaxContentSize is the number of bytes of a text document whose words are indexed, 0 to index the names only
+	MaxContentSize int64
+	MaxResults     int
+	// DeletedRetention is how long the tags and description of the deleted files are kept, so that the files moved,
+	// renamed or restored from the trash get them back; it should cover the storage's trash retention
+	DeletedRetention int64 // seconds
+	PurgeInterval    int64 // seconds
+}
+
+func (c SearchConfig) validate() error {
+	// an unbuffered queue would drop every change, the sends being non-blocking
+	if c.QueueSize <= 0 || c.DeletedRetention <= 0 || c.PurgeInterval <= 0 {
+		return fmt.Errorf("QueueSize, DeletedRetention and PurgeInterval must be positive")
+	}
+	return nil
+}
+
+// WebhookConfig configures the delivery of the events to the webhooks
+type WebhookConfig struct {
+	// MaxWebhooks bounds the webhooks of a user, 0 if unlimited
+	MaxWebhooks  int
+	PollInterval int64 // milliseconds
+	BatchSize    int
+	Timeout      int64 // milliseconds
+	MaxAttempts  int
+	// RetryInterval is doubled after every failed attempt, up to MaxRetryInterval
+	RetryInterval    int64 // milliseconds
+	MaxRetryInterval int64 // milliseconds
+	// AllowPrivateNetworks lets the webhooks post to loopback and private addresses, e.g. during development
+	AllowPrivateNetworks bool
+	// Admins are the emails of the users whose webhooks may receive the AdminWebhookEvents, e.g. the sign ups
+	Admins []string
+}
+
+func (c WebhookConfig) validate() error {
+	if c.PollInterval <= 0 || c.BatchSize <= 0 || c.Timeout <= 0 || c.MaxAttempts <= 0 || c.RetryInterval <= 0 {
+		return fmt.Errorf("PollInterval, BatchSize, Timeout, MaxAttempts and RetryInterval must be positive")
+	}
+	if c.MaxRetryInterval < c.RetryInterval {
+		return fmt.Errorf("MaxRetryInterval cannot be less than RetryInterval")
+	}
+	return nil
+}
+
+// IsAdmin reports whether the user's webhooks may receive the events not owned by a user
+func (c WebhookConfig) IsAdmin(email string) bool {
+	for _, admin := range c.Admins {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+type OutboxConfig struct {
+	PollInterval   int64 // milliseconds
+	BatchSize      int
+	MaxAttempts    int
+	RetryInterval  int64 // milliseconds
+	PublishTimeout int64 // milliseconds
+}
+
+func (c OutboxConfig) validate() error {
+	if c.PollInterval <= 0 || c.BatchSize <= 0 || c.MaxAttempts <= 0 || c.PublishTimeout <= 0 {
+		return fmt.Errorf("PollInterval, BatchSize, MaxAttempts and PublishTimeout must be positive")
+	}
+	if c.RetryInterval < 0 {
+		return fmt.Errorf("RetryInterval cannot be negative")
+	}
+	return nil
 }
 
 type Config struct {
@@ -115,6 +219,10 @@ type Config struct {
 	Services       ServicesConfig
 	Prometheus     PrometheusConfig
 	I18N           I18NConfig
+	Outbox         OutboxConfig
+	Shares         ShareConfig
+	Search         SearchConfig
+	Webhooks       WebhookConfig
 	TemplateCache  map[string]*template.Template
 }
 
@@ -144,6 +252,20 @@ func ReadConfiguration() error {
 		return fmt.Errorf("couldn't unmarshal configuration: %v", err)
 	}
 
+	return AppConfig.validate()
+}
+
+// validate rejects the values which would stop or break the background workers, e.g. a zero poll interval
+func (c *Config) validate() error {
+	if err := c.Outbox.validate(); err != nil {
+		return fmt.Errorf("invalid Outbox configuration: %s", err)
+	}
+	if err := c.Search.validate(); err != nil {
+		return fmt.Errorf("invalid Search configuration: %s", err)
+	}
+	if err := c.Webhooks.validate(); err != nil {
+		return fmt.Errorf("invalid Webhooks configuration: %s", err)
+	}
 	return nil
 }
 
@@ -28,3 +28,9 @@ require (
 	google.golang.org/genproto v0.0.0-20210803142424-70bd63adacf2
 	google.golang.org/grpc v1.39.0
 )
+
+replace (
+	github.com/bogdanrat/web-server/contracts => ../../contracts
+	github.com/bogdanrat/web-server/service/monitor => ../monitor
+	github.com/bogdanrat/web-server/service/queue => ../queue
+)
@@ -13,7 +13,6 @@ import (
 	"github.com/bogdanrat/web-server/service/core/render"
 	"github.com/bogdanrat/web-server/service/core/store"
 	"github.com/bogdanrat/web-server/service/core/util"
-	"github.com/bogdanrat/web-server/service/queue"
 	"github.com/gin-gonic/gin"
 	"google.golang.org/grpc"
 	"net/http"
@@ -29,18 +28,16 @@ type RPCConfig struct {
 }
 
 type Handler struct {
-	Repository   store.DatabaseRepository
-	Cache        cache.Client
-	AuthService  *RPCConfig
-	EventEmitter queue.EventEmitter
+	Repository  store.DatabaseRepository
+	Cache       cache.Client
+	AuthService *RPCConfig
 }
 
-func NewHandler(repo store.DatabaseRepository, cacheClient cache.Client, authConfig *RPCConfig, eventEmitter queue.EventEmitter) *Handler {
+func NewHandler(repo store.DatabaseRepository, cacheClient cache.Client, authConfig *RPCConfig) *Handler {
 	return &Handler{
-		Repository:   repo,
-		Cache:        cacheClient,
-		AuthService:  authConfig,
-		EventEmitter: eventEmitter,
+		Repository:  repo,
+		Cache:       cacheClient,
+		AuthService: authConfig,
 	}
 }
 
@@ -110,7 +107,13 @@ func (h *Handler) SignUp(c *gin.Context) {
 		}
 	}
 
-	if err := h.Repository.InsertUser(user); err != nil {
+	// the sign up event is written to the outbox in the same transaction as the user,
+	// and it is published by the outbox relay
+	signUpEvent := &models.UserSignUpEvent{
+		User:    user,
+		QrImage: qrImage,
+	}
+	if err := h.Repository.InsertUser(user, signUpEvent); err != nil {
 		jsonErr := models.NewInternalServerError("unable to insert user into db")
 		c.JSON(jsonErr.StatusCode, jsonErr)
 		return
@@ -125,16 +128,6 @@ func (h *Handler) SignUp(c *gin.Context) {
 		}
 		h.Cache.(*cache.Redis).Publish(config.AppConfig.Authentication.Channel, userJson)
 	}
-
-	err := h.EventEmitter.Emit(&models.UserSignUpEvent{
-		User:    user,
-		QrImage: qrImage,
-	})
-	if err != nil {
-		jsonErr := models.NewInternalServerError(fmt.Sprintf("cannot emit user sign up event: %s", err))
-		c.JSON(jsonErr.StatusCode, jsonErr)
-		return
-	}
 }
 
 func (h *Handler) Login(c *gin.Context) {
@@ -0,0 +1,283 @@
+package file
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/core/config"
+	"github.com/bogdanrat/web-server/service/core/lib"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const archiveContentType = "application/zip"
+
+// GetArchive downloads the files with a prefix (GET, ?prefix=), or the listed keys (POST), as a zip archive.
+// The archive is streamed while it is built from the files' streams, it is never held in memory.
+func (h *Handler) GetArchive(c *gin.Context) {
+	request := &models.ArchiveRequest{}
+	bind := c.ShouldBindQuery
+	if c.Request.Method == http.MethodPost {
+		bind = c.ShouldBindJSON
+	}
+	if err := bind(request); err != nil || (request.Prefix == "" && len(request.Keys) == 0) {
+		jsonErr := models.NewBadRequestError("prefix or keys are required", "prefix", "keys")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	var files []*models.GetFilesResponse
+	var jsonErr *models.JSONError
+	if len(request.Keys) > 0 {
+		files, jsonErr = h.getFilesByKey(request.Keys)
+	} else {
+		files, jsonErr = h.getFilesByPrefix(request.Prefix)
+	}
+	if jsonErr != nil {
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	prefix := request.Prefix
+	if len(request.Keys) > 0 {
+		prefix = ""
+	}
+	h.streamArchive(c, prefix, files)
+}
+
+// streamArchive streams the files as a zip archive named after the prefix. The entries are named relative to the folder
+// holding the prefix, e.g. docs/a.pdf is a.pdf in the archive of docs/.
+func (h *Handler) streamArchive(c *gin.Context, prefix string, files []*models.GetFilesResponse) {
+	folder := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		folder = prefix[:i+1]
+	}
+
+	c.Header("Content-Type", archiveContentType)
+	c.Header("Access-Control-Expose-Headers", "Content-Disposition")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, archiveName(prefix)))
+	c.Status(http.StatusOK)
+
+	// once streaming started, the status cannot change: a failure truncates the archive, which clients reject
+	archive := zip.NewWriter(c.Writer)
+	for _, file := range files {
+		if err := h.writeArchiveEntry(archive, strings.TrimPrefix(file.Key, folder), file); err != nil {
+			log.Printf("cannot write %s to archive: %s", file.Key, err)
+			return
+		}
+		c.Writer.Flush()
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("cannot close archive: %s", err)
+	}
+}
+
+func (h *Handler) getFilesByPrefix(prefix string) ([]*models.GetFilesResponse, *models.JSONError) {
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	stream, err := h.RPC.Client.GetFiles(ctx, &storage_service.GetFilesRequest{Prefix: prefix})
+	if err != nil {
+		return nil, lib.HandleRPCError(err)
+	}
+
+	files, jsonErr := h.getAllFiles(stream)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	if len(files) == 0 {
+		return nil, models.NewNotFoundError(fmt.Sprintf("no files found with prefix %s", prefix), "prefix")
+	}
+	return files, nil
+}
+
+// getFilesByKey verifies that the files exist before the archive is streamed, while an error can still be returned
+func (h *Handler) getFilesByKey(keys []string) ([]*models.GetFilesResponse, *models.JSONError) {
+	files := make([]*models.GetFilesResponse, 0, len(keys))
+	listed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if listed[key] {
+			continue
+		}
+		listed[key] = true
+
+		// listing the key as a prefix also returns the files whose keys start with it
+		matches, jsonErr := h.getFilesByPrefix(key)
+		if jsonErr != nil && jsonErr.StatusCode != http.StatusNotFound {
+			return nil, jsonErr
+		}
+		var file *models.GetFilesResponse
+		for _, match := range matches {
+			if match.Key == key {
+				file = match
+				break
+			}
+		}
+		if file == nil {
+			return nil, models.NewNotFoundError(fmt.Sprintf("file %s does not exist", key), "keys")
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// writeArchiveEntry copies the file's chunks into a new entry of the archive, as they are received
+func (h *Handler) writeArchiveEntry(archive *zip.Writer, name string, file *models.GetFilesResponse) error {
+	header := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Deflate,
+	}
+	// images are already compressed
+	if lib.IsImage(name) {
+		header.Method = zip.Store
+	}
+	if file.LastModified != nil {
+		header.Modified = *file.LastModified
+	}
+
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	stream, err := h.RPC.Client.GetFile(ctx, &storage_service.GetFileRequest{
+		FileName: file.Key,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		response, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if _, err = entry.Write(response.GetChunkData()); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveName names the archive after the last folder of the prefix
+func archiveName(prefix string) string {
+	name := path.Base(strings.Trim(prefix, "/"))
+	if name == "." || name == "/" {
+		name = "files"
+	}
+	return strings.ReplaceAll(name, `"`, "") + ".zip"
+}
+
+func isArchive(file *multipart.FileHeader) bool {
+	contentType, _, _ := mime.ParseMediaType(file.Header.Get("Content-Type"))
+	return contentType == archiveContentType || contentType == "application/x-zip-compressed" ||
+		strings.EqualFold(path.Ext(file.Filename), ".zip")
+}
+
+// extractArchive uploads every file of the zip archive as a separate file, keyed by its path in the archive under
+// the prefix. The archive is rejected as a whole if an entry could escape the prefix, or if it exceeds the limits.
+func (h *Handler) extractArchive(file *multipart.FileHeader, prefix string, metadata map[string]string, owner string) *models.JSONError {
+	content, err := file.Open()
+	if err != nil {
+		return models.NewInternalServerError("cannot open file", "file")
+	}
+	defer content.Close()
+
+	reader, err := zip.NewReader(content, file.Size)
+	if err != nil {
+		return models.NewBadRequestError(fmt.Sprintf("invalid zip archive %s: %s", file.Filename, err), "files")
+	}
+
+	limits := config.AppConfig.Services.Storage.Archive
+	entries := make([]*zip.File, 0, len(reader.File))
+	keys := make(map[*zip.File]string, len(reader.File))
+	var extractedSize uint64
+	for _, entry := range reader.File {
+		if entry.FileInfo().IsDir() || skipEntry(entry.Name) {
+			continue
+		}
+		key, err := entryKey(prefix, entry.Name)
+		if err != nil {
+			return models.NewBadRequestError(fmt.Sprintf("invalid entry %s in zip archive %s: %s", entry.Name, file.Filename, err), "files")
+		}
+		// the declared sizes can be trusted: reading past them fails
+		if entry.UncompressedSize64 > math.MaxUint32 {
+			return models.NewBadRequestError(fmt.Sprintf("entry %s in zip archive %s is too large", entry.Name, file.Filename), "files")
+		}
+		extractedSize += entry.UncompressedSize64
+		entries = append(entries, entry)
+		keys[entry] = key
+	}
+
+	if limits.MaxEntries > 0 && len(entries) > limits.MaxEntries {
+		return models.NewBadRequestError(fmt.Sprintf("zip archive %s has more than %d files", file.Filename, limits.MaxEntries), "files")
+	}
+	if limits.MaxExtractedSize > 0 && extractedSize > uint64(limits.MaxExtractedSize) {
+		return models.NewBadRequestError(fmt.Sprintf("zip archive %s extracts to more than %d bytes", file.Filename, limits.MaxExtractedSize), "files")
+	}
+
+	for _, entry := range entries {
+		if jsonErr := h.extractEntry(entry, keys[entry], metadata, owner); jsonErr != nil {
+			return jsonErr
+		}
+	}
+	return nil
+}
+
+func (h *Handler) extractEntry(entry *zip.File, key string, metadata map[string]string, owner string) *models.JSONError {
+	content, err := entry.Open()
+	if err != nil {
+		return models.NewBadRequestError(fmt.Sprintf("cannot open entry %s: %s", entry.Name, err), "files")
+	}
+	defer content.Close()
+
+	return h.upload(key, mime.TypeByExtension(path.Ext(key)), int64(entry.UncompressedSize64), content, metadata, owner)
+}
+
+// entryKey returns the key of an archive entry under the prefix. Names that could escape the prefix (zip slip), i.e.
+// absolute paths or paths with .. segments, are rejected rather than cleaned.
+func entryKey(prefix, name string) (string, error) {
+	// some archivers use backslashes as separators
+	name = strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(name) || (len(name) > 1 && name[1] == ':') {
+		return "", fmt.Errorf("absolute path")
+	}
+	for _, segment := range strings.Split(prefix+"/"+name, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("parent directory reference")
+		}
+	}
+
+	key := path.Clean(name)
+	if prefix != "" {
+		key = prefix + "/" + key
+	}
+	return key, nil
+}
+
+// skipEntry reports whether the entry is an archiver's metadata, e.g. __MACOSX/ or .DS_Store, rather than a file
+func skipEntry(name string) bool {
+	for _, segment := range strings.Split(strings.ReplaceAll(name, `\`, "/"), "/") {
+		if segment == "__MACOSX" || (strings.HasPrefix(segment, ".") && segment != "." && segment != "..") {
+			return true
+		}
+	}
+	return false
+}
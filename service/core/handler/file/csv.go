@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/bogdanrat/web-server/contracts/models"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -29,6 +31,11 @@ func GetFilesAsCSVRecords(files []*models.GetFilesResponse, headers []string) []
 			values := make([]string, 0)
 			// iterate struct fields
 			for i := 0; i < fileStruct.NumField(); i++ {
+				// only fields with a csv header are written, so that values stay aligned with their headers
+				if tag := fileStruct.Type().Field(i).Tag.Get(csvTag); tag == "" || tag == "-" {
+					continue
+				}
+
 				value := ""
 
 				field := fileStruct.Field(i)
@@ -36,24 +43,22 @@ func GetFilesAsCSVRecords(files []*models.GetFilesResponse, headers []string) []
 				fieldType := field.Type()
 				fieldKind := field.Kind()
 
+				switch {
 				// parse time if field is of type time.Time
-				if fieldType.AssignableTo(reflect.TypeOf(&time.Time{})) {
-					value = fieldValue.(*time.Time).Format(dateFormat)
-				}
-
-				if fieldKind == reflect.Uint64 {
+				case fieldType.AssignableTo(reflect.TypeOf(&time.Time{})):
+					if !field.IsNil() {
+						value = fieldValue.(*time.Time).Format(dateFormat)
+					}
+				case fieldKind == reflect.Uint64:
 					value = fmt.Sprintf("%d", fieldValue)
-				}
-
 				// take value as it it in case of strings
-				if fieldKind == reflect.String {
+				case fieldKind == reflect.String:
 					value = fieldValue.(string)
+				case fieldType.AssignableTo(reflect.TypeOf(map[string]string{})):
+					value = FormatMetadata(fieldValue.(map[string]string))
 				}
 
-				// if value variable is not empty, then we have a field of interest and we save it
-				if value != "" {
-					values = append(values, value)
-				}
+				values = append(values, value)
 			}
 
 			// append one row of values
@@ -63,3 +68,13 @@ func GetFilesAsCSVRecords(files []*models.GetFilesResponse, headers []string) []
 
 	return records
 }
+
+// FormatMetadata formats the metadata as key=value pairs, sorted by key
+func FormatMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "; ")
+}
@@ -27,6 +27,9 @@ func WriteFilesToExcel(files []*models.GetFilesResponse, headers []string) (*exc
 		excelFile.SetCellValue(defaultSheetName, fmt.Sprintf("B%d", i+2), file.LastModified)
 		excelFile.SetCellValue(defaultSheetName, fmt.Sprintf("C%d", i+2), file.Size)
 		excelFile.SetCellValue(defaultSheetName, fmt.Sprintf("D%d", i+2), file.StorageClass)
+		excelFile.SetCellValue(defaultSheetName, fmt.Sprintf("E%d", i+2), file.ContentType)
+		excelFile.SetCellValue(defaultSheetName, fmt.Sprintf("F%d", i+2), file.SHA256)
+		excelFile.SetCellValue(defaultSheetName, fmt.Sprintf("G%d", i+2), FormatMetadata(file.Metadata))
 	}
 
 	excelFile.SetSheetName(defaultSheetName, finalSheetName)
@@ -11,12 +11,15 @@ import (
 	"github.com/bogdanrat/web-server/contracts/proto/storage_service"
 	"github.com/bogdanrat/web-server/service/core/config"
 	"github.com/bogdanrat/web-server/service/core/lib"
+	"github.com/bogdanrat/web-server/service/core/middleware"
 	"github.com/bogdanrat/web-server/service/core/render"
+	"github.com/bogdanrat/web-server/service/core/store"
 	"github.com/gin-gonic/gin"
 	"google.golang.org/grpc"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -28,12 +31,16 @@ type RPCConfig struct {
 }
 
 type Handler struct {
-	RPC *RPCConfig
+	RPC    *RPCConfig
+	Shares store.Shares
+	Index  store.FileIndex
 }
 
-func NewHandler(rpcConfig *RPCConfig) *Handler {
+func NewHandler(rpcConfig *RPCConfig, shares store.Shares, index store.FileIndex) *Handler {
 	return &Handler{
-		RPC: rpcConfig,
+		RPC:    rpcConfig,
+		Shares: shares,
+		Index:  index,
 	}
 }
 
@@ -44,6 +51,23 @@ func (h *Handler) PostFiles(c *gin.Context) {
 		return
 	}
 
+	// optional user-defined metadata, as a json object, applied to all uploaded files
+	var metadata map[string]string
+	if rawMetadata := c.Request.MultipartForm.Value["metadata"]; len(rawMetadata) > 0 && rawMetadata[0] != "" {
+		if err := json.Unmarshal([]byte(rawMetadata[0]), &metadata); err != nil {
+			jsonErr := models.NewBadRequestError("metadata must be a json object of strings", "metadata")
+			c.JSON(jsonErr.StatusCode, jsonErr)
+			return
+		}
+	}
+
+	// uploads count towards the user's storage quota
+	owner := c.GetString(middleware.UserEmailKey)
+
+	// zip archives are unpacked into one file per entry, under the optional prefix, if requested
+	extract := c.Query("extract") == "true"
+	prefix := strings.Trim(c.Query("prefix"), "/")
+
 	wg := sync.WaitGroup{}
 
 	files := c.Request.MultipartForm.File["files"]
@@ -52,7 +76,12 @@ func (h *Handler) PostFiles(c *gin.Context) {
 		go func(fileHeader *multipart.FileHeader) {
 			defer wg.Done()
 
-			jsonErr := h.uploadFile(fileHeader)
+			var jsonErr *models.JSONError
+			if extract && isArchive(fileHeader) {
+				jsonErr = h.extractArchive(fileHeader, prefix, metadata, owner)
+			} else {
+				jsonErr = h.uploadFile(fileHeader, metadata, owner)
+			}
 			if jsonErr != nil {
 				c.JSON(jsonErr.StatusCode, jsonErr)
 				return
@@ -65,12 +94,18 @@ func (h *Handler) PostFiles(c *gin.Context) {
 	c.Status(http.StatusCreated)
 }
 
-func (h *Handler) uploadFile(file *multipart.FileHeader) *models.JSONError {
+func (h *Handler) uploadFile(file *multipart.FileHeader, metadata map[string]string, owner string) *models.JSONError {
 	fileHeader, err := file.Open()
 	if err != nil {
 		return models.NewInternalServerError("cannot open file", "file")
 	}
+	defer fileHeader.Close()
+
+	return h.upload(objectKey(file.Filename), file.Header.Get("Content-Type"), file.Size, fileHeader, metadata, owner)
+}
 
+// upload streams the content to the storage service under the key
+func (h *Handler) upload(key, contentType string, size int64, content io.Reader, metadata map[string]string, owner string) *models.JSONError {
 	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
 	ctx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
@@ -80,20 +115,14 @@ func (h *Handler) uploadFile(file *multipart.FileHeader) *models.JSONError {
 		return models.NewInternalServerError("cannot open upload stream")
 	}
 
-	fileName := file.Filename
-	imagesPrefix := config.AppConfig.Services.Storage.ImagesPrefix
-	documentsPrefix := config.AppConfig.Services.Storage.DocumentsPrefix
-	if lib.IsImage(fileName) && imagesPrefix != "" {
-		fileName = fmt.Sprintf("%s/%s", imagesPrefix, fileName)
-	} else if lib.IsDocument(fileName) && documentsPrefix != "" {
-		fileName = fmt.Sprintf("%s/%s", documentsPrefix, fileName)
-	}
-
 	request := &storage_service.UploadFileRequest{
 		Data: &storage_service.UploadFileRequest_Info{
 			Info: &storage_service.FileInfo{
-				Size:     uint32(file.Size),
-				FileName: fileName,
+				Size:        uint32(size),
+				FileName:    key,
+				ContentType: contentType,
+				Metadata:    metadata,
+				Owner:       owner,
 			},
 		},
 	}
@@ -102,7 +131,7 @@ func (h *Handler) uploadFile(file *multipart.FileHeader) *models.JSONError {
 		return lib.HandleRPCError(err)
 	}
 
-	reader := bufio.NewReader(fileHeader)
+	reader := bufio.NewReader(content)
 	// send file in chunks of 1 KB
 	buffer := make([]byte, 1024)
 
@@ -138,6 +167,18 @@ func (h *Handler) uploadFile(file *multipart.FileHeader) *models.JSONError {
 	return nil
 }
 
+// objectKey places images and documents under their configured prefixes
+func objectKey(fileName string) string {
+	imagesPrefix := config.AppConfig.Services.Storage.ImagesPrefix
+	documentsPrefix := config.AppConfig.Services.Storage.DocumentsPrefix
+	if lib.IsImage(fileName) && imagesPrefix != "" {
+		return fmt.Sprintf("%s/%s", imagesPrefix, fileName)
+	} else if lib.IsDocument(fileName) && documentsPrefix != "" {
+		return fmt.Sprintf("%s/%s", documentsPrefix, fileName)
+	}
+	return fileName
+}
+
 func (h *Handler) GetFilePage(c *gin.Context) {
 	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
 	ctx, cancel := context.WithDeadline(context.Background(), deadline)
@@ -173,12 +214,29 @@ func (h *Handler) GetFile(c *gin.Context) {
 		return
 	}
 
+	// the stored content type of the file is sent, which its resized images keep
+	files, jsonErr := h.getFilesByKey([]string{request.FileName})
+	if jsonErr != nil {
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	contentType := files[0].ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
 	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
 	ctx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
 
 	stream, err := h.RPC.Client.GetFile(ctx, &storage_service.GetFileRequest{
-		FileName: request.FileName,
+		FileName:  request.FileName,
+		VersionId: request.VersionID,
+		Width:     request.Width,
+		Height:    request.Height,
+		Fit:       request.Fit,
+		// compressed files are passed through to the clients accepting their encoding
+		AcceptEncoding: c.GetHeader("Accept-Encoding"),
 	})
 
 	if err != nil {
@@ -189,6 +247,7 @@ func (h *Handler) GetFile(c *gin.Context) {
 	}
 
 	fileData := &bytes.Buffer{}
+	contentEncoding := ""
 
 	for {
 		req, err := stream.Recv()
@@ -204,6 +263,9 @@ func (h *Handler) GetFile(c *gin.Context) {
 			}
 		}
 
+		if req.GetContentEncoding() != "" {
+			contentEncoding = req.GetContentEncoding()
+		}
 		chunk := req.GetChunkData()
 		_, err = fileData.Write(chunk)
 
@@ -214,9 +276,13 @@ func (h *Handler) GetFile(c *gin.Context) {
 		}
 	}
 
-	c.Header("Content-Type", "image/jpeg")
+	c.Header("Content-Type", contentType)
 	c.Header("Access-Control-Expose-Headers", "Content-Disposition")
 	c.Header("Content-Disposition", "attachment; filename="+request.FileName)
+	c.Header("Vary", "Accept-Encoding")
+	if contentEncoding != "" {
+		c.Header("Content-Encoding", contentEncoding)
+	}
 	c.Status(http.StatusOK)
 	c.Writer.Write(fileData.Bytes())
 }
@@ -257,22 +323,28 @@ func (h *Handler) getAllFiles(stream storage_service.Storage_GetFilesClient) ([]
 			}
 		}
 
-		file := &models.GetFilesResponse{
-			Key:          response.Object.GetKey(),
-			Size:         response.Object.GetSize(),
-			StorageClass: response.Object.GetStorageClass(),
-		}
-		lastModified, err := time.Parse(time.RFC3339, response.Object.GetLastModified())
-		if err == nil && !lastModified.IsZero() {
-			file.LastModified = &lastModified
-		}
-
-		files = append(files, file)
+		files = append(files, toFile(response.Object))
 	}
 
 	return files, nil
 }
 
+func toFile(object *storage_service.StorageObject) *models.GetFilesResponse {
+	file := &models.GetFilesResponse{
+		Key:          object.GetKey(),
+		Size:         object.GetSize(),
+		StorageClass: object.GetStorageClass(),
+		ContentType:  object.GetContentType(),
+		SHA256:       object.GetSha256(),
+		Metadata:     object.GetMetadata(),
+	}
+	lastModified, err := time.Parse(time.RFC3339, object.GetLastModified())
+	if err == nil && !lastModified.IsZero() {
+		file.LastModified = &lastModified
+	}
+	return file
+}
+
 func (h *Handler) DeleteFile(c *gin.Context) {
 	request := &models.DeleteFileRequest{}
 
@@ -317,7 +389,10 @@ func (h *Handler) DeleteFiles(c *gin.Context) {
 	ctx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
 
-	_, err = h.RPC.Client.DeleteFiles(ctx, &storage_service.DeleteFilesRequest{Prefix: objectPrefix})
+	_, err = h.RPC.Client.DeleteFiles(ctx, &storage_service.DeleteFilesRequest{
+		Prefix:            objectPrefix,
+		ConfirmationToken: request.ConfirmationToken,
+	})
 	if err != nil {
 		if jsonErr := lib.HandleRPCError(err); err != nil {
 			c.JSON(jsonErr.StatusCode, jsonErr)
@@ -328,6 +403,97 @@ func (h *Handler) DeleteFiles(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+func (h *Handler) GetFileVersions(c *gin.Context) {
+	request := &models.ListFileVersionsRequest{}
+	if err := c.ShouldBind(request); err != nil {
+		jsonErr := models.NewBadRequestError("object key is required", "key")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	response, err := h.RPC.Client.ListVersions(ctx, &storage_service.ListVersionsRequest{
+		Key: request.Key,
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	versions := make([]*models.FileVersion, 0, len(response.GetVersions()))
+	for _, version := range response.GetVersions() {
+		fileVersion := &models.FileVersion{
+			Key:            version.GetKey(),
+			VersionID:      version.GetVersionId(),
+			Size:           version.GetSize(),
+			IsLatest:       version.GetIsLatest(),
+			IsDeleteMarker: version.GetIsDeleteMarker(),
+		}
+		lastModified, err := time.Parse(time.RFC3339, version.GetLastModified())
+		if err == nil && !lastModified.IsZero() {
+			fileVersion.LastModified = &lastModified
+		}
+
+		versions = append(versions, fileVersion)
+	}
+
+	c.JSON(http.StatusOK, versions)
+}
+
+func (h *Handler) RestoreFileVersion(c *gin.Context) {
+	request := &models.FileVersionRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("object key and version id are required", "key", "version_id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	_, err := h.RPC.Client.RestoreVersion(ctx, &storage_service.RestoreVersionRequest{
+		Key:       request.Key,
+		VersionId: request.VersionID,
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (h *Handler) DeleteFileVersion(c *gin.Context) {
+	request := &models.FileVersionRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("object key and version id are required", "key", "version_id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	_, err := h.RPC.Client.DeleteVersion(ctx, &storage_service.DeleteVersionRequest{
+		Key:       request.Key,
+		VersionId: request.VersionID,
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
 func (h *Handler) GetFilesCSV(c *gin.Context) {
 	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
 	ctx, cancel := context.WithDeadline(context.Background(), deadline)
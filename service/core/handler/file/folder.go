@@ -0,0 +1,129 @@
+package file
+
+import (
+	"context"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/core/lib"
+	"github.com/bogdanrat/web-server/service/core/middleware"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// GetFolder returns the immediate sub-folders and files of the folder given by the path query parameter,
+// the root folder if empty, along with the folders' recursive sizes
+func (h *Handler) GetFolder(c *gin.Context) {
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	response, err := h.RPC.Client.ListFolder(ctx, &storage_service.ListFolderRequest{
+		Path: c.Query("path"),
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	folder := &models.FolderResponse{
+		Folder:  toFolder(response.GetFolder()),
+		Folders: make([]*models.Folder, 0, len(response.GetFolders())),
+		Files:   make([]*models.GetFilesResponse, 0, len(response.GetFiles())),
+	}
+	for _, subFolder := range response.GetFolders() {
+		child := toFolder(subFolder)
+		folder.Folders = append(folder.Folders, &child)
+	}
+	for _, file := range response.GetFiles() {
+		folder.Files = append(folder.Files, toFile(file))
+	}
+
+	c.JSON(http.StatusOK, folder)
+}
+
+func (h *Handler) CreateFolder(c *gin.Context) {
+	request := &models.FolderRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("folder path is required", "path")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	_, err := h.RPC.Client.CreateFolder(ctx, &storage_service.CreateFolderRequest{
+		Path:  request.Path,
+		Owner: c.GetString(middleware.UserEmailKey),
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+func (h *Handler) RenameFolder(c *gin.Context) {
+	request := &models.RenameFolderRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("folder path and new path are required", "path", "new_path")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	response, err := h.RPC.Client.RenameFolder(ctx, &storage_service.RenameFolderRequest{
+		Path:      request.Path,
+		NewPath:   request.NewPath,
+		Overwrite: request.Overwrite,
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, &models.TransferFileResponse{Keys: response.GetKeys()})
+}
+
+func (h *Handler) DeleteFolder(c *gin.Context) {
+	request := &models.DeleteFolderRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("folder path is required", "path")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	_, err := h.RPC.Client.DeleteFolder(ctx, &storage_service.DeleteFolderRequest{
+		Path:              request.Path,
+		Recursive:         request.Recursive,
+		ConfirmationToken: request.ConfirmationToken,
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func toFolder(folder *storage_service.Folder) models.Folder {
+	return models.Folder{
+		Path:    folder.GetPath(),
+		Size:    folder.GetSize(),
+		Objects: folder.GetObjects(),
+	}
+}
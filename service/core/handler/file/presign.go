@@ -0,0 +1,110 @@
+package file
+
+import (
+	"context"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/core/lib"
+	"github.com/bogdanrat/web-server/service/core/middleware"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// GetUploadURL returns a presigned url the client uploads the file to, bypassing the core service.
+// The client must then call CompleteUpload, which validates the file and makes it available under its key.
+func (h *Handler) GetUploadURL(c *gin.Context) {
+	request := &models.UploadURLRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("file name is required", "file_name")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	h.presign(c, &storage_service.PresignedURLRequest{
+		Key:         objectKey(request.FileName),
+		Method:      http.MethodPut,
+		ContentType: request.ContentType,
+		Size:        request.Size,
+		Owner:       c.GetString(middleware.UserEmailKey),
+	})
+}
+
+// GetDownloadURL returns a presigned url the client downloads the file from
+func (h *Handler) GetDownloadURL(c *gin.Context) {
+	request := &models.GetFileRequest{}
+	if err := c.ShouldBind(request); err != nil || request.FileName == "" {
+		jsonErr := models.NewBadRequestError("file name is required", "file_name")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	h.presign(c, &storage_service.PresignedURLRequest{
+		Key:    request.FileName,
+		Method: http.MethodGet,
+	})
+}
+
+func (h *Handler) presign(c *gin.Context, request *storage_service.PresignedURLRequest) {
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	response, err := h.RPC.Client.GetPresignedURL(ctx, request)
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	presigned := &models.PresignedURLResponse{
+		Key:    request.GetKey(),
+		URL:    response.GetUrl(),
+		Method: response.GetMethod(),
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, response.GetExpiresAt()); err == nil {
+		presigned.ExpiresAt = &expiresAt
+	}
+
+	c.JSON(http.StatusOK, presigned)
+}
+
+// CompleteUpload validates a file uploaded with a presigned url and records its checksum and metadata
+func (h *Handler) CompleteUpload(c *gin.Context) {
+	request := &models.CompleteUploadRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("object key is required", "key")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	response, err := h.RPC.Client.CompleteUpload(ctx, &storage_service.CompleteUploadRequest{
+		Key:         request.Key,
+		ContentType: request.ContentType,
+		Metadata:    request.Metadata,
+		Owner:       c.GetString(middleware.UserEmailKey),
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	file := &models.GetFilesResponse{
+		Key:          response.Object.GetKey(),
+		Size:         response.Object.GetSize(),
+		StorageClass: response.Object.GetStorageClass(),
+		ContentType:  response.Object.GetContentType(),
+		SHA256:       response.Object.GetSha256(),
+		Metadata:     response.Object.GetMetadata(),
+	}
+	if lastModified, err := time.Parse(time.RFC3339, response.Object.GetLastModified()); err == nil {
+		file.LastModified = &lastModified
+	}
+
+	c.JSON(http.StatusCreated, file)
+}
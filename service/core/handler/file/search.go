@@ -0,0 +1,121 @@
+package file
+
+import (
+	"fmt"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/service/core/config"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxTags bounds the tags of a file
+const maxTags = 50
+
+// TagFile sets the tags and the description of a file, replacing the previous ones
+func (h *Handler) TagFile(c *gin.Context) {
+	request := &models.TagFileRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("key is required", "key")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	tags := normalizeTags(request.Tags)
+	if len(tags) > maxTags {
+		jsonErr := models.NewBadRequestError(fmt.Sprintf("a file can have at most %d tags", maxTags), "tags")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	tagged, err := h.Index.TagFile(request.Key, tags, strings.TrimSpace(request.Description))
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not tag file: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	if !tagged {
+		jsonErr := models.NewNotFoundError(fmt.Sprintf("file %s not found", request.Key), "key")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// SearchFiles searches the files by their names, tags, descriptions and the text of the text documents, filtered by
+// tags, type and last modification. The results are ranked by relevance, or by last modification without a query.
+func (h *Handler) SearchFiles(c *gin.Context) {
+	request := &models.SearchFilesRequest{}
+	if err := c.ShouldBindQuery(request); err != nil {
+		jsonErr := models.NewBadRequestError(fmt.Sprintf("invalid search: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	query := &models.FileQuery{
+		Text:  strings.TrimSpace(request.Query),
+		Tags:  normalizeTags(request.Tags),
+		Type:  strings.ToLower(strings.Trim(strings.TrimSpace(request.Type), ".")),
+		Limit: request.Limit,
+	}
+	maxResults := config.AppConfig.Search.MaxResults
+	if query.Limit <= 0 || (maxResults > 0 && query.Limit > maxResults) {
+		query.Limit = maxResults
+	}
+
+	var err error
+	if query.From, err = parseSearchTime(request.From, false); err != nil {
+		jsonErr := models.NewBadRequestError("from must be a date or an RFC 3339 time", "from")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	if query.To, err = parseSearchTime(request.To, true); err != nil {
+		jsonErr := models.NewBadRequestError("to must be a date or an RFC 3339 time", "to")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	results, err := h.Index.SearchFiles(query)
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not search files: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+// normalizeTags lowercases the tags and drops the empty and duplicate ones
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// parseSearchTime parses a date, as its start, or as its end if the bound is inclusive of the day, or an RFC 3339 time
+func parseSearchTime(value string, endOfDay bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			date = date.Add(time.Hour*24 - time.Nanosecond)
+		}
+		return &date, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
@@ -0,0 +1,293 @@
+package file
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/core/config"
+	"github.com/bogdanrat/web-server/service/core/lib"
+	"github.com/bogdanrat/web-server/service/core/middleware"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// shareTokenSize is the number of random bytes of a share token
+const shareTokenSize = 32
+
+// maxShareExpiration bounds the expiration of the shares when it is unlimited, so that it cannot overflow a duration
+const maxShareExpiration = 100 * 365 * 24 * 60 * 60
+
+// sharePasswordHeader carries the password of a protected share, which can also be posted as the password form field
+const sharePasswordHeader = "X-Share-Password"
+
+// CreateShare creates a public link to a file, or to the files with a prefix if the key ends with a slash.
+// The token is only returned in the response, only its hash is stored.
+func (h *Handler) CreateShare(c *gin.Context) {
+	request := &models.CreateShareRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("key is required", "key")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	shareConfig := config.AppConfig.Shares
+	expiresIn := request.ExpiresIn
+	if expiresIn == 0 {
+		expiresIn = shareConfig.DefaultExpiration
+	}
+	maxExpiration := shareConfig.MaxExpiration
+	if maxExpiration <= 0 || maxExpiration > maxShareExpiration {
+		maxExpiration = maxShareExpiration
+	}
+	if expiresIn <= 0 || expiresIn > maxExpiration {
+		jsonErr := models.NewBadRequestError(fmt.Sprintf("expiration must be between 1 and %d seconds", maxExpiration), "expires_in")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	if request.MaxDownloads < 0 {
+		jsonErr := models.NewBadRequestError("max downloads cannot be negative", "max_downloads")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	// the shared files must exist when the share is created
+	var jsonErr *models.JSONError
+	if strings.HasSuffix(request.Key, "/") {
+		_, jsonErr = h.getFilesByPrefix(request.Key)
+	} else {
+		_, jsonErr = h.getFilesByKey([]string{request.Key})
+	}
+	if jsonErr != nil {
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not generate share token: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	share := &models.Share{
+		Owner:        c.GetString(middleware.UserEmailKey),
+		TokenHash:    hashShareToken(token),
+		Key:          request.Key,
+		ExpiresAt:    time.Now().Add(time.Second * time.Duration(expiresIn)),
+		MaxDownloads: request.MaxDownloads,
+	}
+	if request.Password != "" {
+		if err = share.HashPassword(request.Password); err != nil {
+			jsonErr := models.NewInternalServerError(fmt.Sprintf("could not hash password: %s", err))
+			c.JSON(jsonErr.StatusCode, jsonErr)
+			return
+		}
+	}
+
+	if err = h.Shares.InsertShare(share); err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not create share: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.JSON(http.StatusCreated, &models.CreateShareResponse{
+		Share: share,
+		Token: token,
+		URL:   strings.TrimSuffix(shareConfig.BaseURL, "/") + "/s/" + token,
+	})
+}
+
+// GetShares returns the shares of the user, including the expired and revoked ones
+func (h *Handler) GetShares(c *gin.Context) {
+	shares, err := h.Shares.GetSharesByOwner(c.GetString(middleware.UserEmailKey))
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not get shares: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, shares)
+}
+
+func (h *Handler) RevokeShare(c *gin.Context) {
+	request := &models.RevokeShareRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("share id is required", "id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	revoked, err := h.Shares.RevokeShare(request.ID, c.GetString(middleware.UserEmailKey))
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not revoke share: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	if !revoked {
+		jsonErr := models.NewNotFoundError(fmt.Sprintf("share %d not found", request.ID), "id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetShared downloads a shared file, without authentication. A shared prefix is downloaded as a zip archive, or one of
+// its files with the file query parameter, relative to the prefix. Every download counts towards the share's limit.
+func (h *Handler) GetShared(c *gin.Context) {
+	share, err := h.Shares.GetShareByTokenHash(hashShareToken(c.Param("token")))
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not get share: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	// revoked and expired shares are not told apart from unknown tokens
+	if share == nil || share.RevokedAt != nil || !share.ExpiresAt.After(time.Now()) {
+		jsonErr := models.NewNotFoundError("share not found")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	password := c.GetHeader(sharePasswordHeader)
+	if password == "" {
+		password = c.PostForm("password")
+	}
+	if err = share.CheckPassword(password); err != nil {
+		jsonErr := models.NewUnauthorizedError("invalid share password", "password")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	prefix := ""
+	key := share.Key
+	if strings.HasSuffix(share.Key, "/") {
+		prefix = share.Key
+		key = ""
+		if file := c.Query("file"); file != "" {
+			if key, err = sharedFileKey(share.Key, file); err != nil {
+				jsonErr := models.NewBadRequestError(fmt.Sprintf("invalid file %s: %s", file, err), "file")
+				c.JSON(jsonErr.StatusCode, jsonErr)
+				return
+			}
+		}
+	}
+
+	// the files are resolved before the download is counted, so that a missing file does not use it up
+	var files []*models.GetFilesResponse
+	var jsonErr *models.JSONError
+	if key != "" {
+		files, jsonErr = h.getFilesByKey([]string{key})
+	} else {
+		files, jsonErr = h.getFilesByPrefix(prefix)
+	}
+	if jsonErr != nil {
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	claimed, err := h.Shares.ClaimShareDownload(share.ID)
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not count download: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	if !claimed {
+		jsonErr := models.NewNotFoundError("share not found")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	if key == "" {
+		h.streamArchive(c, prefix, files)
+		return
+	}
+	h.streamFile(c, files[0])
+}
+
+// streamFile writes the file's chunks to the response as they are received
+func (h *Handler) streamFile(c *gin.Context, file *models.GetFilesResponse) {
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	stream, err := h.RPC.Client.GetFile(ctx, &storage_service.GetFileRequest{
+		FileName: file.Key,
+	})
+	if err != nil {
+		rpcError(c, err)
+		return
+	}
+
+	// the first chunk is received before the headers are written, while an error can still be returned
+	response, err := stream.Recv()
+	if err != nil && err != io.EOF {
+		rpcError(c, err)
+		return
+	}
+
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Access-Control-Expose-Headers", "Content-Disposition")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, strings.ReplaceAll(path.Base(file.Key), `"`, "")))
+	c.Status(http.StatusOK)
+
+	for err == nil {
+		if _, err = c.Writer.Write(response.GetChunkData()); err != nil {
+			break
+		}
+		c.Writer.Flush()
+		response, err = stream.Recv()
+	}
+	// once streaming started, the status cannot change: a failure truncates the response
+	if err != io.EOF {
+		log.Printf("cannot stream %s: %s", file.Key, err)
+	}
+}
+
+// rpcError responds with the error of a failed call, as an internal error if the call returned none
+func rpcError(c *gin.Context, err error) {
+	jsonErr := lib.HandleRPCError(err)
+	if jsonErr == nil {
+		jsonErr = models.NewInternalServerError(err.Error())
+	}
+	c.JSON(jsonErr.StatusCode, jsonErr)
+}
+
+// sharedFileKey returns the key of a file of a shared prefix, rejecting paths that could escape the prefix
+func sharedFileKey(prefix, file string) (string, error) {
+	if path.IsAbs(file) {
+		return "", fmt.Errorf("absolute path")
+	}
+	for _, segment := range strings.Split(file, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("parent directory reference")
+		}
+	}
+	return prefix + path.Clean(file), nil
+}
+
+func newShareToken() (string, error) {
+	token := make([]byte, shareTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func hashShareToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,67 @@
+package file
+
+import (
+	"context"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/core/lib"
+	"github.com/bogdanrat/web-server/service/core/middleware"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// CopyFile copies a file, or all files with a prefix, server-side
+func (h *Handler) CopyFile(c *gin.Context) {
+	request := &models.TransferFileRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("source and destination keys are required", "src_key", "dst_key")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	response, err := h.RPC.Client.CopyFile(ctx, &storage_service.CopyFileRequest{
+		SrcKey:    request.SrcKey,
+		DstKey:    request.DstKey,
+		Overwrite: request.Overwrite,
+		Owner:     c.GetString(middleware.UserEmailKey),
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, &models.TransferFileResponse{Keys: response.GetKeys()})
+}
+
+// MoveFile moves (renames) a file, or all files with a prefix, server-side
+func (h *Handler) MoveFile(c *gin.Context) {
+	request := &models.TransferFileRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("source and destination keys are required", "src_key", "dst_key")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	response, err := h.RPC.Client.MoveFile(ctx, &storage_service.MoveFileRequest{
+		SrcKey:    request.SrcKey,
+		DstKey:    request.DstKey,
+		Overwrite: request.Overwrite,
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, &models.TransferFileResponse{Keys: response.GetKeys()})
+}
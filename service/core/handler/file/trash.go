@@ -0,0 +1,132 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/core/lib"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ConfirmDeleteFiles issues the token required to delete all files with a prefix
+func (h *Handler) ConfirmDeleteFiles(c *gin.Context) {
+	request := &models.ConfirmDeleteFilesRequest{}
+	err := json.NewDecoder(c.Request.Body).Decode(request)
+	if err != nil && err != io.EOF {
+		jsonErr := models.NewBadRequestError("invalid json body", "prefix")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	objectPrefix := ""
+	if request.Prefix != nil {
+		objectPrefix = *request.Prefix
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	response, err := h.RPC.Client.ConfirmDeleteFiles(ctx, &storage_service.ConfirmDeleteFilesRequest{Prefix: objectPrefix})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	confirmation := &models.ConfirmDeleteFilesResponse{
+		ConfirmationToken: response.GetConfirmationToken(),
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, response.GetExpiresAt()); err == nil {
+		confirmation.ExpiresAt = &expiresAt
+	}
+
+	c.JSON(http.StatusOK, confirmation)
+}
+
+func (h *Handler) GetTrash(c *gin.Context) {
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	response, err := h.RPC.Client.GetTrash(ctx, &storage_service.GetTrashRequest{})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	files := make([]*models.TrashedFile, 0, len(response.GetObjects()))
+	for _, object := range response.GetObjects() {
+		file := &models.TrashedFile{
+			TrashID: object.GetTrashId(),
+			Key:     object.GetKey(),
+			Size:    object.GetSize(),
+		}
+		if deletedAt, err := time.Parse(time.RFC3339, object.GetDeletedAt()); err == nil {
+			file.DeletedAt = &deletedAt
+		}
+		if expiresAt, err := time.Parse(time.RFC3339, object.GetExpiresAt()); err == nil {
+			file.ExpiresAt = &expiresAt
+		}
+
+		files = append(files, file)
+	}
+
+	c.JSON(http.StatusOK, files)
+}
+
+func (h *Handler) RestoreTrashed(c *gin.Context) {
+	request := &models.TrashRequest{}
+	if err := c.ShouldBindJSON(request); err != nil || request.TrashID == "" {
+		jsonErr := models.NewBadRequestError("trash id is required", "trash_id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	_, err := h.RPC.Client.RestoreTrashed(ctx, &storage_service.RestoreTrashedRequest{
+		TrashId:   request.TrashID,
+		Overwrite: request.Overwrite,
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// PurgeTrash permanently deletes a file from the trash, or empties the trash if all is set
+func (h *Handler) PurgeTrash(c *gin.Context) {
+	request := &models.TrashRequest{}
+	if err := c.ShouldBindJSON(request); err != nil || (request.TrashID == "") == !request.All {
+		jsonErr := models.NewBadRequestError("either trash id or all is required", "trash_id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	_, err := h.RPC.Client.PurgeTrash(ctx, &storage_service.PurgeTrashRequest{
+		TrashId: request.TrashID,
+		All:     request.All,
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
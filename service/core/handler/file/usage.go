@@ -0,0 +1,50 @@
+package file
+
+import (
+	"context"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/core/lib"
+	"github.com/bogdanrat/web-server/service/core/middleware"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// GetUsage returns the storage used by the user and by prefix, along with their quotas
+func (h *Handler) GetUsage(c *gin.Context) {
+	deadline := time.Now().Add(time.Millisecond * time.Duration(h.RPC.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	response, err := h.RPC.Client.GetUsage(ctx, &storage_service.GetUsageRequest{
+		Owner: c.GetString(middleware.UserEmailKey),
+	})
+	if err != nil {
+		jsonErr := lib.HandleRPCError(err)
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	usage := &models.UsageResponse{
+		Owner:    toUsage(response.GetOwner()),
+		Prefixes: make([]*models.PrefixUsage, 0, len(response.GetPrefixes())),
+	}
+	for _, prefix := range response.GetPrefixes() {
+		usage.Prefixes = append(usage.Prefixes, &models.PrefixUsage{
+			Prefix: prefix.GetPrefix(),
+			Usage:  toUsage(prefix.GetUsage()),
+		})
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
+
+func toUsage(usage *storage_service.Usage) models.Usage {
+	return models.Usage{
+		Bytes:      usage.GetBytes(),
+		Objects:    usage.GetObjects(),
+		MaxBytes:   usage.GetMaxBytes(),
+		MaxObjects: usage.GetMaxObjects(),
+	}
+}
@@ -0,0 +1,277 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/service/core/config"
+	"github.com/bogdanrat/web-server/service/core/middleware"
+	"github.com/bogdanrat/web-server/service/core/store"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// secretSize is the number of random bytes of a webhook secret
+	secretSize = 32
+	maxURLSize = 2048
+	// maxDeliveries bounds the deliveries returned at once
+	maxDeliveries = 100
+)
+
+type Handler struct {
+	Webhooks store.Webhooks
+}
+
+func NewHandler(webhooks store.Webhooks) *Handler {
+	return &Handler{
+		Webhooks: webhooks,
+	}
+}
+
+// GetWebhooks returns the webhooks of the user, without their secrets
+func (h *Handler) GetWebhooks(c *gin.Context) {
+	webhooks, err := h.Webhooks.GetWebhooksByOwner(c.GetString(middleware.UserEmailKey))
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not get webhooks: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// CreateWebhook subscribes an endpoint to events. The secret signing the deliveries is only returned in the response.
+func (h *Handler) CreateWebhook(c *gin.Context) {
+	request := &models.CreateWebhookRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("url is required", "url")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	webhook := &models.Webhook{
+		Owner:  c.GetString(middleware.UserEmailKey),
+		URL:    strings.TrimSpace(request.URL),
+		Events: request.Events,
+		Prefix: request.Prefix,
+		Active: request.Active == nil || *request.Active,
+	}
+	if jsonErr := validateWebhook(webhook); jsonErr != nil {
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	maxWebhooks := config.AppConfig.Webhooks.MaxWebhooks
+	if maxWebhooks > 0 {
+		webhooks, err := h.Webhooks.GetWebhooksByOwner(webhook.Owner)
+		if err != nil {
+			jsonErr := models.NewInternalServerError(fmt.Sprintf("could not get webhooks: %s", err))
+			c.JSON(jsonErr.StatusCode, jsonErr)
+			return
+		}
+		if len(webhooks) >= maxWebhooks {
+			jsonErr := models.NewBadRequestError(fmt.Sprintf("a user can have at most %d webhooks", maxWebhooks))
+			c.JSON(jsonErr.StatusCode, jsonErr)
+			return
+		}
+	}
+
+	var err error
+	if webhook.Secret, err = newSecret(); err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not generate webhook secret: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	if err = h.Webhooks.InsertWebhook(webhook); err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not create webhook: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.JSON(http.StatusCreated, &models.WebhookResponse{
+		Webhook: webhook,
+		Secret:  webhook.Secret,
+	})
+}
+
+// UpdateWebhook replaces the url and the filters of the webhook, and optionally rotates its secret, which is then returned
+func (h *Handler) UpdateWebhook(c *gin.Context) {
+	request := &models.UpdateWebhookRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("webhook id and url are required")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	webhook, err := h.Webhooks.GetWebhook(request.ID, c.GetString(middleware.UserEmailKey))
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not get webhook: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	if webhook == nil {
+		jsonErr := models.NewNotFoundError(fmt.Sprintf("webhook %d not found", request.ID), "id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	webhook.URL = strings.TrimSpace(request.URL)
+	webhook.Events = request.Events
+	webhook.Prefix = request.Prefix
+	if request.Active != nil {
+		webhook.Active = *request.Active
+	}
+	if jsonErr := validateWebhook(webhook); jsonErr != nil {
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	response := &models.WebhookResponse{Webhook: webhook}
+	if request.RotateSecret {
+		if webhook.Secret, err = newSecret(); err != nil {
+			jsonErr := models.NewInternalServerError(fmt.Sprintf("could not generate webhook secret: %s", err))
+			c.JSON(jsonErr.StatusCode, jsonErr)
+			return
+		}
+		response.Secret = webhook.Secret
+	}
+
+	updated, err := h.Webhooks.UpdateWebhook(webhook)
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not update webhook: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	if !updated {
+		jsonErr := models.NewNotFoundError(fmt.Sprintf("webhook %d not found", request.ID), "id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteWebhook deletes the webhook, along with its pending and past deliveries
+func (h *Handler) DeleteWebhook(c *gin.Context) {
+	request := &models.DeleteWebhookRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("webhook id is required", "id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	deleted, err := h.Webhooks.DeleteWebhook(request.ID, c.GetString(middleware.UserEmailKey))
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not delete webhook: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	if !deleted {
+		jsonErr := models.NewNotFoundError(fmt.Sprintf("webhook %d not found", request.ID), "id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetDeliveries returns the latest deliveries of the webhook, with the outcome of their last attempt
+func (h *Handler) GetDeliveries(c *gin.Context) {
+	request := &models.GetWebhookDeliveriesRequest{}
+	if err := c.ShouldBindQuery(request); err != nil {
+		jsonErr := models.NewBadRequestError("webhook id is required", "webhook_id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	switch request.Status {
+	case "", models.WebhookDeliveryPending, models.WebhookDeliveryDelivered, models.WebhookDeliveryFailed:
+	default:
+		jsonErr := models.NewBadRequestError(fmt.Sprintf("status must be %s, %s or %s",
+			models.WebhookDeliveryPending, models.WebhookDeliveryDelivered, models.WebhookDeliveryFailed), "status")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	if request.Limit <= 0 || request.Limit > maxDeliveries {
+		request.Limit = maxDeliveries
+	}
+
+	deliveries, err := h.Webhooks.GetWebhookDeliveries(request.WebhookID, c.GetString(middleware.UserEmailKey), request.Status, request.Limit)
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not get webhook deliveries: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// Redeliver queues a delivery to be sent again, with its attempts reset, whether it was delivered or it failed.
+// The deliveries of an inactive webhook are sent once it is activated again.
+func (h *Handler) Redeliver(c *gin.Context) {
+	request := &models.RedeliverWebhookRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		jsonErr := models.NewBadRequestError("delivery id is required", "id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	queued, err := h.Webhooks.RedeliverWebhookDelivery(request.ID, c.GetString(middleware.UserEmailKey))
+	if err != nil {
+		jsonErr := models.NewInternalServerError(fmt.Sprintf("could not redeliver: %s", err))
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+	if !queued {
+		jsonErr := models.NewNotFoundError(fmt.Sprintf("delivery %d not found", request.ID), "id")
+		c.JSON(jsonErr.StatusCode, jsonErr)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// validateWebhook checks the url, which must use https unless in development mode, and normalizes the events, which
+// must not be reserved to the administrators unless the owner is one
+func validateWebhook(webhook *models.Webhook) *models.JSONError {
+	endpoint, err := url.Parse(webhook.URL)
+	if err != nil || endpoint.Host == "" || len(webhook.URL) > maxURLSize {
+		return models.NewBadRequestError("url must be an absolute url", "url")
+	}
+	if endpoint.Scheme != "https" && !(endpoint.Scheme == "http" && config.AppConfig.Server.DevelopmentMode) {
+		return models.NewBadRequestError("url must use https", "url")
+	}
+	if endpoint.User != nil {
+		return models.NewBadRequestError("url cannot contain credentials, the deliveries are signed instead", "url")
+	}
+
+	events := make([]string, 0, len(webhook.Events))
+	seen := make(map[string]bool, len(webhook.Events))
+	for _, event := range webhook.Events {
+		if !models.IsWebhookEvent(event) {
+			return models.NewBadRequestError(fmt.Sprintf("unknown event %q, the events are %s", event, strings.Join(models.WebhookEvents, ", ")), "events")
+		}
+		if models.IsAdminWebhookEvent(event) && !config.AppConfig.Webhooks.IsAdmin(webhook.Owner) {
+			return models.NewBadRequestError(fmt.Sprintf("event %q is only delivered to the administrators", event), "events")
+		}
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+	webhook.Events = events
+	return nil
+}
+
+func newSecret() (string, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
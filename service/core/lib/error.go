@@ -13,7 +13,20 @@ func HandleRPCError(err error) *models.JSONError {
 		errorCode := status.Code(err)
 
 		switch errorCode {
-		case codes.InvalidArgument, codes.ResourceExhausted:
+		case codes.ResourceExhausted:
+			errorStatus := status.Convert(err)
+			jsonErr = models.NewBadRequestError(errorStatus.Message())
+			for _, details := range errorStatus.Details() {
+				switch info := details.(type) {
+				case *epb.QuotaFailure:
+					for _, violation := range info.GetViolations() {
+						jsonErr = models.NewInsufficientStorageError(violation.GetDescription(), violation.GetSubject())
+					}
+				case *epb.BadRequest_FieldViolation:
+					jsonErr = models.NewBadRequestError(info.Description, info.Field)
+				}
+			}
+		case codes.InvalidArgument:
 			errorStatus := status.Convert(err)
 			for _, details := range errorStatus.Details() {
 				switch info := details.(type) {
@@ -23,6 +36,14 @@ func HandleRPCError(err error) *models.JSONError {
 					jsonErr = models.NewInternalServerError(err.Error())
 				}
 			}
+		case codes.AlreadyExists:
+			errorStatus := status.Convert(err)
+			jsonErr = models.NewConflictError(errorStatus.Message())
+			for _, details := range errorStatus.Details() {
+				if info, ok := details.(*epb.BadRequest_FieldViolation); ok {
+					jsonErr = models.NewConflictError(info.Description, info.Field)
+				}
+			}
 		case codes.PermissionDenied:
 			jsonErr = models.NewUnauthorizedError(err.Error())
 		case codes.NotFound:
@@ -0,0 +1,59 @@
+package listener
+
+import (
+	"fmt"
+	"github.com/bogdanrat/web-server/service/core/cache"
+	"github.com/bogdanrat/web-server/service/queue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	deduplicationKeyPrefix = "processed-event"
+)
+
+var (
+	duplicateEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "events_duplicates_dropped_total",
+			Help: "Number of duplicate events dropped before being handled",
+		},
+		[]string{"type"},
+	)
+)
+
+// Deduplicator remembers the ids of the events being processed,
+// so that an event delivered more than once by the message broker is handled only once.
+type Deduplicator struct {
+	Cache cache.Client
+	// TTL is the time, in seconds, an event id is remembered for
+	TTL int
+}
+
+func NewDeduplicator(cacheClient cache.Client, ttl int) *Deduplicator {
+	return &Deduplicator{
+		Cache: cacheClient,
+		TTL:   ttl,
+	}
+}
+
+// Claim marks the event as being processed, returning false if it was already claimed.
+func (d *Deduplicator) Claim(envelope *queue.Envelope) (bool, error) {
+	claimed, err := d.Cache.SetIfAbsent(deduplicationKey(envelope), envelope.Type, d.TTL)
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		duplicateEvents.WithLabelValues(envelope.Type).Inc()
+	}
+	return claimed, nil
+}
+
+// Release forgets the event, allowing it to be processed again when redelivered.
+func (d *Deduplicator) Release(envelope *queue.Envelope) error {
+	return d.Cache.Delete(deduplicationKey(envelope))
+}
+
+func deduplicationKey(envelope *queue.Envelope) string {
+	return fmt.Sprintf("%s:%s:%s", deduplicationKeyPrefix, envelope.Source, envelope.ID)
+}
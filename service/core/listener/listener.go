@@ -6,6 +6,8 @@ import (
 	"github.com/bogdanrat/web-server/contracts/models"
 	"github.com/bogdanrat/web-server/service/core/i18n"
 	"github.com/bogdanrat/web-server/service/core/mail"
+	"github.com/bogdanrat/web-server/service/core/search"
+	"github.com/bogdanrat/web-server/service/core/webhook"
 	"github.com/bogdanrat/web-server/service/queue"
 	"log"
 )
@@ -13,17 +15,33 @@ import (
 type EventProcessor struct {
 	EventListener queue.EventListener
 	Translator    i18n.Translator
+	// Deduplicator is optional; when set, events with an already processed id are dropped
+	Deduplicator *Deduplicator
+	// Indexer is optional; when set, the files changed by the storage events are indexed again
+	Indexer *search.Indexer
+	// Webhooks is optional; when set, the events are delivered to the webhooks subscribed to them
+	Webhooks *webhook.Dispatcher
 }
 
-func NewEventProcessor(listener queue.EventListener, translator i18n.Translator) *EventProcessor {
+func NewEventProcessor(listener queue.EventListener, translator i18n.Translator, deduplicator *Deduplicator, indexer *search.Indexer, webhooks *webhook.Dispatcher) *EventProcessor {
 	return &EventProcessor{
 		EventListener: listener,
 		Translator:    translator,
+		Deduplicator:  deduplicator,
+		Indexer:       indexer,
+		Webhooks:      webhooks,
 	}
 }
 
 func (p *EventProcessor) ProcessEvent() error {
-	received, errors, err := p.EventListener.Listen(models.UserSignUpEventName, models.NewKeyValuePairEventName, models.DeleteKeyValuePairEventName)
+	received, errors, err := p.EventListener.Listen(
+		models.UserSignUpEventName,
+		models.NewKeyValuePairEventName,
+		models.DeleteKeyValuePairEventName,
+		models.FileUploadedEventName,
+		models.FileDeletedEventName,
+		models.PrefixDeletedEventName,
+	)
 	if err != nil {
 		return fmt.Errorf("could not listen for events: %s", err)
 	}
@@ -31,29 +49,75 @@ func (p *EventProcessor) ProcessEvent() error {
 	for {
 		select {
 		case event := <-received:
-			p.handleEvent(event)
+			err := p.HandleEvent(event)
+			if err != nil {
+				log.Printf("could not handle event %s: %s", event.Name(), err)
+			}
+			queue.Acknowledge(event, err)
 		case err := <-errors:
 			log.Printf("received error while processing message: %s", err)
 		}
 	}
 }
 
-func (p *EventProcessor) handleEvent(event queue.Event) {
+// HandleEvent dispatches the event to its handler
+func (p *EventProcessor) HandleEvent(event queue.Event) error {
+	event, envelope := queue.Unwrap(event)
+	if p.Deduplicator == nil || envelope == nil || envelope.ID == "" {
+		return p.process(event, envelope)
+	}
+
+	claimed, err := p.Deduplicator.Claim(envelope)
+	if err != nil {
+		return fmt.Errorf("could not check event %s for duplicates: %s", envelope.ID, err)
+	}
+	if !claimed {
+		log.Printf("Dropped duplicate event %s (%s)\n", envelope.ID, envelope.Type)
+		return nil
+	}
+
+	if err = p.process(event, envelope); err != nil {
+		// let the event be handled again when the message broker redelivers it
+		if releaseErr := p.Deduplicator.Release(envelope); releaseErr != nil {
+			log.Printf("could not release event %s: %s", envelope.ID, releaseErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// process queues the event for the webhooks before handling it. The webhooks are not delivered an event twice when its
+// handling fails and it is redelivered, as long as it has an id.
+func (p *EventProcessor) process(event queue.Event, envelope *queue.Envelope) error {
+	if p.Webhooks != nil {
+		if err := p.Webhooks.Dispatch(event, envelope); err != nil {
+			return fmt.Errorf("could not dispatch event to webhooks: %s", err)
+		}
+	}
+	return p.handleEvent(event)
+}
+
+func (p *EventProcessor) handleEvent(event queue.Event) error {
 	switch e := event.(type) {
 	case *models.UserSignUpEvent:
-		p.handleUserSignUpEvent(e)
+		return p.handleUserSignUpEvent(e)
 	case *models.NewKeyValuePairEvent, *models.DeleteKeyValuePairEvent:
-		p.handleKeyValuePairEvent()
+		return p.handleKeyValuePairEvent()
+	case *models.FileUploadedEvent:
+		return p.handleFileEvent(e.Key)
+	case *models.FileDeletedEvent:
+		return p.handleFileEvent(e.Key)
+	case *models.PrefixDeletedEvent:
+		return p.handleFileEvent(e.Prefix)
 	default:
-		log.Printf("unknown event: %t", e)
+		return fmt.Errorf("unknown event: %T", e)
 	}
 }
 
-func (p *EventProcessor) handleUserSignUpEvent(event *models.UserSignUpEvent) {
+func (p *EventProcessor) handleUserSignUpEvent(event *models.UserSignUpEvent) error {
 	user := event.User
 	if user == nil {
-		log.Printf("event user field is nil")
-		return
+		return fmt.Errorf("event user field is nil")
 	}
 
 	email := &mail.Message{
@@ -78,14 +142,24 @@ func (p *EventProcessor) handleUserSignUpEvent(event *models.UserSignUpEvent) {
 	email.Body = buffer.String()
 
 	if err := mail.Send(email); err != nil {
-		log.Printf("cannot send email: %s", err)
+		return fmt.Errorf("cannot send email: %s", err)
 	}
 
 	log.Printf("Sent Welcome Email to %s\n", user.Email)
+	return nil
 }
 
-func (p *EventProcessor) handleKeyValuePairEvent() {
+func (p *EventProcessor) handleKeyValuePairEvent() error {
 	if err := p.Translator.Reload(); err != nil {
-		log.Printf("cannot reload translations: %s", err)
+		return fmt.Errorf("cannot reload translations: %s", err)
+	}
+	return nil
+}
+
+// handleFileEvent indexes the files with the key, or prefix, again
+func (p *EventProcessor) handleFileEvent(prefix string) error {
+	if p.Indexer != nil {
+		p.Indexer.Sync(prefix)
 	}
+	return nil
 }
@@ -11,6 +11,9 @@ import (
 	"strings"
 )
 
+// UserEmailKey is the context key of the authorized user's email
+const UserEmailKey = "user_email"
+
 var (
 	pathsToSkipFromAuthorization = []string{"/sign-up", "/login", "/logout", "/token/refresh"}
 )
@@ -47,6 +50,8 @@ func Authorization(developmentMode bool, cacheClient cache.Client, authClient pb
 				c.Abort()
 				return
 			}
+
+			c.Set(UserEmailKey, response.Email)
 		}
 
 		// It executes the pending handlers in the chain inside the calling handler
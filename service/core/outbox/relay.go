@@ -0,0 +1,120 @@
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bogdanrat/web-server/service/core/config"
+	"github.com/bogdanrat/web-server/service/core/store"
+	"github.com/bogdanrat/web-server/service/queue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"time"
+)
+
+var (
+	failedMessages = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "outbox_failed_messages",
+			Help: "Number of outbox messages given up on after the maximum attempts, kept in the outbox with their last error",
+		},
+	)
+)
+
+// Relay publishes the events written to the outbox through the configured event emitter.
+type Relay struct {
+	Outbox       store.Outbox
+	EventEmitter queue.EventEmitter
+	Config       config.OutboxConfig
+}
+
+// outboxEvent is an already serialized event, emitted as it was stored in the outbox
+type outboxEvent struct {
+	name    string
+	payload json.RawMessage
+}
+
+func (e *outboxEvent) Name() string {
+	return e.name
+}
+
+func (e *outboxEvent) MarshalJSON() ([]byte, error) {
+	return e.payload, nil
+}
+
+func NewRelay(outbox store.Outbox, eventEmitter queue.EventEmitter, outboxConfig config.OutboxConfig) *Relay {
+	return &Relay{
+		Outbox:       outbox,
+		EventEmitter: eventEmitter,
+		Config:       outboxConfig,
+	}
+}
+
+// Start polls the outbox until the process exits
+func (r *Relay) Start() {
+	ticker := time.NewTicker(time.Millisecond * time.Duration(r.Config.PollInterval))
+	defer ticker.Stop()
+
+	publishTimeout := time.Millisecond * time.Duration(r.Config.PublishTimeout)
+	retryInterval := time.Millisecond * time.Duration(r.Config.RetryInterval)
+	for range ticker.C {
+		// the messages are published one by one, keeping their order, so the lease outlasts the whole batch
+		messages, err := r.Outbox.ClaimOutboxMessages(r.Config.BatchSize, r.Config.MaxAttempts, publishTimeout*time.Duration(r.Config.BatchSize+1))
+		if err != nil {
+			log.Printf("could not claim outbox messages: %s", err)
+			continue
+		}
+
+		for _, message := range messages {
+			if publishErr := r.publish(message, publishTimeout); publishErr != nil {
+				err = r.Outbox.MarkOutboxMessageFailed(message.ID, publishErr, retryInterval, r.Config.MaxAttempts)
+			} else {
+				err = r.Outbox.MarkOutboxMessageSent(message.ID)
+			}
+			// a message which cannot be marked is published again once its lease expires
+			if err != nil {
+				log.Printf("could not mark outbox message %d: %s", message.ID, err)
+			}
+		}
+
+		if failed, err := r.Outbox.CountFailedOutboxMessages(r.Config.MaxAttempts); err != nil {
+			log.Printf("could not count failed outbox messages: %s", err)
+		} else {
+			failedMessages.Set(float64(failed))
+		}
+	}
+}
+
+// publish emits the message, failing if it is not emitted within the timeout. An emit which times out may still succeed,
+// the event then being published twice, with the same id.
+func (r *Relay) publish(message *store.OutboxMessage, timeout time.Duration) error {
+	event := &queue.EnvelopedEvent{
+		Event: &outboxEvent{
+			name:    message.EventName,
+			payload: message.Payload,
+		},
+		Envelope: &queue.Envelope{
+			ID:   message.EventID,
+			Time: message.CreatedAt,
+		},
+	}
+
+	emitted := make(chan error, 1)
+	go func() {
+		emitted <- r.EventEmitter.Emit(event)
+	}()
+
+	var err error
+	select {
+	case err = <-emitted:
+	case <-time.After(timeout):
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		if message.Attempts+1 >= r.Config.MaxAttempts {
+			log.Printf("giving up on outbox message %d (%s) after %d attempts: %s", message.ID, message.EventName, message.Attempts+1, err)
+		}
+		return fmt.Errorf("cannot emit event %s: %s", message.EventName, err)
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/bogdanrat/web-server/service/core/handler/file"
 	storeHandler "github.com/bogdanrat/web-server/service/core/handler/store"
 	"github.com/bogdanrat/web-server/service/core/handler/users"
+	webhookHandler "github.com/bogdanrat/web-server/service/core/handler/webhook"
 	"github.com/bogdanrat/web-server/service/core/middleware"
 	"github.com/bogdanrat/web-server/service/core/store"
 	"github.com/bogdanrat/web-server/service/monitor"
@@ -28,7 +29,7 @@ func New(repo store.DatabaseRepository, cacheClient cache.Client, keyValueStore
 	corsConfig := cors.DefaultConfig()
 
 	corsConfig.AllowOrigins = []string{"http://localhost:3000"}
-	corsConfig.AllowHeaders = []string{"Authorization", "Content-Type"}
+	corsConfig.AllowHeaders = []string{"Authorization", "Content-Type", "X-Share-Password"}
 	// To be able to send tokens to the server.
 	corsConfig.AllowCredentials = true
 
@@ -61,7 +62,6 @@ func New(repo store.DatabaseRepository, cacheClient cache.Client, keyValueStore
 			Deadline:    config.AppConfig.Services.Auth.GRPC.Deadline,
 			CallOptions: authOptions,
 		},
-		eventEmitter,
 	)
 
 	usersHandler := users.NewHandler(repo)
@@ -75,10 +75,12 @@ func New(repo store.DatabaseRepository, cacheClient cache.Client, keyValueStore
 		Client:      storageClient,
 		Deadline:    config.AppConfig.Services.Storage.GRPC.Deadline,
 		CallOptions: authOptions,
-	})
+	}, repo, repo)
 
 	storeHandler := storeHandler.NewHandler(keyValueStore, eventEmitter)
 
+	webhookHandler := webhookHandler.NewHandler(repo)
+
 	// public endpoints
 	router.GET("/", func(c *gin.Context) {
 		c.Status(http.StatusOK)
@@ -90,6 +92,10 @@ func New(repo store.DatabaseRepository, cacheClient cache.Client, keyValueStore
 
 	router.GET("/login", authenticationHandler.ShowLogin)
 
+	// shared files are public, the share token grants the access
+	router.GET("/s/:token", fileHandler.GetShared)
+	router.POST("/s/:token", fileHandler.GetShared)
+
 	// private endpoints, requires jwt
 	apiGroup := router.Group("/api").Use(middleware.Authorization(config.AppConfig.Server.DevelopmentMode, authenticationHandler.Cache, authenticationHandler.AuthService.Client))
 
@@ -105,10 +111,45 @@ func New(repo store.DatabaseRepository, cacheClient cache.Client, keyValueStore
 	apiGroup.GET("/file", fileHandler.GetFile)
 	apiGroup.GET("/files", fileHandler.GetFiles)
 	apiGroup.POST("/files", fileHandler.PostFiles)
+	apiGroup.POST("/files/upload-url", fileHandler.GetUploadURL)
+	apiGroup.POST("/files/upload-complete", fileHandler.CompleteUpload)
+	apiGroup.GET("/file/url", fileHandler.GetDownloadURL)
 	apiGroup.DELETE("/file", fileHandler.DeleteFile)
+	apiGroup.POST("/file/copy", fileHandler.CopyFile)
+	apiGroup.POST("/file/move", fileHandler.MoveFile)
+	apiGroup.POST("/files/delete-confirmation", fileHandler.ConfirmDeleteFiles)
 	apiGroup.DELETE("/files", fileHandler.DeleteFiles)
 	apiGroup.GET("/files/csv", fileHandler.GetFilesCSV)
 	apiGroup.GET("/files/excel", fileHandler.GetFilesExcel)
+	apiGroup.GET("/files/archive", fileHandler.GetArchive)
+	apiGroup.POST("/files/archive", fileHandler.GetArchive)
+	apiGroup.GET("/files/search", fileHandler.SearchFiles)
+	apiGroup.PUT("/file/tags", fileHandler.TagFile)
+	apiGroup.GET("/file/versions", fileHandler.GetFileVersions)
+	apiGroup.POST("/file/versions/restore", fileHandler.RestoreFileVersion)
+	apiGroup.DELETE("/file/versions", fileHandler.DeleteFileVersion)
+
+	apiGroup.GET("/folders", fileHandler.GetFolder)
+	apiGroup.POST("/folders", fileHandler.CreateFolder)
+	apiGroup.POST("/folders/rename", fileHandler.RenameFolder)
+	apiGroup.DELETE("/folders", fileHandler.DeleteFolder)
+
+	apiGroup.GET("/shares", fileHandler.GetShares)
+	apiGroup.POST("/shares", fileHandler.CreateShare)
+	apiGroup.DELETE("/shares", fileHandler.RevokeShare)
+
+	apiGroup.GET("/webhooks", webhookHandler.GetWebhooks)
+	apiGroup.POST("/webhooks", webhookHandler.CreateWebhook)
+	apiGroup.PUT("/webhooks", webhookHandler.UpdateWebhook)
+	apiGroup.DELETE("/webhooks", webhookHandler.DeleteWebhook)
+	apiGroup.GET("/webhooks/deliveries", webhookHandler.GetDeliveries)
+	apiGroup.POST("/webhooks/redeliver", webhookHandler.Redeliver)
+
+	apiGroup.GET("/usage", fileHandler.GetUsage)
+
+	apiGroup.GET("/trash", fileHandler.GetTrash)
+	apiGroup.POST("/trash/restore", fileHandler.RestoreTrashed)
+	apiGroup.DELETE("/trash", fileHandler.PurgeTrash)
 
 	apiGroup.GET("/store/pair", storeHandler.GetPair)
 	apiGroup.GET("/store/pairs", storeHandler.GetPairs)
@@ -0,0 +1,212 @@
+package search
+
+import (
+	"context"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/core/config"
+	"github.com/bogdanrat/web-server/service/core/store"
+	"io"
+	"log"
+	"mime"
+	"path"
+	"strings"
+	"time"
+)
+
+// Indexer keeps the file index in sync with the storage. The changed keys and prefixes are queued, then a single worker
+// compares the files the storage service lists under them with the indexed ones.
+type Indexer struct {
+	Index    store.FileIndex
+	Client   storage_service.StorageClient
+	Deadline int64 // milliseconds
+	Config   config.SearchConfig
+
+	changes chan string
+}
+
+func NewIndexer(index store.FileIndex, client storage_service.StorageClient, deadline int64, searchConfig config.SearchConfig) *Indexer {
+	return &Indexer{
+		Index:    index,
+		Client:   client,
+		Deadline: deadline,
+		Config:   searchConfig,
+		changes:  make(chan string, searchConfig.QueueSize),
+	}
+}
+
+// Start indexes the queued changes until the process exits, starting with all the files, and purges the deleted files
+func (i *Indexer) Start() {
+	if err := i.sync(""); err != nil {
+		log.Printf("could not index files: %s", err)
+	}
+
+	ticker := time.NewTicker(time.Second * time.Duration(i.Config.PurgeInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case prefix := <-i.changes:
+			if err := i.sync(prefix); err != nil {
+				log.Printf("could not index files with prefix %q: %s", prefix, err)
+			}
+		case <-ticker.C:
+			deletedBefore := time.Now().Add(-time.Second * time.Duration(i.Config.DeletedRetention))
+			if purged, err := i.Index.PurgeIndexedFiles(deletedBefore); err != nil {
+				log.Printf("could not purge deleted files from the index: %s", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d deleted files from the index\n", purged)
+			}
+		}
+	}
+}
+
+// Sync queues the keys, or prefixes, to be indexed again. The changes are dropped when the queue is full.
+func (i *Indexer) Sync(prefixes ...string) {
+	for _, prefix := range prefixes {
+		select {
+		case i.changes <- prefix:
+		default:
+			log.Printf("index queue full, dropped the change of %q", prefix)
+		}
+	}
+}
+
+// sync indexes the files with the prefix which changed since they were indexed, and removes the deleted ones
+func (i *Indexer) sync(prefix string) error {
+	objects, err := i.listObjects(prefix)
+	if err != nil {
+		return err
+	}
+	indexed, err := i.Index.GetIndexedFiles(prefix)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]*models.IndexedFile, len(indexed))
+	for _, file := range indexed {
+		current[file.Key] = file
+	}
+
+	for _, object := range objects {
+		file, ok := current[object.GetKey()]
+		delete(current, object.GetKey())
+		if ok && !changed(file, object) {
+			continue
+		}
+		if err = i.index(object); err != nil {
+			return err
+		}
+	}
+
+	if len(current) == 0 {
+		return nil
+	}
+	deleted := make([]string, 0, len(current))
+	for key := range current {
+		deleted = append(deleted, key)
+	}
+	return i.Index.DeleteIndexedFiles(deleted...)
+}
+
+func (i *Indexer) listObjects(prefix string) ([]*storage_service.StorageObject, error) {
+	deadline := time.Now().Add(time.Millisecond * time.Duration(i.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	stream, err := i.Client.GetFiles(ctx, &storage_service.GetFilesRequest{Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]*storage_service.StorageObject, 0)
+	for {
+		response, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return objects, nil
+			}
+			return nil, err
+		}
+		objects = append(objects, response.GetObject())
+	}
+}
+
+func changed(file *models.IndexedFile, object *storage_service.StorageObject) bool {
+	if file.SHA256 != "" || object.GetSha256() != "" {
+		return file.SHA256 != object.GetSha256()
+	}
+	lastModified := ""
+	if file.LastModified != nil {
+		lastModified = file.LastModified.UTC().Format(time.RFC3339)
+	}
+	return file.Size != object.GetSize() || lastModified != object.GetLastModified()
+}
+
+func (i *Indexer) index(object *storage_service.StorageObject) error {
+	file := &models.IndexedFile{
+		Key:         object.GetKey(),
+		Name:        path.Base(object.GetKey()),
+		ContentType: object.GetContentType(),
+		Size:        object.GetSize(),
+		Owner:       object.GetOwner(),
+		SHA256:      object.GetSha256(),
+	}
+	if file.ContentType == "" {
+		file.ContentType = mime.TypeByExtension(path.Ext(file.Key))
+	}
+	lastModified, err := time.Parse(time.RFC3339, object.GetLastModified())
+	if err == nil && !lastModified.IsZero() {
+		file.LastModified = &lastModified
+	}
+
+	if i.Config.MaxContentSize > 0 && isText(file.ContentType) {
+		// a document which cannot be read is still found by its name
+		if file.Content, err = i.extractText(file.Key); err != nil {
+			log.Printf("could not extract the text of %s: %s", file.Key, err)
+		}
+	}
+
+	return i.Index.IndexFile(file)
+}
+
+// isText reports whether the words of the document can be indexed as they are, e.g. plain text, csv, markdown or json
+func isText(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/xml"
+}
+
+// extractText reads the beginning of the document, up to the configured size
+func (i *Indexer) extractText(key string) (string, error) {
+	deadline := time.Now().Add(time.Millisecond * time.Duration(i.Deadline))
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	// cancelling stops the download of the rest of the document
+	defer cancel()
+
+	stream, err := i.Client.GetFile(ctx, &storage_service.GetFileRequest{
+		FileName: key,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	text := &strings.Builder{}
+	for int64(text.Len()) < i.Config.MaxContentSize {
+		response, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+		text.Write(response.GetChunkData())
+	}
+
+	content := text.String()
+	if int64(len(content)) > i.Config.MaxContentSize {
+		content = content[:i.Config.MaxContentSize]
+	}
+	// the document may be cut inside a character, and Postgres rejects invalid UTF-8 and NUL characters
+	content = strings.ToValidUTF8(content, "")
+	return strings.ReplaceAll(content, "\x00", ""), nil
+}
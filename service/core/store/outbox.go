@@ -0,0 +1,27 @@
+package store
+
+import "time"
+
+// OutboxMessage is an event persisted in the same transaction as the data it relates to,
+// waiting to be published to the message broker.
+type OutboxMessage struct {
+	ID        int64
+	EventID   string
+	EventName string
+	Payload   []byte
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// Outbox gives access to the pending outbox messages.
+type Outbox interface {
+	// ClaimOutboxMessages returns, in order, at most limit pending messages which are due, postponing them by lease so
+	// that they are not claimed again while being published. No lock is held once they are returned.
+	ClaimOutboxMessages(limit int, maxAttempts int, lease time.Duration) ([]*OutboxMessage, error)
+	MarkOutboxMessageSent(id int64) error
+	// MarkOutboxMessageFailed records the error, the message being retried after retryInterval * attempts. After
+	// maxAttempts it is marked as failed instead, and kept, with its last error, without being claimed again.
+	MarkOutboxMessageFailed(id int64, publishErr error, retryInterval time.Duration, maxAttempts int) error
+	// CountFailedOutboxMessages returns the number of messages which were given up on
+	CountFailedOutboxMessages(maxAttempts int) (int64, error)
+}
@@ -3,13 +3,17 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/bogdanrat/web-server/contracts/models"
 	"github.com/bogdanrat/web-server/service/core/common"
 	"github.com/bogdanrat/web-server/service/core/lib"
 	"github.com/bogdanrat/web-server/service/core/store"
-	_ "github.com/lib/pq"
+	"github.com/bogdanrat/web-server/service/queue"
+	"github.com/lib/pq"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,6 +22,173 @@ const (
 	getUserByEmail      = `SELECT * FROM users WHERE email = $1;`
 	insertUser          = `INSERT INTO users (name, email, password, qr_secret) VALUES ($1, $2, $3, $4);`
 	updateUserQRByEmail = `UPDATE users SET qr_secret = $2 WHERE email = $1`
+
+	createOutboxTable = `CREATE TABLE IF NOT EXISTS outbox (
+		id              BIGSERIAL PRIMARY KEY,
+		event_name      TEXT        NOT NULL,
+		payload         JSONB       NOT NULL,
+		attempts        INTEGER     NOT NULL DEFAULT 0,
+		last_error      TEXT,
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		sent_at         TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (next_attempt_at) WHERE sent_at IS NULL;
+	ALTER TABLE outbox ADD COLUMN IF NOT EXISTS event_id TEXT;
+	ALTER TABLE outbox ADD COLUMN IF NOT EXISTS failed_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS outbox_failed_idx ON outbox (id) WHERE failed_at IS NOT NULL;`
+	insertOutboxMessage = `INSERT INTO outbox (event_id, event_name, payload) VALUES ($1, $2, $3);`
+	// SKIP LOCKED and the postponement let several relays process the outbox concurrently without publishing the same
+	// message twice, and without holding locks while publishing
+	claimOutboxMessages = `UPDATE outbox SET next_attempt_at = now() + $3 * interval '1 millisecond' WHERE id IN (
+			SELECT id FROM outbox WHERE sent_at IS NULL AND failed_at IS NULL AND attempts < $1 AND next_attempt_at <= now()
+			ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED)
+		RETURNING id, COALESCE(event_id, ''), event_name, payload, attempts, created_at;`
+	markOutboxMessageSent   = `UPDATE outbox SET sent_at = now(), attempts = attempts + 1, last_error = NULL WHERE id = $1;`
+	markOutboxMessageFailed = `UPDATE outbox SET attempts = attempts + 1, last_error = $2, next_attempt_at = now() + $3 * (attempts + 1) * interval '1 millisecond',
+		failed_at = CASE WHEN attempts + 1 >= $4 THEN now() END WHERE id = $1;`
+	// the messages which gave up before failed_at existed are counted by their attempts
+	countFailedOutboxMessages = `SELECT count(*) FROM outbox WHERE sent_at IS NULL AND (failed_at IS NOT NULL OR attempts >= $1);`
+
+	createSharesTable = `CREATE TABLE IF NOT EXISTS shares (
+		id            BIGSERIAL PRIMARY KEY,
+		owner         TEXT        NOT NULL,
+		token_hash    TEXT        NOT NULL UNIQUE,
+		object_key    TEXT        NOT NULL,
+		password_hash TEXT,
+		expires_at    TIMESTAMPTZ NOT NULL,
+		max_downloads INTEGER     NOT NULL DEFAULT 0,
+		downloads     INTEGER     NOT NULL DEFAULT 0,
+		created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+		revoked_at    TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS shares_owner_idx ON shares (owner);`
+	selectShare = `SELECT id, owner, token_hash, object_key, password_hash, expires_at, max_downloads, downloads, created_at, revoked_at FROM shares`
+	insertShare = `INSERT INTO shares (owner, token_hash, object_key, password_hash, expires_at, max_downloads) VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at;`
+	getShareByTokenHash = selectShare + ` WHERE token_hash = $1;`
+	getSharesByOwner    = selectShare + ` WHERE owner = $1 ORDER BY created_at DESC;`
+	revokeShare         = `UPDATE shares SET revoked_at = now() WHERE id = $1 AND owner = $2 AND revoked_at IS NULL;`
+	// the conditions are checked by the update itself, so that concurrent downloads cannot exceed the limit
+	claimShareDownload = `UPDATE shares SET downloads = downloads + 1
+		WHERE id = $1 AND revoked_at IS NULL AND expires_at > now() AND (max_downloads = 0 OR downloads < max_downloads);`
+
+	// the trigger computes the searched document, weighing the names and tags over the descriptions, and these over the contents
+	createFileIndexTable = `CREATE TABLE IF NOT EXISTS file_index (
+		object_key    TEXT PRIMARY KEY,
+		name          TEXT        NOT NULL,
+		content_type  TEXT        NOT NULL DEFAULT '',
+		size          BIGINT      NOT NULL DEFAULT 0,
+		owner         TEXT        NOT NULL DEFAULT '',
+		sha256        TEXT        NOT NULL DEFAULT '',
+		last_modified TIMESTAMPTZ,
+		tags          TEXT[]      NOT NULL DEFAULT '{}',
+		description   TEXT        NOT NULL DEFAULT '',
+		content       TEXT        NOT NULL DEFAULT '',
+		document      TSVECTOR,
+		deleted_at    TIMESTAMPTZ
+	);
+	ALTER TABLE file_index ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS file_index_deleted_idx ON file_index (sha256) WHERE deleted_at IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS file_index_document_idx ON file_index USING GIN (document);
+	CREATE INDEX IF NOT EXISTS file_index_tags_idx ON file_index USING GIN (tags);
+	CREATE OR REPLACE FUNCTION file_index_document() RETURNS trigger AS $$
+	BEGIN
+		NEW.document :=
+			setweight(to_tsvector('english', regexp_replace(NEW.name, '[^[:alnum:]]+', ' ', 'g')), 'A') ||
+			setweight(to_tsvector('english', array_to_string(NEW.tags, ' ')), 'A') ||
+			setweight(to_tsvector('english', NEW.description), 'B') ||
+			setweight(to_tsvector('english', NEW.content), 'C');
+		RETURN NEW;
+	END
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS file_index_document_trigger ON file_index;
+	CREATE TRIGGER file_index_document_trigger BEFORE INSERT OR UPDATE ON file_index
+		FOR EACH ROW EXECUTE PROCEDURE file_index_document();`
+	indexedFileColumns = `object_key, name, content_type, size, owner, sha256, last_modified, tags, description`
+	// the prefix is compared as is, LIKE would match its underscores and percent signs as wildcards
+	getIndexedFiles = `SELECT ` + indexedFileColumns + ` FROM file_index
+		WHERE left(object_key, length($1)) = $1 AND deleted_at IS NULL ORDER BY object_key;`
+	// a file indexed for the first time takes the tags and description of the latest deleted file of the owner with the
+	// same content, which it was likely moved, renamed or restored from; a file indexed again under its key keeps its own
+	indexFile = `WITH adopted AS (
+			DELETE FROM file_index WHERE object_key = (
+				SELECT object_key FROM file_index
+				WHERE deleted_at IS NOT NULL AND $6 <> '' AND sha256 = $6 AND owner = $5 AND object_key <> $1
+					AND NOT EXISTS (SELECT 1 FROM file_index WHERE object_key = $1)
+				ORDER BY deleted_at DESC LIMIT 1)
+			RETURNING tags, description)
+		INSERT INTO file_index (object_key, name, content_type, size, owner, sha256, last_modified, content, tags, description)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8,
+			COALESCE((SELECT tags FROM adopted), '{}'), COALESCE((SELECT description FROM adopted), ''))
+		ON CONFLICT (object_key) DO UPDATE SET name = EXCLUDED.name, content_type = EXCLUDED.content_type, size = EXCLUDED.size,
+			owner = EXCLUDED.owner, sha256 = EXCLUDED.sha256, last_modified = EXCLUDED.last_modified, content = EXCLUDED.content,
+			deleted_at = NULL;`
+	// the deleted files are kept, without being searched, until purged
+	deleteIndexedFiles = `UPDATE file_index SET deleted_at = now() WHERE object_key = ANY($1) AND deleted_at IS NULL;`
+	purgeIndexedFiles  = `DELETE FROM file_index WHERE deleted_at < $1;`
+	tagFile            = `UPDATE file_index SET tags = $2, description = $3 WHERE object_key = $1 AND deleted_at IS NULL;`
+	// searchFiles is completed by the conditions, the ordering and the limit of the query
+	searchFiles = `SELECT ` + indexedFileColumns + `, %s AS rank, %s AS headline FROM file_index`
+
+	createWebhooksTable = `CREATE TABLE IF NOT EXISTS webhooks (
+		id         BIGSERIAL PRIMARY KEY,
+		owner      TEXT        NOT NULL,
+		url        TEXT        NOT NULL,
+		events     TEXT[]      NOT NULL DEFAULT '{}',
+		prefix     TEXT        NOT NULL DEFAULT '',
+		secret     TEXT        NOT NULL,
+		active     BOOLEAN     NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS webhooks_owner_idx ON webhooks (owner);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id              BIGSERIAL PRIMARY KEY,
+		webhook_id      BIGINT      NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+		event_id        TEXT        NOT NULL,
+		event_name      TEXT        NOT NULL,
+		payload         JSONB       NOT NULL,
+		status          TEXT        NOT NULL DEFAULT 'pending',
+		attempts        INTEGER     NOT NULL DEFAULT 0,
+		response_status INTEGER,
+		last_error      TEXT,
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_attempt_at TIMESTAMPTZ,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		delivered_at    TIMESTAMPTZ,
+		UNIQUE (webhook_id, event_id)
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';`
+	webhookColumns      = `id, owner, url, events, prefix, secret, active, created_at, updated_at`
+	insertWebhook       = `INSERT INTO webhooks (owner, url, events, prefix, secret, active) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at, updated_at;`
+	getWebhook          = `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = $1 AND owner = $2;`
+	getWebhooksByOwner  = `SELECT ` + webhookColumns + ` FROM webhooks WHERE owner = $1 ORDER BY id;`
+	getWebhooksForEvent = `SELECT ` + webhookColumns + ` FROM webhooks WHERE active AND (cardinality(events) = 0 OR $1 = ANY(events));`
+	updateWebhook       = `UPDATE webhooks SET url = $3, events = $4, prefix = $5, secret = $6, active = $7, updated_at = now()
+		WHERE id = $1 AND owner = $2 RETURNING updated_at;`
+	deleteWebhook         = `DELETE FROM webhooks WHERE id = $1 AND owner = $2;`
+	insertWebhookDelivery = `INSERT INTO webhook_deliveries (webhook_id, event_id, event_name, payload) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (webhook_id, event_id) DO NOTHING;`
+	webhookDeliveryColumns = `d.id, d.webhook_id, d.event_id, d.event_name, d.payload, d.status, d.attempts, d.response_status, d.last_error,
+		d.created_at, d.last_attempt_at, d.next_attempt_at, d.delivered_at`
+	// postponing the claimed deliveries lets several dispatchers share the queue without holding locks while sending
+	claimWebhookDeliveries = `UPDATE webhook_deliveries d SET next_attempt_at = now() + $2 * interval '1 millisecond' FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT pending.id FROM webhook_deliveries pending JOIN webhooks hook ON hook.id = pending.webhook_id
+			WHERE pending.status = 'pending' AND pending.next_attempt_at <= now() AND hook.active
+			ORDER BY pending.next_attempt_at, pending.id LIMIT $1 FOR UPDATE OF pending SKIP LOCKED)
+		RETURNING ` + webhookDeliveryColumns + `, w.url, w.secret;`
+	markWebhookDelivered = `UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1, response_status = $2,
+		last_error = NULL, last_attempt_at = now(), delivered_at = now() WHERE id = $1;`
+	// the expressions use the attempts before the update
+	markWebhookAttemptFailed = `UPDATE webhook_deliveries SET attempts = attempts + 1, response_status = NULLIF($2, 0), last_error = $3,
+		last_attempt_at = now(), status = CASE WHEN attempts + 1 >= $4 THEN 'failed' ELSE 'pending' END,
+		next_attempt_at = now() + LEAST($5 * power(2, attempts), $6) * interval '1 millisecond' WHERE id = $1;`
+	getWebhookDeliveries = `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.webhook_id = $1 AND w.owner = $2 AND ($3 = '' OR d.status = $3) ORDER BY d.id DESC LIMIT $4;`
+	redeliverWebhookDelivery = `UPDATE webhook_deliveries d SET status = 'pending', attempts = 0, next_attempt_at = now() FROM webhooks w
+		WHERE d.id = $1 AND w.id = d.webhook_id AND w.owner = $2;`
 )
 
 type Repository struct {
@@ -35,9 +206,33 @@ func NewRepository() (store.DatabaseRepository, error) {
 		return nil, err
 	}
 
-	return &Repository{
+	repo := &Repository{
 		DB: conn,
-	}, nil
+	}
+	if err = repo.setup(); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+func (repo *Repository) setup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	if _, err := repo.DB.ExecContext(ctx, createOutboxTable); err != nil {
+		return fmt.Errorf("could not create outbox table: %s", err)
+	}
+	if _, err := repo.DB.ExecContext(ctx, createSharesTable); err != nil {
+		return fmt.Errorf("could not create shares table: %s", err)
+	}
+	if _, err := repo.DB.ExecContext(ctx, createFileIndexTable); err != nil {
+		return fmt.Errorf("could not create file index table: %s", err)
+	}
+	if _, err := repo.DB.ExecContext(ctx, createWebhooksTable); err != nil {
+		return fmt.Errorf("could not create webhook tables: %s", err)
+	}
+	return nil
 }
 
 func initConnection(secrets *common.DatabaseSecrets) (*sql.DB, error) {
@@ -103,15 +298,39 @@ func (repo *Repository) GetUserByEmail(email string) (*models.User, error) {
 	return user, nil
 }
 
-func (repo *Repository) InsertUser(user *models.User) error {
+func (repo *Repository) InsertUser(user *models.User, events ...queue.Event) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 
-	_, err := repo.DB.ExecContext(ctx, insertUser, user.Name, user.Email, user.Password, user.QRSecret)
+	tx, err := repo.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	return nil
+	// Rollback is a no-op once the transaction was committed
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, insertUser, user.Name, user.Email, user.Password, user.QRSecret); err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("could not marshal json event: %s", err)
+		}
+
+		// the event id is assigned once, so that consumers can detect the event if the relay publishes it more than once
+		eventID := queue.NewEventID()
+		if _, envelope := queue.Unwrap(event); envelope != nil && envelope.ID != "" {
+			eventID = envelope.ID
+		}
+
+		if _, err = tx.ExecContext(ctx, insertOutboxMessage, eventID, event.Name(), payload); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 func (repo *Repository) UpdateUserQRSecret(email, secret string) error {
@@ -124,3 +343,459 @@ func (repo *Repository) UpdateUserQRSecret(email, secret string) error {
 	}
 	return nil
 }
+
+func (repo *Repository) ClaimOutboxMessages(limit int, maxAttempts int, lease time.Duration) ([]*store.OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := repo.DB.QueryContext(ctx, claimOutboxMessages, maxAttempts, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]*store.OutboxMessage, 0)
+	for rows.Next() {
+		message := &store.OutboxMessage{}
+		if err = rows.Scan(&message.ID, &message.EventID, &message.EventName, &message.Payload, &message.Attempts, &message.CreatedAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the updated rows are returned in no particular order
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+	return messages, nil
+}
+
+func (repo *Repository) MarkOutboxMessageSent(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err := repo.DB.ExecContext(ctx, markOutboxMessageSent, id)
+	return err
+}
+
+func (repo *Repository) MarkOutboxMessageFailed(id int64, publishErr error, retryInterval time.Duration, maxAttempts int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err := repo.DB.ExecContext(ctx, markOutboxMessageFailed, id, publishErr.Error(), retryInterval.Milliseconds(), maxAttempts)
+	return err
+}
+
+func (repo *Repository) CountFailedOutboxMessages(maxAttempts int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	var count int64
+	err := repo.DB.QueryRowContext(ctx, countFailedOutboxMessages, maxAttempts).Scan(&count)
+	return count, err
+}
+
+func (repo *Repository) InsertShare(share *models.Share) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	return repo.DB.QueryRowContext(ctx, insertShare, share.Owner, share.TokenHash, share.Key, share.PasswordHash, share.ExpiresAt, share.MaxDownloads).
+		Scan(&share.ID, &share.CreatedAt)
+}
+
+func (repo *Repository) GetShareByTokenHash(tokenHash string) (*models.Share, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	share, err := scanShare(repo.DB.QueryRowContext(ctx, getShareByTokenHash, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return share, err
+}
+
+func (repo *Repository) GetSharesByOwner(owner string) ([]*models.Share, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := repo.DB.QueryContext(ctx, getSharesByOwner, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := make([]*models.Share, 0)
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+func (repo *Repository) RevokeShare(id int64, owner string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	result, err := repo.DB.ExecContext(ctx, revokeShare, id, owner)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (repo *Repository) ClaimShareDownload(id int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	result, err := repo.DB.ExecContext(ctx, claimShareDownload, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// scanShare scans a row selected by selectShare
+func scanShare(row interface{ Scan(...interface{}) error }) (*models.Share, error) {
+	share := &models.Share{}
+	err := row.Scan(&share.ID, &share.Owner, &share.TokenHash, &share.Key, &share.PasswordHash, &share.ExpiresAt,
+		&share.MaxDownloads, &share.Downloads, &share.CreatedAt, &share.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	share.HasPassword = share.PasswordHash != nil
+	return share, nil
+}
+
+func (repo *Repository) GetIndexedFiles(prefix string) ([]*models.IndexedFile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := repo.DB.QueryContext(ctx, getIndexedFiles, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]*models.IndexedFile, 0)
+	for rows.Next() {
+		file := &models.IndexedFile{}
+		if err = rows.Scan(indexedFileFields(file)...); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (repo *Repository) IndexFile(file *models.IndexedFile) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err := repo.DB.ExecContext(ctx, indexFile, file.Key, file.Name, file.ContentType, int64(file.Size), file.Owner, file.SHA256,
+		file.LastModified, file.Content)
+	return err
+}
+
+func (repo *Repository) DeleteIndexedFiles(keys ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err := repo.DB.ExecContext(ctx, deleteIndexedFiles, pq.Array(keys))
+	return err
+}
+
+func (repo *Repository) PurgeIndexedFiles(deletedBefore time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	result, err := repo.DB.ExecContext(ctx, purgeIndexedFiles, deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (repo *Repository) TagFile(key string, tags []string, description string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	result, err := repo.DB.ExecContext(ctx, tagFile, key, pq.Array(tags), description)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// SearchFiles ranks the files matching the text, if any, or returns the last modified ones
+func (repo *Repository) SearchFiles(query *models.FileQuery) ([]*models.SearchFilesResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	conditions := []string{"deleted_at IS NULL"}
+	args := make([]interface{}, 0)
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	rank, headline, order := "0", "''", "last_modified DESC NULLS LAST, object_key"
+	if query.Text != "" {
+		tsQuery := fmt.Sprintf("websearch_to_tsquery('english', %s)", arg(query.Text))
+		conditions = append(conditions, fmt.Sprintf("document @@ %s", tsQuery))
+		rank = fmt.Sprintf("ts_rank(document, %s)", tsQuery)
+		headline = fmt.Sprintf("ts_headline('english', name || ' ' || description || ' ' || content, %s)", tsQuery)
+		order = "rank DESC, object_key"
+	}
+	if len(query.Tags) > 0 {
+		conditions = append(conditions, fmt.Sprintf("tags @> %s", arg(pq.Array(query.Tags))))
+	}
+	if query.Type != "" {
+		typeArg := arg(query.Type)
+		conditions = append(conditions, fmt.Sprintf("(content_type = %[1]s OR content_type LIKE %[1]s || '/%%' OR lower(name) LIKE '%%.' || lower(%[1]s))", typeArg))
+	}
+	if query.From != nil {
+		conditions = append(conditions, fmt.Sprintf("last_modified >= %s", arg(*query.From)))
+	}
+	if query.To != nil {
+		conditions = append(conditions, fmt.Sprintf("last_modified <= %s", arg(*query.To)))
+	}
+
+	statement := fmt.Sprintf(searchFiles, rank, headline) + " WHERE " + strings.Join(conditions, " AND ")
+	statement += " ORDER BY " + order
+	if query.Limit > 0 {
+		statement += " LIMIT " + arg(query.Limit)
+	}
+
+	rows, err := repo.DB.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*models.SearchFilesResult, 0)
+	for rows.Next() {
+		result := &models.SearchFilesResult{IndexedFile: &models.IndexedFile{}}
+		if err = rows.Scan(append(indexedFileFields(result.IndexedFile), &result.Rank, &result.Headline)...); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// indexedFileFields returns the fields of the file scanned from the indexedFileColumns
+func indexedFileFields(file *models.IndexedFile) []interface{} {
+	return []interface{}{&file.Key, &file.Name, &file.ContentType, &file.Size, &file.Owner, &file.SHA256, &file.LastModified,
+		pq.Array(&file.Tags), &file.Description}
+}
+
+func (repo *Repository) InsertWebhook(webhook *models.Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	return repo.DB.QueryRowContext(ctx, insertWebhook, webhook.Owner, webhook.URL, pq.Array(webhook.Events), webhook.Prefix,
+		webhook.Secret, webhook.Active).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.UpdatedAt)
+}
+
+func (repo *Repository) GetWebhook(id int64, owner string) (*models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	webhook, err := scanWebhook(repo.DB.QueryRowContext(ctx, getWebhook, id, owner))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return webhook, err
+}
+
+func (repo *Repository) GetWebhooksByOwner(owner string) ([]*models.Webhook, error) {
+	return repo.queryWebhooks(getWebhooksByOwner, owner)
+}
+
+func (repo *Repository) GetWebhooksForEvent(eventName string) ([]*models.Webhook, error) {
+	return repo.queryWebhooks(getWebhooksForEvent, eventName)
+}
+
+func (repo *Repository) queryWebhooks(query string, args ...interface{}) ([]*models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := repo.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := make([]*models.Webhook, 0)
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (repo *Repository) UpdateWebhook(webhook *models.Webhook) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	err := repo.DB.QueryRowContext(ctx, updateWebhook, webhook.ID, webhook.Owner, webhook.URL, pq.Array(webhook.Events), webhook.Prefix,
+		webhook.Secret, webhook.Active).Scan(&webhook.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (repo *Repository) DeleteWebhook(id int64, owner string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	result, err := repo.DB.ExecContext(ctx, deleteWebhook, id, owner)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (repo *Repository) InsertWebhookDeliveries(deliveries ...*models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, delivery := range deliveries {
+		_, err = tx.ExecContext(ctx, insertWebhookDelivery, delivery.WebhookID, delivery.EventID, delivery.Event, []byte(delivery.Payload))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (repo *Repository) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*store.PendingWebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := repo.DB.QueryContext(ctx, claimWebhookDeliveries, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]*store.PendingWebhookDelivery, 0)
+	for rows.Next() {
+		delivery := &store.PendingWebhookDelivery{WebhookDelivery: &models.WebhookDelivery{}}
+		if err = rows.Scan(append(webhookDeliveryFields(delivery.WebhookDelivery), &delivery.URL, &delivery.Secret)...); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (repo *Repository) RecordWebhookAttempt(id int64, responseStatus int, attemptErr error, maxAttempts int, retryInterval, maxRetryInterval time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	var err error
+	if attemptErr == nil {
+		_, err = repo.DB.ExecContext(ctx, markWebhookDelivered, id, responseStatus)
+	} else {
+		_, err = repo.DB.ExecContext(ctx, markWebhookAttemptFailed, id, responseStatus, attemptErr.Error(), maxAttempts,
+			retryInterval.Milliseconds(), maxRetryInterval.Milliseconds())
+	}
+	return err
+}
+
+func (repo *Repository) GetWebhookDeliveries(webhookID int64, owner string, status string, limit int) ([]*models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := repo.DB.QueryContext(ctx, getWebhookDeliveries, webhookID, owner, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]*models.WebhookDelivery, 0)
+	for rows.Next() {
+		delivery := &models.WebhookDelivery{}
+		if err = rows.Scan(webhookDeliveryFields(delivery)...); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (repo *Repository) RedeliverWebhookDelivery(id int64, owner string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	result, err := repo.DB.ExecContext(ctx, redeliverWebhookDelivery, id, owner)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// scanWebhook scans a row of the webhookColumns
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*models.Webhook, error) {
+	webhook := &models.Webhook{}
+	err := row.Scan(&webhook.ID, &webhook.Owner, &webhook.URL, pq.Array(&webhook.Events), &webhook.Prefix, &webhook.Secret,
+		&webhook.Active, &webhook.CreatedAt, &webhook.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// webhookDeliveryFields returns the fields of the delivery scanned from the webhookDeliveryColumns
+func webhookDeliveryFields(delivery *models.WebhookDelivery) []interface{} {
+	return []interface{}{&delivery.ID, &delivery.WebhookID, &delivery.EventID, &delivery.Event, (*[]byte)(&delivery.Payload), &delivery.Status,
+		&delivery.Attempts, &delivery.ResponseStatus, &delivery.LastError, &delivery.CreatedAt, &delivery.LastAttemptAt,
+		&delivery.NextAttemptAt, &delivery.DeliveredAt}
+}
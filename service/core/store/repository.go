@@ -1,10 +1,18 @@
 package store
 
-import "github.com/bogdanrat/web-server/contracts/models"
+import (
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/service/queue"
+)
 
 type DatabaseRepository interface {
 	GetAllUsers() ([]*models.User, error)
 	GetUserByEmail(string) (*models.User, error)
-	InsertUser(user *models.User) error
+	// InsertUser inserts the user and writes the given events to the outbox, in the same transaction
+	InsertUser(user *models.User, events ...queue.Event) error
 	UpdateUserQRSecret(email, secret string) error
+	Outbox
+	Shares
+	FileIndex
+	Webhooks
 }
@@ -0,0 +1,22 @@
+package store
+
+import (
+	"github.com/bogdanrat/web-server/contracts/models"
+	"time"
+)
+
+// FileIndex persists the files indexed for the search, along with their tags and descriptions.
+type FileIndex interface {
+	// GetIndexedFiles returns the indexed files whose keys start with the prefix, without their content
+	GetIndexedFiles(prefix string) ([]*models.IndexedFile, error)
+	// IndexFile inserts or updates the file, keeping its tags and description. A newly indexed file takes those of a
+	// deleted file of its owner with the same content, so that they follow the files moved, renamed, trashed or restored.
+	IndexFile(file *models.IndexedFile) error
+	// DeleteIndexedFiles removes the files from the search, keeping their tags and description until purged
+	DeleteIndexedFiles(keys ...string) error
+	// PurgeIndexedFiles deletes the files removed from the search before the time, returning their number
+	PurgeIndexedFiles(deletedBefore time.Time) (int64, error)
+	// TagFile sets the tags and description of the file, reporting false if it is not indexed
+	TagFile(key string, tags []string, description string) (bool, error)
+	SearchFiles(query *models.FileQuery) ([]*models.SearchFilesResult, error)
+}
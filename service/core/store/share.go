@@ -0,0 +1,15 @@
+package store
+
+import "github.com/bogdanrat/web-server/contracts/models"
+
+// Shares persists the public share links of the files.
+type Shares interface {
+	InsertShare(share *models.Share) error
+	// GetShareByTokenHash returns nil if no share has the token
+	GetShareByTokenHash(tokenHash string) (*models.Share, error)
+	GetSharesByOwner(owner string) ([]*models.Share, error)
+	// RevokeShare reports whether an active share of the owner was revoked
+	RevokeShare(id int64, owner string) (bool, error)
+	// ClaimShareDownload counts a download of the share, reporting false if it is revoked, expired or exhausted
+	ClaimShareDownload(id int64) (bool, error)
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"github.com/bogdanrat/web-server/contracts/models"
+	"time"
+)
+
+// PendingWebhookDelivery is a delivery claimed to be sent, along with the endpoint and the secret of its webhook
+type PendingWebhookDelivery struct {
+	*models.WebhookDelivery
+	URL    string
+	Secret string
+}
+
+// Webhooks persists the webhooks of the users and the deliveries of the events to them.
+type Webhooks interface {
+	InsertWebhook(webhook *models.Webhook) error
+	// GetWebhook returns nil if the owner has no webhook with the id
+	GetWebhook(id int64, owner string) (*models.Webhook, error)
+	GetWebhooksByOwner(owner string) ([]*models.Webhook, error)
+	// GetWebhooksForEvent returns the active webhooks subscribed to the event
+	GetWebhooksForEvent(eventName string) ([]*models.Webhook, error)
+	// UpdateWebhook reports whether the webhook of the owner was updated
+	UpdateWebhook(webhook *models.Webhook) (bool, error)
+	// DeleteWebhook deletes the webhook along with its deliveries, reporting whether the owner had it
+	DeleteWebhook(id int64, owner string) (bool, error)
+	// InsertWebhookDeliveries queues the deliveries, skipping the events already queued for their webhooks
+	InsertWebhookDeliveries(deliveries ...*models.WebhookDelivery) error
+	// ClaimWebhookDeliveries returns at most limit pending deliveries of the active webhooks which are due,
+	// postponing them by lease so that they are not claimed again while being sent
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*PendingWebhookDelivery, error)
+	// RecordWebhookAttempt marks the delivery as delivered if the attempt succeeded. Otherwise it is retried after
+	// retryInterval, doubled after every attempt up to maxRetryInterval, or marked as failed after maxAttempts.
+	RecordWebhookAttempt(id int64, responseStatus int, attemptErr error, maxAttempts int, retryInterval, maxRetryInterval time.Duration) error
+	// GetWebhookDeliveries returns the latest deliveries of the owner's webhook, with the status if not empty
+	GetWebhookDeliveries(webhookID int64, owner string, status string, limit int) ([]*models.WebhookDelivery, error)
+	// RedeliverWebhookDelivery queues the delivery again, reporting whether the owner had it
+	RedeliverWebhookDelivery(id int64, owner string) (bool, error)
+}
@@ -0,0 +1,235 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/bogdanrat/web-server/contracts/models"
+	"github.com/bogdanrat/web-server/service/core/config"
+	"github.com/bogdanrat/web-server/service/core/store"
+	"github.com/bogdanrat/web-server/service/queue"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+	TimestampHeader = "X-Webhook-Timestamp"
+	// SignatureHeader carries sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">, keyed with the webhook's secret
+	SignatureHeader = "X-Webhook-Signature"
+
+	userAgent = "web-server-webhooks"
+	// maxResponseSize is the part of the response read before closing it, letting the connection be reused
+	maxResponseSize = 64 * 1024
+)
+
+// Dispatcher queues the events for the webhooks subscribed to them, then posts the queued deliveries,
+// retrying the failed ones. The deliveries of an event are not ordered with those of the other events.
+type Dispatcher struct {
+	Store  store.Webhooks
+	Client *http.Client
+	Config config.WebhookConfig
+}
+
+func NewDispatcher(webhooks store.Webhooks, webhookConfig config.WebhookConfig) *Dispatcher {
+	dialer := &net.Dialer{
+		Timeout: time.Millisecond * time.Duration(webhookConfig.Timeout),
+	}
+	if !webhookConfig.AllowPrivateNetworks {
+		// checking the dialed address, rather than the url, also covers the host names resolving to private addresses
+		dialer.Control = denyPrivateNetworks
+	}
+
+	return &Dispatcher{
+		Store: webhooks,
+		Client: &http.Client{
+			// no proxy, so that the dialed address is the webhook's
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: dialer.Timeout,
+				MaxIdleConnsPerHost: 2,
+			},
+			Timeout: dialer.Timeout,
+			// a redirect is a failed delivery, the webhook's url must be updated instead
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		Config: webhookConfig,
+	}
+}
+
+// Dispatch queues the event for the webhooks subscribed to it. An event is queued once per webhook, by its envelope id.
+func (d *Dispatcher) Dispatch(event queue.Event, envelope *queue.Envelope) error {
+	if !models.IsWebhookEvent(event.Name()) {
+		return nil
+	}
+	// the deliveries of an event without an id are duplicated if it is handled again
+	envelope = withID(envelope)
+
+	webhooks, err := d.Store.GetWebhooksForEvent(event.Name())
+	if err != nil {
+		return fmt.Errorf("could not get webhooks: %s", err)
+	}
+
+	deliveries := make([]*models.WebhookDelivery, 0, len(webhooks))
+	var payload []byte
+	for _, webhook := range webhooks {
+		if !d.matches(webhook, event) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = newPayload(event, envelope); err != nil {
+				return err
+			}
+		}
+		deliveries = append(deliveries, &models.WebhookDelivery{
+			WebhookID: webhook.ID,
+			EventID:   envelope.ID,
+			Event:     event.Name(),
+			Payload:   payload,
+		})
+	}
+
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return d.Store.InsertWebhookDeliveries(deliveries...)
+}
+
+// Start sends the due deliveries until the process exits
+func (d *Dispatcher) Start() {
+	ticker := time.NewTicker(time.Millisecond * time.Duration(d.Config.PollInterval))
+	defer ticker.Stop()
+
+	timeout := time.Millisecond * time.Duration(d.Config.Timeout)
+	for range ticker.C {
+		// the lease outlasts the attempts, which are bounded by the client's timeout
+		deliveries, err := d.Store.ClaimWebhookDeliveries(d.Config.BatchSize, timeout*2)
+		if err != nil {
+			log.Printf("could not claim webhook deliveries: %s", err)
+			continue
+		}
+
+		wg := &sync.WaitGroup{}
+		for _, delivery := range deliveries {
+			wg.Add(1)
+			go func(delivery *store.PendingWebhookDelivery) {
+				defer wg.Done()
+				d.attempt(delivery)
+			}(delivery)
+		}
+		wg.Wait()
+	}
+}
+
+func (d *Dispatcher) attempt(delivery *store.PendingWebhookDelivery) {
+	responseStatus, err := d.post(delivery)
+	if err != nil && delivery.Attempts+1 >= d.Config.MaxAttempts {
+		log.Printf("giving up on webhook delivery %d (%s) after %d attempts: %s", delivery.ID, delivery.Event, delivery.Attempts+1, err)
+	}
+
+	err = d.Store.RecordWebhookAttempt(delivery.ID, responseStatus, err, d.Config.MaxAttempts,
+		time.Millisecond*time.Duration(d.Config.RetryInterval), time.Millisecond*time.Duration(d.Config.MaxRetryInterval))
+	if err != nil {
+		log.Printf("could not record the attempt of webhook delivery %d: %s", delivery.ID, err)
+	}
+}
+
+// post sends the delivery, returning the response status, if any, and an error unless the status is 2xx
+func (d *Dispatcher) post(delivery *store.PendingWebhookDelivery) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", userAgent)
+	request.Header.Set(EventHeader, delivery.Event)
+	request.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, maxResponseSize))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// Sign returns the value of the SignatureHeader. Signing the timestamp lets the webhooks reject replayed deliveries.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newPayload(event queue.Event, envelope *queue.Envelope) ([]byte, error) {
+	data := interface{}(event)
+	if e, ok := event.(*models.UserSignUpEvent); ok {
+		// the qr code holds the user's second factor secret
+		data = &models.UserSignUpEvent{User: e.User}
+	}
+
+	payload, err := json.Marshal(&models.WebhookPayload{
+		ID:    envelope.ID,
+		Event: event.Name(),
+		Time:  envelope.Time,
+		Data:  data,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal webhook payload: %s", err)
+	}
+	return payload, nil
+}
+
+func withID(envelope *queue.Envelope) *queue.Envelope {
+	identified := &queue.Envelope{}
+	if envelope != nil {
+		*identified = *envelope
+	}
+	if identified.ID == "" {
+		identified.ID = queue.NewEventID()
+	}
+	if identified.Time.IsZero() {
+		identified.Time = time.Now().UTC()
+	}
+	return identified
+}
+
+// matches reports whether the webhook receives the event: the file events of its owner's files within its prefix, and
+// the events not owned by a user if its owner is an administrator. The administrators are checked again when
+// dispatching, since they may have changed since the webhook was created.
+func (d *Dispatcher) matches(webhook *models.Webhook, event queue.Event) bool {
+	switch e := event.(type) {
+	case *models.FileUploadedEvent:
+		return e.Owner == webhook.Owner && strings.HasPrefix(e.Key, webhook.Prefix)
+	case *models.FileDeletedEvent:
+		return e.Owner == webhook.Owner && strings.HasPrefix(e.Key, webhook.Prefix)
+	case *models.PrefixDeletedEvent:
+		// deleting a parent of the prefix deletes the files within it too
+		return d.Config.IsAdmin(webhook.Owner) &&
+			(strings.HasPrefix(e.Prefix, webhook.Prefix) || strings.HasPrefix(webhook.Prefix, e.Prefix))
+	default:
+		return d.Config.IsAdmin(webhook.Owner)
+	}
+}
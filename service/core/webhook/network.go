@@ -0,0 +1,49 @@
+package webhook
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// privateNetworks are the address ranges not routed on the internet, besides the loopback and link-local ones
+var privateNetworks = []*net.IPNet{
+	parseCIDR("10.0.0.0/8"),
+	parseCIDR("172.16.0.0/12"),
+	parseCIDR("192.168.0.0/16"),
+	parseCIDR("100.64.0.0/10"),
+	parseCIDR("fc00::/7"),
+}
+
+// denyPrivateNetworks prevents the webhooks from reaching the internal services, e.g. the databases or the cloud metadata
+func denyPrivateNetworks(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivate(ip) {
+		return fmt.Errorf("address %s is not public", host)
+	}
+	return nil
+}
+
+func isPrivate(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
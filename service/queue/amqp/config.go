@@ -0,0 +1,39 @@
+package amqp
+
+const (
+	defaultChannelPoolSize = 4
+	defaultMaxRetries      = 3
+	defaultRetryInterval   = 200  // milliseconds
+	defaultConfirmTimeout  = 5000 // milliseconds
+	defaultSource          = "web-server"
+)
+
+type EmitterConfig struct {
+	// URI is used to dial the broker again when the connection is lost
+	URI      string
+	Exchange string
+	// Source identifies the emitting service in the events' envelope
+	Source          string
+	ChannelPoolSize int
+	MaxRetries      int
+	RetryInterval   int64 // milliseconds
+	ConfirmTimeout  int64 // milliseconds
+}
+
+func (c *EmitterConfig) sanitize() {
+	if c.ChannelPoolSize <= 0 {
+		c.ChannelPoolSize = defaultChannelPoolSize
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = defaultRetryInterval
+	}
+	if c.ConfirmTimeout <= 0 {
+		c.ConfirmTimeout = defaultConfirmTimeout
+	}
+	if c.Source == "" {
+		c.Source = defaultSource
+	}
+}
@@ -2,9 +2,13 @@ package amqp
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/bogdanrat/web-server/service/queue"
 	"github.com/streadway/amqp"
+	"log"
+	"sync"
+	"time"
 )
 
 /*
@@ -26,34 +30,48 @@ import (
 			(<entity-name>.<state-change>.<location>, e.g., event.created.europe; event.created.*; event.*.europe)
 */
 
+var (
+	ErrUnroutable   = errors.New("message could not be routed to any queue")
+	ErrNotConfirmed = errors.New("message was not confirmed by the broker")
+)
+
 type amqpEventEmitter struct {
-	connection *amqp.Connection
-	exchange   string
-	events     chan *emittedEvent
+	connectionMutex sync.RWMutex
+	connection      *amqp.Connection
+	config          EmitterConfig
+	// channels is a pool of channels in confirm mode, reused between publishings
+	channels chan *confirmChannel
 }
 
-type emittedEvent struct {
-	event     queue.Event
-	errorChan chan error
+// confirmChannel is a channel in confirm mode, along with its notification channels
+type confirmChannel struct {
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
 }
 
-func NewEventEmitter(conn *amqp.Connection, exchange string) (queue.EventEmitter, error) {
+func NewEventEmitter(conn *amqp.Connection, config EmitterConfig) (queue.EventEmitter, error) {
+	config.sanitize()
+
 	emitter := &amqpEventEmitter{
 		connection: conn,
-		exchange:   exchange,
+		config:     config,
+		channels:   make(chan *confirmChannel, config.ChannelPoolSize),
 	}
 
 	err := emitter.setup()
 	if err != nil {
 		return nil, err
 	}
+
+	go emitter.watchConnection(conn)
 	return emitter, nil
 }
 
 func (e *amqpEventEmitter) setup() error {
 	// Channels are used to multiplex several virtual connections over one actual TCP connection.
 	// Channel() opens a unique, concurrent server channel to process the bulk of AMQP messages
-	channel, err := e.connection.Channel()
+	channel, err := e.getConnection().Channel()
 	if err != nil {
 		return err
 	}
@@ -61,7 +79,7 @@ func (e *amqpEventEmitter) setup() error {
 
 	// A message publishers declares the Exchange into which it intends to publish messages
 	err = channel.ExchangeDeclare(
-		e.exchange,
+		e.config.Exchange,
 		"topic",
 		true,  // durable: cause the exchange to remain declared when the broker restarts
 		false, // autoDelete: cause the exchange to be deleted as soon as the channel that declared it is closed
@@ -72,31 +90,170 @@ func (e *amqpEventEmitter) setup() error {
 	return err
 }
 
-func (e *amqpEventEmitter) Emit(event queue.Event) error {
-	channel, err := e.connection.Channel()
+func (e *amqpEventEmitter) getConnection() *amqp.Connection {
+	e.connectionMutex.RLock()
+	defer e.connectionMutex.RUnlock()
+	return e.connection
+}
+
+// watchConnection waits for the connection to be closed and dials the broker again, unless it was closed on purpose.
+func (e *amqpEventEmitter) watchConnection(conn *amqp.Connection) {
+	closeErr, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+	// the channel is closed without an error on a graceful shutdown
+	if !ok || closeErr == nil {
+		return
+	}
+	log.Printf("AMQP connection lost: %s\n", closeErr)
+
+	for attempt := 1; ; attempt++ {
+		newConn, err := amqp.Dial(e.config.URI)
+		if err == nil {
+			e.connectionMutex.Lock()
+			e.connection = newConn
+			e.connectionMutex.Unlock()
+			e.drainChannels()
+
+			if err = e.setup(); err == nil {
+				log.Println("AMQP connection reestablished.")
+				go e.watchConnection(newConn)
+				return
+			}
+			_ = newConn.Close()
+		}
+
+		log.Printf("could not reconnect to AMQP broker (attempt %d): %s\n", attempt, err)
+		time.Sleep(e.backoff(attempt))
+	}
+}
+
+// drainChannels discards the pooled channels, which belong to a dead connection
+func (e *amqpEventEmitter) drainChannels() {
+	for {
+		select {
+		case channel := <-e.channels:
+			_ = channel.channel.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (e *amqpEventEmitter) acquireChannel() (*confirmChannel, error) {
+	select {
+	case channel := <-e.channels:
+		return channel, nil
+	default:
+	}
+
+	channel, err := e.getConnection().Channel()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Confirm() puts the channel in confirm mode: the broker acknowledges every publishing once it took responsibility for it
+	if err = channel.Confirm(false); err != nil {
+		_ = channel.Close()
+		return nil, err
 	}
-	defer channel.Close()
 
+	return &confirmChannel{
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, 1)),
+	}, nil
+}
+
+func (e *amqpEventEmitter) releaseChannel(channel *confirmChannel) {
+	select {
+	case e.channels <- channel:
+	default:
+		// pool is full
+		_ = channel.channel.Close()
+	}
+}
+
+func (e *amqpEventEmitter) Emit(event queue.Event) error {
 	jsonBody, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("could not marshal json event: %s", err.Error())
 	}
 
+	envelope := queue.NewEnvelope(event, e.config.Source)
+	headers := amqp.Table{}
+	for name, value := range envelope.Attributes() {
+		headers[name] = value
+	}
+
 	message := amqp.Publishing{
-		Headers:     amqp.Table{queue.EventNameHeader: event.Name()},
-		ContentType: "application/json",
-		Body:        jsonBody,
+		Headers:       headers,
+		ContentType:   envelope.DataContentType,
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     envelope.ID,
+		CorrelationId: envelope.CorrelationID,
+		Timestamp:     envelope.Time,
+		Type:          envelope.Type,
+		Body:          jsonBody,
 	}
 
-	err = channel.Publish(
-		e.exchange,
-		event.Name(),
-		false, // mandatory: instruct the broker to make sure that the message is actually routed into at least one queue
+	for attempt := 0; ; attempt++ {
+		err = e.publish(envelope.Type, message)
+		if err == nil || errors.Is(err, ErrUnroutable) || attempt >= e.config.MaxRetries {
+			return err
+		}
+
+		log.Printf("could not publish event %s (attempt %d): %s\n", event.Name(), attempt+1, err)
+		time.Sleep(e.backoff(attempt + 1))
+	}
+}
+
+func (e *amqpEventEmitter) publish(routingKey string, message amqp.Publishing) error {
+	channel, err := e.acquireChannel()
+	if err != nil {
+		return err
+	}
+
+	err = channel.channel.Publish(
+		e.config.Exchange,
+		routingKey,
+		true,  // mandatory: instruct the broker to make sure that the message is actually routed into at least one queue
 		false, // immediate: instruct the broker to make sure that the message is actually delivered to at least on subscriber
 		message,
 	)
+	if err != nil {
+		_ = channel.channel.Close()
+		return err
+	}
 
-	return err
+	timer := time.NewTimer(time.Millisecond * time.Duration(e.config.ConfirmTimeout))
+	defer timer.Stop()
+
+	select {
+	case confirmation, ok := <-channel.confirms:
+		if !ok {
+			// the channel was closed before the confirmation arrived
+			return ErrNotConfirmed
+		}
+
+		// an unroutable message is returned by the broker before it is acknowledged
+		select {
+		case returned := <-channel.returns:
+			e.releaseChannel(channel)
+			return fmt.Errorf("%w: %d %s", ErrUnroutable, returned.ReplyCode, returned.ReplyText)
+		default:
+		}
+
+		e.releaseChannel(channel)
+		if !confirmation.Ack {
+			return ErrNotConfirmed
+		}
+		return nil
+	case <-timer.C:
+		// a late confirmation would be mistaken for the next publishing's, so the channel is discarded
+		_ = channel.channel.Close()
+		return fmt.Errorf("%w: timed out after %d ms", ErrNotConfirmed, e.config.ConfirmTimeout)
+	}
+}
+
+func (e *amqpEventEmitter) backoff(attempt int) time.Duration {
+	return time.Millisecond * time.Duration(e.config.RetryInterval*int64(attempt))
 }
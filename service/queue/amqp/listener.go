@@ -21,7 +21,7 @@ func NewListener(conn *amqp.Connection, exchangeName string, queueName string) (
 		queue:      queueName,
 	}
 
-	mapper, err := queue.NewEventMapper(queue.StaticMapper)
+	mapper, err := queue.NewEventMapper(queue.RegistryMapper)
 	if err != nil {
 		return nil, err
 	}
@@ -67,10 +67,17 @@ func (l *amqpEventListener) Listen(eventNames ...string) (<-chan queue.Event, <-
 
 	go func() {
 		for message := range messages {
-			// use the x-event-name header to map message back to their respective struct types
-			rawEventName, ok := message.Headers[queue.EventNameHeader]
-			if !ok {
-				errors <- fmt.Errorf("message did not contain %s header", queue.EventNameHeader)
+			// use the envelope attributes to map message back to their respective struct types
+			attributes := make(map[string]string)
+			for name, value := range message.Headers {
+				if stringValue, ok := value.(string); ok {
+					attributes[name] = stringValue
+				}
+			}
+
+			envelope, err := queue.EnvelopeFromAttributes(attributes)
+			if err != nil {
+				errors <- err
 				// Nack() negatively acknowledge the delivery of message(s)
 				// This method must not be used to select or requeue messages the client wishes not to handle,
 				// rather it is to inform the server that the client is incapable of handling this message at this time.
@@ -83,28 +90,36 @@ func (l *amqpEventListener) Listen(eventNames ...string) (<-chan queue.Event, <-
 				continue
 			}
 
-			eventName, ok := rawEventName.(string)
-			if !ok {
-				errors <- fmt.Errorf("header %s did not contain string value", queue.EventNameHeader)
-				if err := message.Nack(false, false); err != nil {
-					log.Printf("Error Nack: %s\n", err)
-				}
-				continue
-			}
-
-			event, err := l.mapper.MapEvent(eventName, message.Body)
+			event, err := l.mapper.MapVersionedEvent(envelope.Type, envelope.SchemaVersion, message.Body)
 			if err != nil {
-				errors <- fmt.Errorf("could not unmarshal event %s: %s", eventName, err)
+				errors <- fmt.Errorf("could not unmarshal event %s: %s", envelope.Type, err)
 				if err := message.Nack(false, false); err != nil {
 					log.Printf("Error Nack: %s\n", err)
 				}
+				continue
 			}
 
-			events <- event
-			err = message.Ack(false)
-			if err != nil {
-				errors <- fmt.Errorf("could not acknowledge message: %s", err)
+			// the message is acknowledged once the event is handled, otherwise it is requeued to be delivered again.
+			// The errors are logged, the acknowledgement being made by the goroutine which also reads the errors channel.
+			enveloped := &queue.EnvelopedEvent{
+				Event:    event,
+				Envelope: envelope,
 			}
+			enveloped.Ack = func(message amqp.Delivery) func(error) {
+				return func(err error) {
+					if err != nil {
+						log.Printf("event %s not handled, requeuing message: %s", envelope.Type, err)
+						if err = message.Nack(false, true); err != nil {
+							log.Printf("Error Nack: %s\n", err)
+						}
+						return
+					}
+					if err = message.Ack(false); err != nil {
+						log.Printf("could not acknowledge message: %s", err)
+					}
+				}
+			}(message)
+			events <- enveloped
 		}
 	}()
 
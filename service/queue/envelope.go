@@ -0,0 +1,186 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Events are sent in CloudEvents binary content mode: the event data is the message body,
+	while the envelope attributes are sent as AMQP application properties or SQS message attributes,
+	prefixed by cloudEvents_ (https://github.com/cloudevents/spec/blob/v1.0.1/amqp-protocol-binding.md).
+*/
+
+const (
+	CloudEventsSpecVersion = "1.0"
+	CloudEventsPrefix      = "cloudEvents_"
+
+	SpecVersionAttribute     = CloudEventsPrefix + "specversion"
+	IDAttribute              = CloudEventsPrefix + "id"
+	SourceAttribute          = CloudEventsPrefix + "source"
+	TypeAttribute            = CloudEventsPrefix + "type"
+	TimeAttribute            = CloudEventsPrefix + "time"
+	DataContentTypeAttribute = CloudEventsPrefix + "datacontenttype"
+	// extension attributes
+	SchemaVersionAttribute = CloudEventsPrefix + "schemaversion"
+	CorrelationIDAttribute = CloudEventsPrefix + "correlationid"
+
+	JSONContentType = "application/json"
+)
+
+// Envelope holds the metadata common to all events
+type Envelope struct {
+	ID              string
+	Source          string
+	Time            time.Time
+	Type            string
+	SchemaVersion   int
+	CorrelationID   string
+	DataContentType string
+}
+
+// EnvelopedEvent is an event along with its envelope.
+// Listeners deliver received events wrapped in an EnvelopedEvent,
+// and emitters use the envelope of an EnvelopedEvent instead of creating a new one.
+type EnvelopedEvent struct {
+	Event
+	Envelope *Envelope
+	// Ack, if set by the listener, is told by Acknowledge whether the event was handled
+	Ack func(err error)
+}
+
+// Acknowledge reports the outcome of handling a received event to the listener which delivered it.
+// Listeners which set an Ack keep the message queued until the event is handled without error.
+func Acknowledge(event Event, err error) {
+	if enveloped, ok := event.(*EnvelopedEvent); ok && enveloped.Ack != nil {
+		enveloped.Ack(err)
+	}
+}
+
+// MarshalJSON serializes only the wrapped event, the envelope being sent as message attributes
+func (e *EnvelopedEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.Event)
+}
+
+// Correlated is implemented by events which belong to a flow started by another event or request
+type Correlated interface {
+	CorrelationID() string
+}
+
+// Unwrap returns the wrapped event and its envelope, if any
+func Unwrap(event Event) (Event, *Envelope) {
+	if enveloped, ok := event.(*EnvelopedEvent); ok {
+		return enveloped.Event, enveloped.Envelope
+	}
+	return event, nil
+}
+
+// NewEnvelope builds the envelope of an event about to be emitted by source.
+func NewEnvelope(event Event, source string) *Envelope {
+	envelope := &Envelope{}
+	if _, existing := Unwrap(event); existing != nil {
+		*envelope = *existing
+	}
+
+	if envelope.ID == "" {
+		envelope.ID = NewEventID()
+	}
+	if envelope.Source == "" {
+		envelope.Source = source
+	}
+	if envelope.Time.IsZero() {
+		envelope.Time = time.Now().UTC()
+	}
+	if envelope.Type == "" {
+		envelope.Type = event.Name()
+	}
+	if envelope.SchemaVersion == 0 {
+		envelope.SchemaVersion = DefaultRegistry.SchemaVersion(envelope.Type)
+	}
+	if envelope.CorrelationID == "" {
+		if correlated, ok := event.(Correlated); ok {
+			envelope.CorrelationID = correlated.CorrelationID()
+		} else {
+			envelope.CorrelationID = envelope.ID
+		}
+	}
+	if envelope.DataContentType == "" {
+		envelope.DataContentType = JSONContentType
+	}
+
+	return envelope
+}
+
+// Attributes encodes the envelope as CloudEvents attributes
+func (e *Envelope) Attributes() map[string]string {
+	return map[string]string{
+		SpecVersionAttribute:     CloudEventsSpecVersion,
+		IDAttribute:              e.ID,
+		SourceAttribute:          e.Source,
+		TypeAttribute:            e.Type,
+		TimeAttribute:            e.Time.Format(time.RFC3339Nano),
+		DataContentTypeAttribute: e.DataContentType,
+		SchemaVersionAttribute:   strconv.Itoa(e.SchemaVersion),
+		CorrelationIDAttribute:   e.CorrelationID,
+	}
+}
+
+// EnvelopeFromAttributes decodes an envelope from CloudEvents attributes.
+// Messages sent before the envelope was introduced only carry the x-event-name header; they are read as schema version 1.
+func EnvelopeFromAttributes(attributes map[string]string) (*Envelope, error) {
+	eventType, ok := attributes[TypeAttribute]
+	if !ok {
+		legacyName, ok := attributes[EventNameHeader]
+		if !ok {
+			return nil, fmt.Errorf("message did not contain %s attribute", TypeAttribute)
+		}
+		return &Envelope{
+			Type:            legacyName,
+			SchemaVersion:   1,
+			DataContentType: JSONContentType,
+		}, nil
+	}
+
+	if specVersion := attributes[SpecVersionAttribute]; !strings.HasPrefix(specVersion, "1.") {
+		return nil, fmt.Errorf("unsupported cloudevents spec version: %s", specVersion)
+	}
+
+	envelope := &Envelope{
+		ID:              attributes[IDAttribute],
+		Source:          attributes[SourceAttribute],
+		Type:            eventType,
+		SchemaVersion:   1,
+		CorrelationID:   attributes[CorrelationIDAttribute],
+		DataContentType: attributes[DataContentTypeAttribute],
+	}
+
+	if rawTime, ok := attributes[TimeAttribute]; ok {
+		eventTime, err := time.Parse(time.RFC3339Nano, rawTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s attribute: %s", TimeAttribute, err)
+		}
+		envelope.Time = eventTime
+	}
+	if rawVersion, ok := attributes[SchemaVersionAttribute]; ok {
+		version, err := strconv.Atoi(rawVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s attribute: %s", SchemaVersionAttribute, err)
+		}
+		envelope.SchemaVersion = version
+	}
+
+	return envelope, nil
+}
+
+// NewEventID returns a random (version 4) UUID
+func NewEventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,13 @@
+package queue
+
+import "github.com/bogdanrat/web-server/contracts/models"
+
+// the events shared by all services are registered in the default registry
+func init() {
+	RegisterEvent(models.UserSignUpEventName, 1, func() Event { return &models.UserSignUpEvent{} })
+	RegisterEvent(models.NewKeyValuePairEventName, 1, func() Event { return &models.NewKeyValuePairEvent{} })
+	RegisterEvent(models.DeleteKeyValuePairEventName, 1, func() Event { return &models.DeleteKeyValuePairEvent{} })
+	RegisterEvent(models.FileUploadedEventName, 1, func() Event { return &models.FileUploadedEvent{} })
+	RegisterEvent(models.FileDeletedEventName, 1, func() Event { return &models.FileDeletedEvent{} })
+	RegisterEvent(models.PrefixDeletedEventName, 1, func() Event { return &models.PrefixDeletedEvent{} })
+}
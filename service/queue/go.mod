@@ -9,3 +9,5 @@ require (
 	github.com/streadway/amqp v1.0.0
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
 )
+
+replace github.com/bogdanrat/web-server/contracts => ../../contracts
@@ -7,17 +7,22 @@ import (
 type MapperType int
 
 const (
-	StaticMapper MapperType = iota
+	RegistryMapper MapperType = iota
 )
 
 type EventMapper interface {
+	// MapEvent maps a serialized event of the current schema version
 	MapEvent(eventName string, serialized interface{}) (Event, error)
+	// MapVersionedEvent maps a serialized event of the given schema version, upcasting it to the current version
+	MapVersionedEvent(eventName string, schemaVersion int, serialized interface{}) (Event, error)
+	// SchemaVersion returns the current schema version of the event
+	SchemaVersion(eventName string) int
 }
 
 func NewEventMapper(mapperType MapperType) (EventMapper, error) {
 	switch mapperType {
-	case StaticMapper:
-		return &StaticEventMapper{}, nil
+	case RegistryMapper:
+		return DefaultRegistry, nil
 	default:
 		return nil, errors.New("unknown event mapper type")
 	}
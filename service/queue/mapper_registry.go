@@ -0,0 +1,172 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"sync"
+)
+
+// EventFactory returns a new, empty instance of an event type
+type EventFactory func() Event
+
+// Upcaster converts the serialized data of an event from a schema version to the next one
+type Upcaster func(data map[string]interface{}) (map[string]interface{}, error)
+
+// RegistryEventMapper maps events by the types registered by the packages which define them
+type RegistryEventMapper struct {
+	mutex sync.RWMutex
+	types map[string]*eventType
+}
+
+type eventType struct {
+	version int
+	factory EventFactory
+	// upcasters, keyed by the schema version they convert from
+	upcasters map[int]Upcaster
+}
+
+var (
+	DefaultRegistry = NewRegistryEventMapper()
+)
+
+func NewRegistryEventMapper() *RegistryEventMapper {
+	return &RegistryEventMapper{
+		types: make(map[string]*eventType),
+	}
+}
+
+// RegisterEvent registers an event type in the default registry
+func RegisterEvent(eventName string, schemaVersion int, factory EventFactory) {
+	DefaultRegistry.Register(eventName, schemaVersion, factory)
+}
+
+// RegisterUpcaster registers an upcaster in the default registry
+func RegisterUpcaster(eventName string, fromVersion int, upcaster Upcaster) {
+	DefaultRegistry.RegisterUpcaster(eventName, fromVersion, upcaster)
+}
+
+// Register registers the current schema version of an event type
+func (m *RegistryEventMapper) Register(eventName string, schemaVersion int, factory EventFactory) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if existing, ok := m.types[eventName]; ok {
+		existing.version = schemaVersion
+		existing.factory = factory
+		return
+	}
+
+	m.types[eventName] = &eventType{
+		version:   schemaVersion,
+		factory:   factory,
+		upcasters: make(map[int]Upcaster),
+	}
+}
+
+// RegisterUpcaster registers the conversion of an event from fromVersion to fromVersion + 1.
+// The event type has to be registered first.
+func (m *RegistryEventMapper) RegisterUpcaster(eventName string, fromVersion int, upcaster Upcaster) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	registered, ok := m.types[eventName]
+	if !ok {
+		panic(fmt.Sprintf("cannot register upcaster for unknown event type: %s", eventName))
+	}
+	registered.upcasters[fromVersion] = upcaster
+}
+
+func (m *RegistryEventMapper) SchemaVersion(eventName string) int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if registered, ok := m.types[eventName]; ok {
+		return registered.version
+	}
+	return 1
+}
+
+func (m *RegistryEventMapper) MapEvent(eventName string, serialized interface{}) (Event, error) {
+	return m.MapVersionedEvent(eventName, m.SchemaVersion(eventName), serialized)
+}
+
+func (m *RegistryEventMapper) MapVersionedEvent(eventName string, schemaVersion int, serialized interface{}) (Event, error) {
+	m.mutex.RLock()
+	registered, ok := m.types[eventName]
+	m.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown event type: %s", eventName)
+	}
+
+	if schemaVersion > registered.version {
+		return nil, fmt.Errorf("unsupported schema version %d of event %s, current version is %d", schemaVersion, eventName, registered.version)
+	}
+
+	if schemaVersion < registered.version {
+		upcasted, err := m.upcast(eventName, registered, schemaVersion, serialized)
+		if err != nil {
+			return nil, err
+		}
+		serialized = upcasted
+	}
+
+	event := registered.factory()
+
+	switch s := serialized.(type) {
+	case []byte:
+		err := json.Unmarshal(s, event)
+		if err != nil {
+			return nil, fmt.Errorf("could not unmarshal event %s: %s", eventName, err)
+		}
+	default:
+		cfg := &mapstructure.DecoderConfig{
+			Result:  event,
+			TagName: "json",
+		}
+		decoder, err := mapstructure.NewDecoder(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize decoder for event %s: %s", eventName, err)
+		}
+
+		err = decoder.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode event %s: %s", eventName, err)
+		}
+	}
+
+	return event, nil
+}
+
+// upcast applies the upcasters of the event one after another, returning the json data of the current schema version
+func (m *RegistryEventMapper) upcast(eventName string, registered *eventType, schemaVersion int, serialized interface{}) ([]byte, error) {
+	var data map[string]interface{}
+
+	switch s := serialized.(type) {
+	case []byte:
+		if err := json.Unmarshal(s, &data); err != nil {
+			return nil, fmt.Errorf("could not unmarshal event %s: %s", eventName, err)
+		}
+	case map[string]interface{}:
+		data = s
+	default:
+		return nil, fmt.Errorf("cannot upcast event %s serialized as %T", eventName, serialized)
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for version := schemaVersion; version < registered.version; version++ {
+		upcaster, ok := registered.upcasters[version]
+		if !ok {
+			return nil, fmt.Errorf("missing upcaster of event %s from schema version %d", eventName, version)
+		}
+
+		var err error
+		if data, err = upcaster(data); err != nil {
+			return nil, fmt.Errorf("could not upcast event %s from schema version %d: %s", eventName, version, err)
+		}
+	}
+
+	return json.Marshal(data)
+}
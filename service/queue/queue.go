@@ -1,5 +1,7 @@
 package queue
 
 const (
+	// EventNameHeader carried the event name before events were sent with a CloudEvents envelope.
+	// It is still read from messages which do not have the envelope attributes.
 	EventNameHeader = "x-event-name"
 )
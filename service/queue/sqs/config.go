@@ -2,6 +2,18 @@ package sqs
 
 const (
 	MessageGroupIDAuth = "auth"
+	// MessageGroupIDStorage keeps the storage events in the order of the changes
+	MessageGroupIDStorage = "storage"
+)
+
+// Policies applied to received messages whose event name was not requested by the listener, or which cannot be read
+const (
+	// LeaveUnrequested leaves the message in the queue; it becomes visible again after the visibility timeout
+	LeaveUnrequested = "leave"
+	// DeleteUnrequested removes the message from the queue
+	DeleteUnrequested = "delete"
+	// DeadLetterUnrequested moves the message to the configured dead-letter queue
+	DeadLetterUnrequested = "dead-letter"
 )
 
 type Config struct {
@@ -12,4 +24,8 @@ type Config struct {
 	MaxNumberOfMessages       int64
 	VisibilityTimeout         int64
 	WaitTimeSeconds           int64
+	UnrequestedEventPolicy    string
+	DeadLetterQueueName       string
+	// Source identifies the emitting service in the events' envelope
+	Source string
 }
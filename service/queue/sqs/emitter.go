@@ -27,7 +27,8 @@ func NewEventEmitter(sess *session.Session, config Config) (queue.EventEmitter,
 
 	svc := sqs.New(sess)
 	emitter := &sqsEventEmitter{
-		svc: svc,
+		svc:    svc,
+		config: config,
 	}
 
 	if err := emitter.setup(config); err != nil {
@@ -90,24 +91,33 @@ func (e *sqsEventEmitter) Emit(event queue.Event) error {
 		return fmt.Errorf("could not marshal json event: %s", err.Error())
 	}
 
+	envelope := queue.NewEnvelope(event, e.config.Source)
+
 	var messageGroupID *string
-	switch event.Name() {
+	switch envelope.Type {
 	case models.UserSignUpEventName:
 		messageGroupID = aws.String(MessageGroupIDAuth)
+	case models.FileUploadedEventName, models.FileDeletedEventName, models.PrefixDeletedEventName:
+		messageGroupID = aws.String(MessageGroupIDStorage)
+	}
+
+	messageAttributes := make(map[string]*sqs.MessageAttributeValue)
+	for name, value := range envelope.Attributes() {
+		messageAttributes[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
 	}
 
 	message := &sqs.SendMessageInput{
-		QueueUrl:    e.queueUrl,
-		MessageBody: aws.String(string(jsonBody)),
-		MessageAttributes: map[string]*sqs.MessageAttributeValue{
-			queue.EventNameHeader: {
-				DataType:    aws.String("String"),
-				StringValue: aws.String(event.Name()),
-			},
-		},
+		QueueUrl:          e.queueUrl,
+		MessageBody:       aws.String(string(jsonBody)),
+		MessageAttributes: messageAttributes,
 	}
 	if e.isFifo {
 		message.MessageGroupId = messageGroupID
+		// the event id lets SQS drop the same event sent more than once within the deduplication interval
+		message.MessageDeduplicationId = aws.String(envelope.ID)
 	}
 
 	_, err = e.svc.SendMessage(message)
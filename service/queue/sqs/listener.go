@@ -9,13 +9,38 @@ import (
 	"github.com/bogdanrat/web-server/service/queue"
 	"log"
 	"strings"
+	"sync"
 )
 
+// GroupHandler handles events received with a given message group id.
+// The message is deleted from the queue only when the handler returns no error.
+type GroupHandler func(event queue.Event) error
+
+// GroupRouter is implemented by listeners able to fan out messages to per-group handlers.
+type GroupRouter interface {
+	RouteGroup(groupID string, handler GroupHandler)
+}
+
 type sqsEventListener struct {
-	svc      *sqs.SQS
-	queueUrl *string
-	mapper   queue.EventMapper
-	config   Config
+	svc              *sqs.SQS
+	queueUrl         *string
+	deadLetterUrl    *string
+	mapper           queue.EventMapper
+	config           Config
+	groupsMutex      sync.RWMutex
+	groups           map[string]*groupWorker
+	unrequestedEvent string
+}
+
+// groupWorker processes the messages of a single message group sequentially, preserving their order.
+type groupWorker struct {
+	handler  GroupHandler
+	messages chan *groupMessage
+}
+
+type groupMessage struct {
+	event   queue.Event
+	message *sqs.Message
 }
 
 func NewEventListener(sess *session.Session, config Config) (queue.EventListener, error) {
@@ -25,7 +50,7 @@ func NewEventListener(sess *session.Session, config Config) (queue.EventListener
 
 	svc := sqs.New(sess)
 
-	mapper, err := queue.NewEventMapper(queue.StaticMapper)
+	mapper, err := queue.NewEventMapper(queue.RegistryMapper)
 	if err != nil {
 		return nil, err
 	}
@@ -34,6 +59,7 @@ func NewEventListener(sess *session.Session, config Config) (queue.EventListener
 		svc:    svc,
 		mapper: mapper,
 		config: config,
+		groups: make(map[string]*groupWorker),
 	}
 
 	if err := listener.setup(config); err != nil {
@@ -43,28 +69,81 @@ func NewEventListener(sess *session.Session, config Config) (queue.EventListener
 }
 
 func (l *sqsEventListener) setup(config Config) error {
+	queueUrl, err := l.getQueueUrl(config.QueueName)
+	if err != nil {
+		return err
+	}
+	l.queueUrl = queueUrl
+
+	switch config.UnrequestedEventPolicy {
+	case "", LeaveUnrequested:
+		l.unrequestedEvent = LeaveUnrequested
+	case DeleteUnrequested:
+		l.unrequestedEvent = DeleteUnrequested
+	case DeadLetterUnrequested:
+		if config.DeadLetterQueueName == "" {
+			return fmt.Errorf("dead-letter queue name is required by the %s policy", DeadLetterUnrequested)
+		}
+		deadLetterUrl, err := l.getQueueUrl(config.DeadLetterQueueName)
+		if err != nil {
+			return err
+		}
+		l.deadLetterUrl = deadLetterUrl
+		l.unrequestedEvent = DeadLetterUnrequested
+	default:
+		return fmt.Errorf("unknown unrequested event policy: %s", config.UnrequestedEventPolicy)
+	}
+
+	return nil
+}
+
+func (l *sqsEventListener) getQueueUrl(queueName string) (*string, error) {
 	output, err := l.svc.GetQueueUrl(&sqs.GetQueueUrlInput{
-		QueueName: aws.String(config.QueueName),
+		QueueName: aws.String(queueName),
 	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			code := aerr.Code()
 			switch code {
 			case sqs.ErrCodeQueueDoesNotExist, "NotFound":
-				log.Printf("SQS Queue not found: %s\n", config.QueueName)
-				return err
+				log.Printf("SQS Queue not found: %s\n", queueName)
+				return nil, err
 			}
 		}
-		return err
+		return nil, err
+	}
+	return output.QueueUrl, nil
+}
+
+// RouteGroup registers a handler for all messages received with the given message group id.
+// Messages of a group are handled one by one, in the order they were received.
+// Groups must be routed before calling Listen.
+func (l *sqsEventListener) RouteGroup(groupID string, handler GroupHandler) {
+	l.groupsMutex.Lock()
+	defer l.groupsMutex.Unlock()
+
+	key := strings.ToLower(groupID)
+	if worker, ok := l.groups[key]; ok {
+		worker.handler = handler
+		return
+	}
+
+	l.groups[key] = &groupWorker{
+		handler:  handler,
+		messages: make(chan *groupMessage),
 	}
-	l.queueUrl = output.QueueUrl
-	return nil
 }
 
 func (l *sqsEventListener) Listen(eventNames ...string) (<-chan queue.Event, <-chan error, error) {
 	events := make(chan queue.Event)
 	errors := make(chan error)
 
+	l.groupsMutex.RLock()
+	for _, worker := range l.groups {
+		go l.processGroup(worker, errors)
+	}
+	l.groupsMutex.RUnlock()
+
 	go func() {
 		for {
 			l.receiveMessage(events, errors, eventNames...)
@@ -88,46 +167,145 @@ func (l *sqsEventListener) receiveMessage(events chan queue.Event, errors chan e
 		return
 	}
 
-	foundEvent := false
 	for _, message := range output.Messages {
-		attributeValue, ok := message.MessageAttributes[queue.EventNameHeader]
-		if !ok {
-			continue
-		}
-		messageGroupID, ok := message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]
-		if ok && strings.EqualFold(*messageGroupID, MessageGroupIDAuth) {
-			// have a fan-out based on message group id, for example
+		attributes := make(map[string]string)
+		for name, value := range message.MessageAttributes {
+			if value != nil && value.StringValue != nil {
+				attributes[name] = *value.StringValue
+			}
 		}
 
-		eventName := aws.StringValue(attributeValue.StringValue)
-		for _, event := range eventNames {
-			if strings.EqualFold(eventName, event) {
-				foundEvent = true
-				break
-			}
+		envelope, err := queue.EnvelopeFromAttributes(attributes)
+		if err != nil {
+			errors <- fmt.Errorf("message %s: %s", aws.StringValue(message.MessageId), err)
+			l.handleUnrequested(message, errors)
+			continue
 		}
-		if !foundEvent {
+
+		if !isRequested(envelope.Type, eventNames) {
+			l.handleUnrequested(message, errors)
 			continue
 		}
 
 		messageBody := aws.StringValue(message.Body)
-		event, err := l.mapper.MapEvent(eventName, []byte(messageBody))
+		mapped, err := l.mapper.MapVersionedEvent(envelope.Type, envelope.SchemaVersion, []byte(messageBody))
 		if err != nil {
-			errors <- err
+			// a malformed message, or one of an unknown schema version, would otherwise be redelivered forever
+			errors <- fmt.Errorf("message %s: %s", aws.StringValue(message.MessageId), err)
+			l.handleUnrequested(message, errors)
 			continue
 		}
+		event := &queue.EnvelopedEvent{
+			Event:    mapped,
+			Envelope: envelope,
+		}
+
+		// fan-out based on message group id: messages of a routed group go to their group handler
+		if worker := l.groupWorker(message); worker != nil {
+			worker.messages <- &groupMessage{
+				event:   event,
+				message: message,
+			}
+			continue
+		}
+
+		// the message is deleted once the event is handled, otherwise it is redelivered after the visibility timeout.
+		// The errors are logged, the acknowledgement being made by the goroutine which also reads the errors channel.
+		event.Ack = func(message *sqs.Message) func(error) {
+			return func(err error) {
+				if err != nil {
+					log.Printf("event %s not handled, leaving message %s in the queue: %s", envelope.Type, aws.StringValue(message.MessageId), err)
+					return
+				}
+				if err = l.deleteMessage(message); err != nil {
+					log.Println(err)
+				}
+			}
+		}(message)
 		events <- event
+	}
+}
 
-		_, err = l.svc.DeleteMessage(&sqs.DeleteMessageInput{
-			QueueUrl:      l.queueUrl,
-			ReceiptHandle: message.ReceiptHandle,
-		})
-		if err != nil {
+func (l *sqsEventListener) groupWorker(message *sqs.Message) *groupWorker {
+	messageGroupID, ok := message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]
+	if !ok || messageGroupID == nil {
+		return nil
+	}
+
+	l.groupsMutex.RLock()
+	defer l.groupsMutex.RUnlock()
+	return l.groups[strings.ToLower(*messageGroupID)]
+}
+
+func (l *sqsEventListener) processGroup(worker *groupWorker, errors chan error) {
+	for groupMessage := range worker.messages {
+		l.groupsMutex.RLock()
+		handler := worker.handler
+		l.groupsMutex.RUnlock()
+
+		if err := handler(groupMessage.event); err != nil {
+			// leave the message in the queue, it will be redelivered after the visibility timeout
+			errors <- fmt.Errorf("could not handle event %s: %s", groupMessage.event.Name(), err)
+			continue
+		}
+
+		if err := l.deleteMessage(groupMessage.message); err != nil {
+			errors <- err
+		}
+	}
+}
+
+func (l *sqsEventListener) handleUnrequested(message *sqs.Message, errors chan error) {
+	switch l.unrequestedEvent {
+	case DeleteUnrequested:
+		if err := l.deleteMessage(message); err != nil {
+			errors <- err
+		}
+	case DeadLetterUnrequested:
+		if err := l.deadLetter(message); err != nil {
 			errors <- err
 		}
 	}
 }
 
+func (l *sqsEventListener) deadLetter(message *sqs.Message) error {
+	input := &sqs.SendMessageInput{
+		QueueUrl:          l.deadLetterUrl,
+		MessageBody:       message.Body,
+		MessageAttributes: message.MessageAttributes,
+	}
+	if strings.Contains(aws.StringValue(l.deadLetterUrl), ".fifo") {
+		messageGroupID, ok := message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]
+		if !ok || messageGroupID == nil {
+			messageGroupID = aws.String(MessageGroupIDAuth)
+		}
+		input.MessageGroupId = messageGroupID
+		input.MessageDeduplicationId = message.MessageId
+	}
+
+	if _, err := l.svc.SendMessage(input); err != nil {
+		return fmt.Errorf("could not move message %s to dead-letter queue: %s", aws.StringValue(message.MessageId), err)
+	}
+	return l.deleteMessage(message)
+}
+
+func (l *sqsEventListener) deleteMessage(message *sqs.Message) error {
+	_, err := l.svc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      l.queueUrl,
+		ReceiptHandle: message.ReceiptHandle,
+	})
+	return err
+}
+
+func isRequested(eventName string, eventNames []string) bool {
+	for _, event := range eventNames {
+		if strings.EqualFold(eventName, event) {
+			return true
+		}
+	}
+	return false
+}
+
 func (l *sqsEventListener) EventMapper() queue.EventMapper {
 	return l.mapper
 }
@@ -6,18 +6,34 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
 	"github.com/bogdanrat/web-server/service/monitor"
+	"github.com/bogdanrat/web-server/service/queue"
+	amqp_queue "github.com/bogdanrat/web-server/service/queue/amqp"
+	sqs_queue "github.com/bogdanrat/web-server/service/queue/sqs"
+	"github.com/bogdanrat/web-server/service/storage/compression"
 	"github.com/bogdanrat/web-server/service/storage/config"
+	"github.com/bogdanrat/web-server/service/storage/encryption"
+	"github.com/bogdanrat/web-server/service/storage/events"
 	"github.com/bogdanrat/web-server/service/storage/handler"
+	"github.com/bogdanrat/web-server/service/storage/imaging"
 	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store/casstore"
 	"github.com/bogdanrat/web-server/service/storage/persistence/store/diskstore"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store/multistore"
 	"github.com/bogdanrat/web-server/service/storage/persistence/store/s3store"
+	"github.com/bogdanrat/web-server/service/storage/presign"
+	"github.com/bogdanrat/web-server/service/storage/trash"
+	"github.com/bogdanrat/web-server/service/storage/usage"
+	"github.com/bogdanrat/web-server/service/storage/validation"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/streadway/amqp"
 	"google.golang.org/grpc"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"time"
 )
 
 var (
@@ -40,22 +56,71 @@ func Init() error {
 	log.Println("AWS Session initialized.")
 
 	// init storage
-	var storage store.Store
-	switch config.AppConfig.StorageEngine {
-	case "disk":
-		storage = diskstore.New(config.AppConfig.DiskStorage.Path)
-	case "s3":
-		storage = s3store.New(config.AWSSession, config.AppConfig.AWS.S3)
-	default:
-		return fmt.Errorf("unknown storage engine %s", config.AppConfig.StorageEngine)
+	storage, err := newEngine(config.AppConfig.StorageEngine)
+	if err != nil {
+		return err
+	}
+
+	// the presigning capability belongs to the storage engine, not to its decorators
+	presigner, ok := storage.(store.Presigner)
+
+	var encryptedStore *encryption.Store
+	if config.AppConfig.Encryption.Enabled {
+		keys, err := encryption.NewKeyRing(config.AppConfig.Encryption)
+		if err != nil {
+			return err
+		}
+		encryptedStore = encryption.NewStore(storage, keys, config.AppConfig.Encryption.ChunkSize)
+		storage = encryptedStore
+		// the urls presigned by the storage engine would give access to the encrypted content
+		ok = false
+		log.Println("Encryption at rest enabled.")
+	}
+
+	// objects are compressed before being encrypted, since encrypted content does not compress
+	var compressedStore *compression.Store
+	if config.AppConfig.Compression.Enabled {
+		compressedStore, err = compression.NewStore(storage, config.AppConfig.Compression)
+		if err != nil {
+			return err
+		}
+		storage = compressedStore
+		// the urls presigned by the storage engine would give access to the compressed content
+		ok = false
+		log.Println("Compression enabled.")
+	}
+	engine := storage
+
+	// usage is tracked for all changes, including the trash's and the presigned uploads'
+	usageTracker := usage.NewTracker(config.AppConfig.Quota)
+	storage = usage.NewStore(storage, usageTracker)
+
+	// the events are emitted for the files changed through the service, e.g. not for the image variants
+	if config.AppConfig.MessageBroker.Broker != "" {
+		eventEmitter, err := initEventEmitter(config.AppConfig.MessageBroker)
+		if err != nil {
+			return fmt.Errorf("could not initialize %s message broker: %s", config.AppConfig.MessageBroker.Broker, err)
+		}
+		storage = events.NewStore(storage, eventEmitter)
+		log.Printf("Message Broker %s initialized.\n", config.AppConfig.MessageBroker.Broker)
 	}
 
 	if err = storage.Init(); err != nil {
 		return err
 	}
+	if encryptedStore != nil && config.AppConfig.Encryption.RotateOnStart {
+		encryptedStore.StartRotation()
+	}
 
-	if config.AppConfig.Prometheus.Enabled {
-		initPrometheus()
+	// stores unable to presign urls get urls served by the storage service
+	var localPresigner *presign.LocalPresigner
+	if !ok {
+		localPresigner = presign.NewLocal(storage, config.AppConfig.Presign)
+		presigner = localPresigner
+	}
+
+	if config.AppConfig.Prometheus.Enabled || localPresigner != nil {
+		initHTTPServer(localPresigner)
 	}
 
 	// init grpc
@@ -67,12 +132,123 @@ func Init() error {
 	var serverOptions []grpc.ServerOption
 	grpcServer = grpc.NewServer(serverOptions...)
 
-	storageServer := handler.New(storage)
+	var trashBin *trash.Bin
+	if config.AppConfig.Trash.Enabled {
+		trashBin = trash.New(storage, time.Second*time.Duration(config.AppConfig.Trash.Retention))
+		trashBin.StartPurger(time.Second * time.Duration(config.AppConfig.Trash.PurgeInterval))
+		log.Println("Trash enabled.")
+	}
+
+	var imageProcessor *imaging.Processor
+	if config.AppConfig.Images.Enabled {
+		// variants are derived from the images, they do not count towards the usage
+		imageProcessor = imaging.NewProcessor(engine, config.AppConfig.Images)
+		imageProcessor.Start()
+		log.Println("Image processing enabled.")
+	}
+
+	validator, err := validation.New(config.AppConfig.Validation)
+	if err != nil {
+		return err
+	}
+	if validator.Scanner != nil {
+		log.Printf("Upload scanning enabled with %s.\n", config.AppConfig.Validation.Scanner.Engine)
+	}
+
+	storageServer := handler.New(storage, trashBin, presigner, usageTracker, imageProcessor, validator, compressedStore)
 	pb.RegisterStorageServer(grpcServer, storageServer)
 
 	return nil
 }
 
+func newEngine(name string) (store.Store, error) {
+	switch name {
+	case "disk":
+		return diskstore.New(config.AppConfig.DiskStorage), nil
+	case "cas":
+		return casstore.New(config.AppConfig.CASStorage), nil
+	case "s3":
+		return s3store.New(config.AWSSession, config.AppConfig.AWS.S3), nil
+	case "multi":
+		return newMultiStore(config.AppConfig.MultiStorage)
+	default:
+		return nil, fmt.Errorf("unknown storage engine %s", name)
+	}
+}
+
+// newMultiStore composes the engines named by the configuration, each engine being used once
+func newMultiStore(multiConfig config.MultiStorageConfig) (store.Store, error) {
+	engines := make(map[string]store.Store)
+	engine := func(name string) (store.Store, error) {
+		if name == "multi" || engines[name] != nil {
+			return nil, fmt.Errorf("storage engine %s cannot be composed more than once", name)
+		}
+		storage, err := newEngine(name)
+		if err != nil {
+			return nil, err
+		}
+		engines[name] = storage
+		return storage, nil
+	}
+
+	primary, err := engine(multiConfig.Primary)
+	if err != nil {
+		return nil, err
+	}
+	secondaries := make([]store.Store, 0, len(multiConfig.Secondaries))
+	for _, name := range multiConfig.Secondaries {
+		secondary, err := engine(name)
+		if err != nil {
+			return nil, err
+		}
+		secondaries = append(secondaries, secondary)
+	}
+	var cold store.Store
+	if multiConfig.Cold != "" {
+		if cold, err = engine(multiConfig.Cold); err != nil {
+			return nil, err
+		}
+	}
+
+	return multistore.New(primary, secondaries, cold, multiConfig), nil
+}
+
+func initEventEmitter(brokerConfig config.MessageBrokerConfig) (queue.EventEmitter, error) {
+	switch brokerConfig.Broker {
+	case config.RabbitMQBroker:
+		amqpUri := os.Getenv("RABBITMQ_URL")
+		if amqpUri == "" {
+			log.Printf("missing env rabbitmq url, using config url")
+			amqpUri = fmt.Sprintf("amqp://%s:%s@%s:%s", brokerConfig.RabbitMQ.DefaultUser, brokerConfig.RabbitMQ.DefaultPassword, brokerConfig.RabbitMQ.Host, brokerConfig.RabbitMQ.Port)
+		}
+
+		conn, err := amqp.Dial(amqpUri)
+		if err != nil {
+			return nil, fmt.Errorf("could not dial %s: %s", amqpUri, err)
+		}
+
+		return amqp_queue.NewEventEmitter(conn, amqp_queue.EmitterConfig{
+			URI:             amqpUri,
+			Exchange:        brokerConfig.RabbitMQ.Exchange,
+			Source:          brokerConfig.Source,
+			ChannelPoolSize: brokerConfig.RabbitMQ.ChannelPoolSize,
+			MaxRetries:      brokerConfig.RabbitMQ.MaxRetries,
+			RetryInterval:   brokerConfig.RabbitMQ.RetryInterval,
+			ConfirmTimeout:  brokerConfig.RabbitMQ.ConfirmTimeout,
+		})
+	case config.SQSBroker:
+		return sqs_queue.NewEventEmitter(config.AWSSession, sqs_queue.Config{
+			QueueName:                 brokerConfig.SQS.QueueName,
+			ContentBasedDeduplication: brokerConfig.SQS.ContentBasedDeduplication,
+			DelaySeconds:              brokerConfig.SQS.DelaySeconds,
+			MessageRetentionPeriod:    brokerConfig.SQS.MessageRetentionPeriod,
+			Source:                    brokerConfig.Source,
+		})
+	default:
+		return nil, fmt.Errorf("unknown message broker %s", brokerConfig.Broker)
+	}
+}
+
 func initAwsSession(awsConfig config.AWSConfig) error {
 	sess, err := session.NewSession(&aws.Config{
 		Region:                        aws.String(awsConfig.Region),
@@ -92,15 +268,21 @@ func Start() {
 	}
 }
 
-func initPrometheus() {
-	_ = monitor.Setup()
-	log.Println("Monitoring enabled.")
-
+func initHTTPServer(localPresigner *presign.LocalPresigner) {
 	router := gin.Default()
 	router.Use(cors.Default())
 
-	router.Use(monitor.PrometheusMiddleware())
-	router.GET(config.AppConfig.Prometheus.MetricsPath, gin.WrapH(promhttp.Handler()))
+	if config.AppConfig.Prometheus.Enabled {
+		_ = monitor.Setup()
+		log.Println("Monitoring enabled.")
+
+		router.Use(monitor.PrometheusMiddleware())
+		router.GET(config.AppConfig.Prometheus.MetricsPath, gin.WrapH(promhttp.Handler()))
+	}
+
+	if localPresigner != nil {
+		localPresigner.RegisterRoutes(router)
+	}
 
 	server := &http.Server{
 		Addr:    config.AppConfig.Server.ListenAddress,
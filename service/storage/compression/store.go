@@ -0,0 +1,265 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"io"
+	"log"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Gzip is the content coding of the compressed objects
+const Gzip = "gzip"
+
+// Store compresses the objects of the configured content types, recording the encoding in their metadata, and
+// decompresses them when read. Objects stored without compression are read as is.
+type Store struct {
+	store.Store
+	Config config.CompressionConfig
+}
+
+func NewStore(storage store.Store, compressionConfig config.CompressionConfig) (*Store, error) {
+	if compressionConfig.Level < gzip.HuffmanOnly || compressionConfig.Level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip compression level %d", compressionConfig.Level)
+	}
+	return &Store{
+		Store:  storage,
+		Config: compressionConfig,
+	}, nil
+}
+
+// Put compresses the content if its type is configured, its size is within the limits and compressing it pays off.
+// The content is buffered up to the maximum size, to know its size before storing it.
+func (s *Store) Put(key string, body io.Reader, metadata *store.ObjectMetadata) error {
+	objectMetadata := &store.ObjectMetadata{}
+	if metadata != nil {
+		*objectMetadata = *metadata
+	}
+	objectMetadata.Compression = nil
+
+	if !s.compressible(objectMetadata.ContentType) {
+		return s.Store.Put(key, body, objectMetadata)
+	}
+
+	content := &bytes.Buffer{}
+	size, err := io.CopyN(content, body, s.Config.MaxSize+1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if size > s.Config.MaxSize {
+		return s.Store.Put(key, io.MultiReader(content, body), objectMetadata)
+	}
+	if size < s.Config.MinSize {
+		return s.Store.Put(key, content, objectMetadata)
+	}
+
+	compressed := &bytes.Buffer{}
+	writer, err := gzip.NewWriterLevel(compressed, s.Config.Level)
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(content.Bytes()); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	if compressed.Len() >= content.Len() {
+		return s.Store.Put(key, content, objectMetadata)
+	}
+
+	objectMetadata.Compression = &store.CompressionMetadata{
+		Encoding: Gzip,
+		Size:     size,
+	}
+	return s.Store.Put(key, compressed, objectMetadata)
+}
+
+// compressible reports whether the content type matches the configured ones, which may end with a wildcard subtype
+func (s *Store) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range s.Config.ContentTypes {
+		pattern = strings.ToLower(pattern)
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if pattern == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) Get(key string, writer io.Writer) error {
+	metadata, err := s.Store.GetMetadata(key)
+	if err != nil {
+		return err
+	}
+	return decompress(metadata, writer, func(destination io.Writer) error {
+		return s.Store.Get(key, destination)
+	})
+}
+
+func (s *Store) GetVersion(key, versionID string, writer io.Writer) error {
+	metadata, err := s.Store.GetMetadata(key, versionID)
+	if err != nil {
+		return err
+	}
+	return decompress(metadata, writer, func(destination io.Writer) error {
+		return s.Store.GetVersion(key, versionID, destination)
+	})
+}
+
+// GetEncoded writes the object as stored if the client accepts its encoding, given the Accept-Encoding header of the
+// request, and returns the encoding. Otherwise, the object is decompressed and the returned encoding is empty.
+func (s *Store) GetEncoded(key, acceptEncoding string, writer io.Writer) (string, error) {
+	metadata, err := s.Store.GetMetadata(key)
+	if err != nil {
+		return "", err
+	}
+	if metadata.Compression != nil && Accepts(acceptEncoding, metadata.Compression.Encoding) {
+		return metadata.Compression.Encoding, s.Store.Get(key, writer)
+	}
+	return "", decompress(metadata, writer, func(destination io.Writer) error {
+		return s.Store.Get(key, destination)
+	})
+}
+
+// decompress reads the object with the read function, decompressing its content if it is compressed
+func decompress(metadata *store.ObjectMetadata, writer io.Writer, read func(io.Writer) error) error {
+	if metadata.Compression == nil {
+		return read(writer)
+	}
+	if metadata.Compression.Encoding != Gzip {
+		return fmt.Errorf("unsupported content encoding %s", metadata.Compression.Encoding)
+	}
+
+	reader, pipeWriter := io.Pipe()
+	defer reader.Close()
+	go func() {
+		pipeWriter.CloseWithError(read(pipeWriter))
+	}()
+
+	decompressor, err := gzip.NewReader(reader)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(writer, decompressor); err != nil {
+		return err
+	}
+	return decompressor.Close()
+}
+
+// GetAll, List and ListVersions report the size of the compressed objects' content, rather than their stored size
+
+func (s *Store) GetAll(prefix ...string) ([]*pb.StorageObject, error) {
+	objects, err := s.Store.GetAll(prefix...)
+	if err != nil {
+		return nil, err
+	}
+	s.uncompressedSizes(objects)
+	return objects, nil
+}
+
+func (s *Store) List(prefix string) (*store.Listing, error) {
+	listing, err := s.Store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	s.uncompressedSizes(listing.Objects)
+	return listing, nil
+}
+
+func (s *Store) ListVersions(key string) ([]*pb.ObjectVersion, error) {
+	versions, err := s.Store.ListVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if version.GetIsDeleteMarker() {
+			continue
+		}
+		metadata, err := s.Store.GetMetadata(key, version.GetVersionId())
+		if err != nil {
+			log.Printf("cannot get encoding of %s version %s: %s\n", key, version.GetVersionId(), err)
+			continue
+		}
+		if metadata.Compression != nil {
+			version.Size = uint64(metadata.Compression.Size)
+		}
+	}
+	return versions, nil
+}
+
+// uncompressedSizes replaces the stored sizes of the compressed objects. An object whose encoding cannot be read, e.g.
+// deleted since listed, keeps its stored size rather than failing the whole listing.
+func (s *Store) uncompressedSizes(objects []*pb.StorageObject) {
+	for _, object := range objects {
+		metadata, err := s.Store.GetMetadata(object.GetKey())
+		if err != nil {
+			log.Printf("cannot get encoding of %s: %s\n", object.GetKey(), err)
+			continue
+		}
+		if metadata.Compression != nil {
+			object.Size = uint64(metadata.Compression.Size)
+		}
+	}
+}
+
+// GetMetadata hides the encoding of the object
+func (s *Store) GetMetadata(key string, versionID ...string) (*store.ObjectMetadata, error) {
+	metadata, err := s.Store.GetMetadata(key, versionID...)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Compression = nil
+	return metadata, nil
+}
+
+// SetMetadata keeps the encoding of the object, which the new metadata does not hold
+func (s *Store) SetMetadata(key string, metadata *store.ObjectMetadata) error {
+	current, err := s.Store.GetMetadata(key)
+	if err != nil {
+		return err
+	}
+
+	objectMetadata := *metadata
+	objectMetadata.Compression = current.Compression
+	return s.Store.SetMetadata(key, &objectMetadata)
+}
+
+// Accepts reports whether the Accept-Encoding header accepts the encoding, explicitly or through a wildcard
+func Accepts(acceptEncoding, encoding string) bool {
+	accepted := false
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, quality := coding, 1.0
+		if i := strings.Index(coding, ";"); i >= 0 {
+			name = coding[:i]
+			parameter := strings.TrimSpace(coding[i+1:])
+			if strings.HasPrefix(parameter, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(parameter, "q="), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case encoding:
+			// an explicit coding takes precedence over the wildcard
+			return quality > 0
+		case "*":
+			accepted = quality > 0
+		}
+	}
+	return accepted
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/spf13/viper"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
@@ -21,15 +22,196 @@ type ServerConfig struct {
 }
 
 type UploadConfig struct {
+	// MaxFileSize is in bytes; the client_max_body_size of the presigned urls in router/nginx.conf must not be lower
 	MaxFileSize uint32
 }
 
 type DiskStorageConfig struct {
-	Path string
+	Path       string
+	Versioning bool
+}
+
+type CASStorageConfig struct {
+	Path       string
+	Versioning bool
+	GCInterval int64 // seconds, 0 disables the garbage collection
+}
+
+// MultiStorageConfig composes the other storage engines, each used once: the objects are written to the primary and
+// replicated asynchronously to the secondaries, and the objects older than TierAge move from the primary to the cold engine
+type MultiStorageConfig struct {
+	Primary     string
+	Secondaries []string
+	// Cold is the engine of the cold tier, empty disables tiering
+	Cold         string
+	TierAge      int64 // seconds
+	TierInterval int64 // seconds
+	// ReplicationQueueSize is the number of changes waiting for replication, further changes are left to the reconciliation
+	ReplicationQueueSize int
+	ReconcileInterval    int64 // seconds, 0 disables the reconciliation
+}
+
+func (c MultiStorageConfig) validate() error {
+	// an unbuffered queue would drop every change, the sends being non-blocking
+	if len(c.Secondaries) > 0 && c.ReplicationQueueSize <= 0 {
+		return fmt.Errorf("ReplicationQueueSize must be positive")
+	}
+	return nil
+}
+
+type QuotaConfig struct {
+	Enabled bool
+	// limits of every owner, 0 means unlimited
+	MaxBytesPerOwner   uint64
+	MaxObjectsPerOwner uint64
+	Prefixes           []PrefixQuotaConfig
+}
+
+// PrefixQuotaConfig limits the objects under a top-level prefix (e.g., images), 0 means unlimited
+type PrefixQuotaConfig struct {
+	Prefix     string
+	MaxBytes   uint64
+	MaxObjects uint64
+}
+
+type ValidationConfig struct {
+	// AllowedExtensions restricts the uploads to the extensions, e.g. .png; empty allows all
+	AllowedExtensions []string
+	// AllowedContentTypes restricts the uploads to the sniffed content types, which may end with a wildcard,
+	// e.g. image/*; empty allows all
+	AllowedContentTypes []string
+	DeniedContentTypes  []string
+	// RejectMismatched rejects the files whose content does not match their extension or declared content type
+	RejectMismatched bool
+	Scanner          ScannerConfig
+}
+
+type ScannerConfig struct {
+	// Engine is clamav, or empty to disable scanning
+	Engine string
+	// Network is tcp or unix
+	Network string
+	Address string
+	Timeout int64 // seconds
+	// FailOpen accepts the uploads when the scanner is unavailable
+	FailOpen bool
+}
+
+type EncryptionConfig struct {
+	Enabled bool
+	// ActiveKeyID identifies the master key wrapping the data keys of the new objects
+	ActiveKeyID string
+	// MasterKeys must hold every key still wrapping data keys, including the previous versions'
+	MasterKeys []MasterKeyConfig
+	// ChunkSize is the size of the chunks encrypted separately
+	ChunkSize int
+	// RotateOnStart re-wraps the data keys wrapped by other master keys than the active one
+	RotateOnStart bool
+}
+
+type MasterKeyConfig struct {
+	ID string
+	// Key is the base64 encoded 256-bit key, or KeyFile the path of a file holding it
+	Key     string
+	KeyFile string
+}
+
+type CompressionConfig struct {
+	Enabled bool
+	// ContentTypes are the compressed content types, which may end with a wildcard subtype, e.g. text/*
+	ContentTypes []string
+	// MinSize and MaxSize bound the size of the compressed objects, which are buffered while compressed
+	MinSize int64
+	MaxSize int64
+	// Level is the gzip compression level, from 1 (best speed) to 9 (best compression), or -1 for the default
+	Level int
+}
+
+type TrashConfig struct {
+	Enabled       bool
+	Retention     int64 // seconds
+	PurgeInterval int64 // seconds
+}
+
+func (c TrashConfig) validate() error {
+	if c.Enabled && (c.Retention <= 0 || c.PurgeInterval <= 0) {
+		return fmt.Errorf("Retention and PurgeInterval must be positive")
+	}
+	return nil
+}
+
+type DeletionConfig struct {
+	// ConfirmationSecret signs the tokens confirming the deletion of multiple files, read from
+	// DELETION_CONFIRMATION_SECRET if empty
+	ConfirmationSecret string
+	ConfirmationTTL    int64 // seconds
+}
+
+func (c DeletionConfig) validate() error {
+	if c.ConfirmationSecret == "" || c.ConfirmationSecret == placeholderSecret {
+		return fmt.Errorf("ConfirmationSecret must be set, e.g. through DELETION_CONFIRMATION_SECRET")
+	}
+	if c.ConfirmationTTL <= 0 {
+		return fmt.Errorf("ConfirmationTTL must be positive")
+	}
+	return nil
+}
+
+type PresignConfig struct {
+	Expiration int64 // seconds
+	// BaseURL prefixes the urls served by the storage service when the storage engine cannot presign them; empty yields relative urls
+	BaseURL string
+	// Secret signs the urls served by the storage service, read from PRESIGN_SECRET if empty
+	Secret string
+}
+
+func (c PresignConfig) validate() error {
+	if c.Secret == "" || c.Secret == placeholderSecret {
+		return fmt.Errorf("Secret must be set, e.g. through PRESIGN_SECRET")
+	}
+	if c.Expiration <= 0 {
+		return fmt.Errorf("Expiration must be positive")
+	}
+	return nil
+}
+
+type ImagesConfig struct {
+	// Enabled allows resizing the stored images on request
+	Enabled bool
+	// ThumbnailSizes are generated in the background for every uploaded image
+	ThumbnailSizes   []ImageSizeConfig
+	ThumbnailWorkers int
+	// ThumbnailQueueSize is the number of uploads waiting for their thumbnails, further uploads get them on first request
+	ThumbnailQueueSize int
+	// MaxDimension limits the width and height of the resized images
+	MaxDimension int
+	// MaxSourcePixels limits the size of the images decoded for resizing
+	MaxSourcePixels int
+	// MaxConcurrentResizes bounds the variants generated at once on request, further requests wait for their turn
+	MaxConcurrentResizes int
+}
+
+func (c ImagesConfig) validate() error {
+	if c.Enabled && c.MaxConcurrentResizes <= 0 {
+		return fmt.Errorf("MaxConcurrentResizes must be positive")
+	}
+	return nil
+}
+
+// ImageSizeConfig is a width and a height in pixels, 0 keeps the aspect ratio
+type ImageSizeConfig struct {
+	Width  int
+	Height int
 }
 
 type S3Config struct {
-	Domain           string
+	// Endpoint is the url of an S3-compatible service, e.g. http://localhost:9000 for MinIO; empty for AWS S3
+	Endpoint string
+	// ForcePathStyle addresses the buckets by path rather than by subdomain, as usual for S3-compatible services
+	ForcePathStyle bool
+	// AccessKeyID and SecretAccessKey are static credentials; empty uses the credentials of the AWS session
+	AccessKeyID      string
+	SecretAccessKey  string
 	Bucket           string
 	BucketVersioning bool
 	Concurrency      int
@@ -43,6 +225,38 @@ type AWSConfig struct {
 	S3     S3Config
 }
 
+const (
+	RabbitMQBroker = "RabbitMQ"
+	SQSBroker      = "SQS"
+)
+
+type RabbitMQConfig struct {
+	DefaultUser     string
+	DefaultPassword string
+	Host            string
+	Port            string
+	Exchange        string
+	ChannelPoolSize int
+	MaxRetries      int
+	RetryInterval   int64 // milliseconds
+	ConfirmTimeout  int64 // milliseconds
+}
+
+type SQSConfig struct {
+	QueueName                 string
+	ContentBasedDeduplication string
+	DelaySeconds              string
+	MessageRetentionPeriod    string
+}
+
+// MessageBrokerConfig configures the broker the storage events are emitted to, no events are emitted if Broker is empty
+type MessageBrokerConfig struct {
+	Broker   string
+	Source   string
+	RabbitMQ RabbitMQConfig
+	SQS      SQSConfig
+}
+
 type PrometheusConfig struct {
 	Enabled     bool
 	MetricsPath string
@@ -52,12 +266,26 @@ type Config struct {
 	Service       ServiceConfig
 	Server        ServerConfig
 	Upload        UploadConfig
+	Validation    ValidationConfig
 	StorageEngine string
 	DiskStorage   DiskStorageConfig
+	CASStorage    CASStorageConfig
+	MultiStorage  MultiStorageConfig
+	Encryption    EncryptionConfig
+	Compression   CompressionConfig
+	Quota         QuotaConfig
+	Trash         TrashConfig
+	Deletion      DeletionConfig
+	Presign       PresignConfig
+	Images        ImagesConfig
 	AWS           AWSConfig
+	MessageBroker MessageBrokerConfig
 	Prometheus    PrometheusConfig
 }
 
+// placeholderSecret is the value of the secrets in the sample configurations, which must be replaced
+const placeholderSecret = "change-me"
+
 var (
 	AppConfig  Config
 	AWSSession *session.Session
@@ -79,6 +307,39 @@ func ReadConfiguration() error {
 		return fmt.Errorf("couldn't unmarshal configuration: %v", err)
 	}
 
+	AppConfig.readSecrets()
+	return AppConfig.validate()
+}
+
+// readSecrets fills the secrets left empty in the configuration file from the environment
+func (c *Config) readSecrets() {
+	if c.Deletion.ConfirmationSecret == "" {
+		c.Deletion.ConfirmationSecret = os.Getenv("DELETION_CONFIRMATION_SECRET")
+	}
+	if c.Presign.Secret == "" {
+		c.Presign.Secret = os.Getenv("PRESIGN_SECRET")
+	}
+}
+
+// validate rejects the missing secrets and the values which would stop or break the background workers
+func (c *Config) validate() error {
+	if c.StorageEngine == "multi" {
+		if err := c.MultiStorage.validate(); err != nil {
+			return fmt.Errorf("invalid MultiStorage configuration: %s", err)
+		}
+	}
+	if err := c.Trash.validate(); err != nil {
+		return fmt.Errorf("invalid Trash configuration: %s", err)
+	}
+	if err := c.Deletion.validate(); err != nil {
+		return fmt.Errorf("invalid Deletion configuration: %s", err)
+	}
+	if err := c.Presign.validate(); err != nil {
+		return fmt.Errorf("invalid Presign configuration: %s", err)
+	}
+	if err := c.Images.validate(); err != nil {
+		return fmt.Errorf("invalid Images configuration: %s", err)
+	}
 	return nil
 }
 
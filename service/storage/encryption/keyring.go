@@ -0,0 +1,112 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"io/ioutil"
+	"strings"
+)
+
+// keySize is the size of the master and data keys, for AES-256
+const keySize = 32
+
+// KeyRing holds the master keys, which wrap the data keys of the objects
+type KeyRing struct {
+	// ActiveKeyID identifies the master key wrapping the new data keys
+	ActiveKeyID string
+
+	keys map[string]cipher.AEAD
+}
+
+// NewKeyRing loads the configured master keys, from the configuration or from their files
+func NewKeyRing(encryptionConfig config.EncryptionConfig) (*KeyRing, error) {
+	keyRing := &KeyRing{
+		ActiveKeyID: encryptionConfig.ActiveKeyID,
+		keys:        make(map[string]cipher.AEAD),
+	}
+
+	for _, masterKey := range encryptionConfig.MasterKeys {
+		encoded := masterKey.Key
+		if masterKey.KeyFile != "" {
+			data, err := ioutil.ReadFile(masterKey.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read master key %s: %s", masterKey.ID, err)
+			}
+			encoded = string(data)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("master key %s must be a base64 encoded %d-byte key", masterKey.ID, keySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		keyRing.keys[masterKey.ID] = aead
+	}
+
+	if _, ok := keyRing.keys[keyRing.ActiveKeyID]; !ok {
+		return nil, fmt.Errorf("active master key %s is not configured", keyRing.ActiveKeyID)
+	}
+	return keyRing, nil
+}
+
+// NewDataKey generates a random data key and wraps it with the active master key
+func (k *KeyRing) NewDataKey() ([]byte, string, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", err
+	}
+
+	wrapped, err := k.Wrap(k.ActiveKeyID, dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return dataKey, wrapped, nil
+}
+
+// Wrap encrypts the data key with the master key; the key id is authenticated, so that a wrapped key cannot be
+// attributed to another master key
+func (k *KeyRing) Wrap(keyID string, dataKey []byte) (string, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown master key %s", keyID)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	wrapped := aead.Seal(nonce, nonce, dataKey, []byte(keyID))
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+func (k *KeyRing) Unwrap(keyID, wrappedKey string) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %s", keyID)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil || len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key")
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key with master key %s: %s", keyID, err)
+	}
+	return dataKey, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
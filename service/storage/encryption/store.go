@@ -0,0 +1,296 @@
+package encryption
+
+import (
+	"fmt"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"io"
+	"log"
+	"sync"
+)
+
+const defaultChunkSize = 64 * 1024
+
+// Store encrypts the objects at rest with envelope encryption: the content of every object is encrypted with its own
+// data key, stored in the object's metadata wrapped by a master key. Objects stored without encryption are read as is.
+type Store struct {
+	store.Store
+	Keys      *KeyRing
+	ChunkSize int
+
+	// mutex is held for writing while an envelope is re-wrapped, so that the object is not replaced or read meanwhile
+	mutex sync.RWMutex
+}
+
+func NewStore(storage store.Store, keys *KeyRing, chunkSize int) *Store {
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	return &Store{
+		Store:     storage,
+		Keys:      keys,
+		ChunkSize: chunkSize,
+	}
+}
+
+func (s *Store) Put(key string, body io.Reader, metadata *store.ObjectMetadata) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	dataKey, wrappedKey, err := s.Keys.NewDataKey()
+	if err != nil {
+		return fmt.Errorf("cannot generate data key: %s", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	objectMetadata := &store.ObjectMetadata{}
+	if metadata != nil {
+		*objectMetadata = *metadata
+	}
+	objectMetadata.Encryption = &store.EncryptionMetadata{
+		KeyID:      s.Keys.ActiveKeyID,
+		WrappedKey: wrappedKey,
+		ChunkSize:  s.ChunkSize,
+	}
+
+	return s.Store.Put(key, newEncryptingReader(body, aead, s.ChunkSize), objectMetadata)
+}
+
+// Get and GetVersion hold the lock while reading, so that the envelope is not re-wrapped between the reads of the
+// metadata and of the content
+
+func (s *Store) Get(key string, writer io.Writer) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	metadata, err := s.Store.GetMetadata(key)
+	if err != nil {
+		return err
+	}
+	return s.decrypt(metadata, writer, func(destination io.Writer) error {
+		return s.Store.Get(key, destination)
+	})
+}
+
+func (s *Store) GetVersion(key, versionID string, writer io.Writer) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	metadata, err := s.Store.GetMetadata(key, versionID)
+	if err != nil {
+		return err
+	}
+	return s.decrypt(metadata, writer, func(destination io.Writer) error {
+		return s.Store.GetVersion(key, versionID, destination)
+	})
+}
+
+// decrypt reads the object with the read function, decrypting its content if it is encrypted
+func (s *Store) decrypt(metadata *store.ObjectMetadata, writer io.Writer, read func(io.Writer) error) error {
+	envelope := metadata.Encryption
+	if envelope == nil {
+		return read(writer)
+	}
+
+	dataKey, err := s.Keys.Unwrap(envelope.KeyID, envelope.WrappedKey)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	decrypter := newDecryptingWriter(writer, aead, envelope.ChunkSize)
+	if err = read(decrypter); err != nil {
+		return err
+	}
+	return decrypter.Close()
+}
+
+// GetAll, List and ListVersions report the size of the encrypted objects' content, rather than their stored size
+
+func (s *Store) GetAll(prefix ...string) ([]*pb.StorageObject, error) {
+	objects, err := s.Store.GetAll(prefix...)
+	if err != nil {
+		return nil, err
+	}
+	s.plaintextSizes(objects)
+	return objects, nil
+}
+
+func (s *Store) List(prefix string) (*store.Listing, error) {
+	listing, err := s.Store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	s.plaintextSizes(listing.Objects)
+	return listing, nil
+}
+
+func (s *Store) ListVersions(key string) ([]*pb.ObjectVersion, error) {
+	versions, err := s.Store.ListVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if version.GetIsDeleteMarker() {
+			continue
+		}
+		metadata, err := s.Store.GetMetadata(key, version.GetVersionId())
+		if err != nil {
+			log.Printf("cannot get encryption envelope of %s version %s: %s\n", key, version.GetVersionId(), err)
+			continue
+		}
+		if envelope := metadata.Encryption; envelope != nil {
+			version.Size = uint64(plaintextSize(gcmOverhead, envelope.ChunkSize, int64(version.GetSize())))
+		}
+	}
+	return versions, nil
+}
+
+// plaintextSizes replaces the stored sizes of the encrypted objects. An object whose envelope cannot be read, e.g. deleted
+// since listed, keeps its stored size rather than failing the whole listing.
+func (s *Store) plaintextSizes(objects []*pb.StorageObject) {
+	for _, object := range objects {
+		metadata, err := s.Store.GetMetadata(object.GetKey())
+		if err != nil {
+			log.Printf("cannot get encryption envelope of %s: %s\n", object.GetKey(), err)
+			continue
+		}
+		if envelope := metadata.Encryption; envelope != nil {
+			object.Size = uint64(plaintextSize(gcmOverhead, envelope.ChunkSize, int64(object.GetSize())))
+		}
+	}
+}
+
+// GetMetadata hides the envelope of the object
+func (s *Store) GetMetadata(key string, versionID ...string) (*store.ObjectMetadata, error) {
+	metadata, err := s.Store.GetMetadata(key, versionID...)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Encryption = nil
+	return metadata, nil
+}
+
+// SetMetadata keeps the envelope of the object, which the new metadata does not hold
+func (s *Store) SetMetadata(key string, metadata *store.ObjectMetadata) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	current, err := s.Store.GetMetadata(key)
+	if err != nil {
+		return err
+	}
+
+	objectMetadata := *metadata
+	objectMetadata.Encryption = current.Encryption
+	return s.Store.SetMetadata(key, &objectMetadata)
+}
+
+// Move, Copy, RestoreVersion and DeleteVersion replace the current version of an object, along with its envelope
+
+func (s *Store) Move(srcKey, dstKey string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Store.Move(srcKey, dstKey)
+}
+
+// Copy shares the data key of the source with the copy, both envelopes being re-wrapped on rotation
+func (s *Store) Copy(srcKey, dstKey, owner string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Store.Copy(srcKey, dstKey, owner)
+}
+
+func (s *Store) RestoreVersion(key, versionID string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Store.RestoreVersion(key, versionID)
+}
+
+func (s *Store) DeleteVersion(key, versionID string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Store.DeleteVersion(key, versionID)
+}
+
+// Rotate re-wraps the data keys wrapped by other master keys than the active one, without rewriting the objects.
+// Previous versions keep their wrapping, so their master keys must be kept until they are deleted.
+func (s *Store) Rotate() (int, error) {
+	objects, err := s.Store.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	// the hidden objects, e.g. the trashed ones, are listed by their common prefix
+	hidden, err := s.Store.GetAll(".")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, object := range hidden {
+		// the prefix also matches the clients' dotfiles, e.g. .env, listed already
+		if store.IsHidden(object.GetKey()) {
+			objects = append(objects, object)
+		}
+	}
+
+	rotated := 0
+	for _, object := range objects {
+		ok, err := s.rotate(object.GetKey())
+		if err != nil {
+			return rotated, fmt.Errorf("cannot rotate %s: %s", object.GetKey(), err)
+		}
+		if ok {
+			rotated++
+		}
+	}
+	return rotated, nil
+}
+
+// rotate re-wraps the data key of the object, if wrapped by another master key than the active one
+func (s *Store) rotate(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	metadata, err := s.Store.GetMetadata(key)
+	if err != nil {
+		// the object was deleted since it was listed
+		log.Printf("skipping rotation of %s: %s\n", key, err)
+		return false, nil
+	}
+	envelope := metadata.Encryption
+	if envelope == nil || envelope.KeyID == s.Keys.ActiveKeyID {
+		return false, nil
+	}
+
+	dataKey, err := s.Keys.Unwrap(envelope.KeyID, envelope.WrappedKey)
+	if err != nil {
+		return false, err
+	}
+	wrappedKey, err := s.Keys.Wrap(s.Keys.ActiveKeyID, dataKey)
+	if err != nil {
+		return false, err
+	}
+
+	envelope.KeyID = s.Keys.ActiveKeyID
+	envelope.WrappedKey = wrappedKey
+	return true, s.Store.SetMetadata(key, metadata)
+}
+
+// StartRotation re-wraps the data keys in the background
+func (s *Store) StartRotation() {
+	go func() {
+		rotated, err := s.Rotate()
+		if err != nil {
+			log.Printf("cannot rotate data keys: %s\n", err)
+		}
+		if rotated > 0 {
+			log.Printf("Re-wrapped %d data keys with master key %s\n", rotated, s.Keys.ActiveKeyID)
+		}
+	}()
+}
@@ -0,0 +1,153 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The content is split into chunks of the same size, except the last one, each encrypted with AES-GCM under the data key.
+// The nonce of a chunk is its index, which is safe since every data key encrypts a single content. The last chunk is
+// authenticated as such, so that a truncated content fails to decrypt.
+
+// gcmOverhead is the size of the authentication tag added to every chunk
+const gcmOverhead = 16
+
+var ErrCorrupted = errors.New("encrypted content is corrupted")
+
+// nonce returns the nonce of the chunk with the given index
+func nonce(aead cipher.AEAD, index uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce
+}
+
+// additionalData marks the last chunk
+func additionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// plaintextSize returns the size of the content before encryption
+func plaintextSize(overhead, chunkSize int, size int64) int64 {
+	encryptedChunkSize := int64(chunkSize + overhead)
+	chunks := size / encryptedChunkSize
+	if size%encryptedChunkSize != 0 || size == 0 {
+		chunks++
+	}
+	if plaintext := size - chunks*int64(overhead); plaintext > 0 {
+		return plaintext
+	}
+	return 0
+}
+
+// encryptingReader encrypts the content read from the source
+type encryptingReader struct {
+	source    *bufio.Reader
+	aead      cipher.AEAD
+	chunkSize int
+
+	index   uint64
+	chunk   []byte
+	pending []byte
+	done    bool
+}
+
+func newEncryptingReader(source io.Reader, aead cipher.AEAD, chunkSize int) *encryptingReader {
+	return &encryptingReader{
+		source:    bufio.NewReader(source),
+		aead:      aead,
+		chunkSize: chunkSize,
+		chunk:     make([]byte, chunkSize),
+	}
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.encryptChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *encryptingReader) encryptChunk() error {
+	n, err := io.ReadFull(r.source, r.chunk)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		// the chunk is the last one if nothing follows it
+		if _, err = r.source.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r.pending = r.aead.Seal(r.pending[:0], nonce(r.aead, r.index), r.chunk[:n], additionalData(last))
+	r.index++
+	r.done = last
+	return nil
+}
+
+// decryptingWriter decrypts the content written to it and writes the plaintext to the destination.
+// Close must be called once the content is written, to decrypt the last chunk.
+type decryptingWriter struct {
+	destination io.Writer
+	aead        cipher.AEAD
+	chunkSize   int
+
+	index  uint64
+	buffer []byte
+}
+
+func newDecryptingWriter(destination io.Writer, aead cipher.AEAD, chunkSize int) *decryptingWriter {
+	return &decryptingWriter{
+		destination: destination,
+		aead:        aead,
+		chunkSize:   chunkSize,
+	}
+}
+
+func (w *decryptingWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+
+	// a full chunk is decrypted only once more content follows it, since the last chunk is authenticated differently
+	encryptedChunkSize := w.chunkSize + w.aead.Overhead()
+	offset := 0
+	for len(w.buffer)-offset > encryptedChunkSize {
+		if err := w.decryptChunk(w.buffer[offset:offset+encryptedChunkSize], false); err != nil {
+			return 0, err
+		}
+		offset += encryptedChunkSize
+	}
+	w.buffer = append(w.buffer[:0], w.buffer[offset:]...)
+	return len(p), nil
+}
+
+func (w *decryptingWriter) Close() error {
+	return w.decryptChunk(w.buffer, true)
+}
+
+func (w *decryptingWriter) decryptChunk(chunk []byte, last bool) error {
+	plaintext, err := w.aead.Open(nil, nonce(w.aead, w.index), chunk, additionalData(last))
+	if err != nil {
+		return ErrCorrupted
+	}
+	w.index++
+
+	_, err = w.destination.Write(plaintext)
+	return err
+}
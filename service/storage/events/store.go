@@ -0,0 +1,193 @@
+package events
+
+import (
+	"github.com/bogdanrat/web-server/contracts/models"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/queue"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"io"
+	"log"
+)
+
+// Store emits the storage events once the changes made through the wrapped store succeed. The hidden objects, e.g. the
+// trashed ones and the folder markers, are not files: trashing a file deletes it, and restoring it uploads it.
+// An event which cannot be emitted is lost, the change being already made.
+type Store struct {
+	store.Store
+	EventEmitter queue.EventEmitter
+	// sizes are known by the wrapped store if it tracks the usage, the events then carry them
+	sizes store.Sizer
+}
+
+func NewStore(storage store.Store, eventEmitter queue.EventEmitter) store.Store {
+	sizes, _ := storage.(store.Sizer)
+	return &Store{
+		Store:        storage,
+		EventEmitter: eventEmitter,
+		sizes:        sizes,
+	}
+}
+
+func (s *Store) Put(key string, body io.Reader, metadata *store.ObjectMetadata) error {
+	counter := &countingReader{reader: body}
+	if err := s.Store.Put(key, counter, metadata); err != nil {
+		return err
+	}
+	if object := s.object(key); object != nil {
+		object.Size = counter.count
+		s.emitUploaded(key, object)
+	}
+	return nil
+}
+
+func (s *Store) Delete(key string) error {
+	object := s.object(key)
+	if err := s.Store.Delete(key); err != nil {
+		return err
+	}
+	s.deleted(key, object)
+	return nil
+}
+
+func (s *Store) DeleteAll(prefix ...string) error {
+	if err := s.Store.DeleteAll(prefix...); err != nil {
+		return err
+	}
+
+	if len(prefix) == 0 {
+		s.emit(&models.PrefixDeletedEvent{})
+	}
+	for _, p := range prefix {
+		if !store.IsHidden(p) {
+			s.emit(&models.PrefixDeletedEvent{Prefix: p})
+		}
+	}
+	return nil
+}
+
+// Move reads the object once, the moved object being unchanged
+func (s *Store) Move(srcKey, dstKey string) error {
+	object := s.object(srcKey)
+	if err := s.Store.Move(srcKey, dstKey); err != nil {
+		return err
+	}
+	s.deleted(srcKey, object)
+	if object == nil {
+		// a hidden source, e.g. a trashed file being restored, is read at its destination
+		s.uploaded(dstKey)
+	} else if !store.IsHidden(dstKey) {
+		s.emitUploaded(dstKey, object)
+	}
+	return nil
+}
+
+func (s *Store) Copy(srcKey, dstKey, owner string) error {
+	if err := s.Store.Copy(srcKey, dstKey, owner); err != nil {
+		return err
+	}
+	s.uploaded(dstKey)
+	return nil
+}
+
+// SetMetadata completes the uploads made with presigned urls, which do not go through Put
+func (s *Store) SetMetadata(key string, metadata *store.ObjectMetadata) error {
+	if err := s.Store.SetMetadata(key, metadata); err != nil {
+		return err
+	}
+	s.uploaded(key)
+	return nil
+}
+
+func (s *Store) RestoreVersion(key, versionID string) error {
+	if err := s.Store.RestoreVersion(key, versionID); err != nil {
+		return err
+	}
+	s.uploaded(key)
+	return nil
+}
+
+// DeleteVersion deletes the file if the version was its only one, or uploads its previous version if it was the latest
+func (s *Store) DeleteVersion(key, versionID string) error {
+	if err := s.Store.DeleteVersion(key, versionID); err != nil {
+		return err
+	}
+	if object := s.object(key); object != nil {
+		s.emitUploaded(key, object)
+	} else {
+		s.deleted(key, nil)
+	}
+	return nil
+}
+
+// object reads the metadata of the object with a single request, nil if it does not exist or is hidden.
+// The size is the one known by the wrapped store, 0 if unknown.
+func (s *Store) object(key string) *pb.StorageObject {
+	if store.IsHidden(key) {
+		return nil
+	}
+	metadata, err := s.Store.GetMetadata(key)
+	if err != nil {
+		return nil
+	}
+	if metadata == nil {
+		metadata = &store.ObjectMetadata{}
+	}
+
+	object := &pb.StorageObject{
+		Key:         key,
+		Owner:       metadata.Owner,
+		ContentType: metadata.ContentType,
+		Sha256:      metadata.SHA256,
+	}
+	if s.sizes != nil {
+		object.Size, _ = s.sizes.Size(key)
+	}
+	return object
+}
+
+func (s *Store) uploaded(key string) {
+	if object := s.object(key); object != nil {
+		s.emitUploaded(key, object)
+	}
+}
+
+func (s *Store) emitUploaded(key string, object *pb.StorageObject) {
+	s.emit(&models.FileUploadedEvent{
+		Key:         key,
+		Size:        object.GetSize(),
+		Owner:       object.GetOwner(),
+		ContentType: object.GetContentType(),
+		SHA256:      object.GetSha256(),
+	})
+}
+
+// deleted emits the deletion of the object read before it was deleted, or of the key only if it could not be read
+func (s *Store) deleted(key string, object *pb.StorageObject) {
+	if store.IsHidden(key) {
+		return
+	}
+	s.emit(&models.FileDeletedEvent{
+		Key:    key,
+		Size:   object.GetSize(),
+		Owner:  object.GetOwner(),
+		SHA256: object.GetSha256(),
+	})
+}
+
+func (s *Store) emit(event queue.Event) {
+	if err := s.EventEmitter.Emit(event); err != nil {
+		log.Printf("could not emit event %s: %s", event.Name(), err)
+	}
+}
+
+// countingReader counts the bytes written by Put
+type countingReader struct {
+	reader io.Reader
+	count  uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += uint64(n)
+	return n, err
+}
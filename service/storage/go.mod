@@ -3,9 +3,10 @@ module github.com/bogdanrat/web-server/service/storage
 go 1.16
 
 require (
-	github.com/aws/aws-sdk-go v1.38.55
-	github.com/bogdanrat/web-server/contracts v0.0.0-20210604201704-5674adc4e1d5
+	github.com/aws/aws-sdk-go v1.38.69
+	github.com/bogdanrat/web-server/contracts v0.0.0-20210804091645-c8d0eb6be48e
 	github.com/bogdanrat/web-server/service/monitor v0.0.0-20210722123852-4e5407f87ed3
+	github.com/bogdanrat/web-server/service/queue v0.0.0-20210804092751-c4524f8c353d
 	github.com/fsnotify/fsnotify v1.4.9 // indirect
 	github.com/gin-contrib/cors v1.3.1
 	github.com/gin-gonic/gin v1.7.2
@@ -13,18 +14,24 @@ require (
 	github.com/mitchellh/mapstructure v1.4.1 // indirect
 	github.com/pelletier/go-toml v1.9.1 // indirect
 	github.com/prometheus/client_golang v1.11.0
-	github.com/rlmcpherson/s3gof3r v0.5.0
 	github.com/spf13/afero v1.6.0 // indirect
 	github.com/spf13/cast v1.3.1 // indirect
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/spf13/viper v1.7.1
+	github.com/streadway/amqp v1.0.0
 	github.com/stretchr/testify v1.6.1 // indirect
-	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a // indirect
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
 	golang.org/x/net v0.0.0-20210525063256-abc453219eb5 // indirect
-	golang.org/x/sys v0.0.0-20210603125802-9665404d3644 // indirect
+	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
 	google.golang.org/genproto v0.0.0-20210604141403-392c879c8b08
 	google.golang.org/grpc v1.38.0
 	gopkg.in/ini.v1 v1.62.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+replace (
+	github.com/bogdanrat/web-server/contracts => ../../contracts
+	github.com/bogdanrat/web-server/service/monitor => ../monitor
+	github.com/bogdanrat/web-server/service/queue => ../queue
+)
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"github.com/bogdanrat/web-server/service/storage/lib"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// Folders are the prefixes of the keys, up to a slash. They exist as long as they hold files, or a folder marker
+// if they were created empty.
+
+func (s *StorageServer) CreateFolder(ctx context.Context, req *pb.CreateFolderRequest) (*pb.CreateFolderResponse, error) {
+	prefix, err := folderPrefix("path", req.GetPath(), false)
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	// a key cannot be both a file and a folder in the disk stores
+	if _, err := s.Storage.GetMetadata(strings.TrimSuffix(prefix, "/")); err == nil {
+		return nil, logError(alreadyExistsError("path", fmt.Sprintf("file %s already exists", strings.TrimSuffix(prefix, "/"))))
+	}
+
+	err = s.Storage.Put(prefix+store.FolderMarker, bytes.NewReader(nil), &store.ObjectMetadata{Owner: req.GetOwner()})
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot create folder: %v", err))
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return &pb.CreateFolderResponse{}, nil
+}
+
+func (s *StorageServer) ListFolder(ctx context.Context, req *pb.ListFolderRequest) (*pb.ListFolderResponse, error) {
+	prefix, err := folderPrefix("path", req.GetPath(), true)
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	listing, err := s.Storage.List(prefix)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot list folder: %v", err))
+	}
+	if prefix != "" && len(listing.Objects) == 0 && len(listing.Prefixes) == 0 {
+		if _, err := s.Storage.GetMetadata(prefix + store.FolderMarker); err != nil {
+			return nil, logError(notFoundError("path", fmt.Sprintf("folder %s does not exist", req.GetPath())))
+		}
+	}
+
+	response := &pb.ListFolderResponse{
+		Folder:  s.folder(prefix),
+		Folders: make([]*pb.Folder, 0, len(listing.Prefixes)),
+		Files:   listing.Objects,
+	}
+	for _, folderPrefix := range listing.Prefixes {
+		response.Folders = append(response.Folders, s.folder(folderPrefix))
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return response, nil
+}
+
+func (s *StorageServer) RenameFolder(ctx context.Context, req *pb.RenameFolderRequest) (*pb.RenameFolderResponse, error) {
+	prefix, err := folderPrefix("path", req.GetPath(), false)
+	if err != nil {
+		return nil, logError(err)
+	}
+	newPrefix, err := folderPrefix("new_path", req.GetNewPath(), false)
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	keys, err := s.transfer(ctx, "path", prefix, "new_path", newPrefix, "", req.GetOverwrite(), true)
+	if err != nil {
+		return nil, logError(err)
+	}
+	return &pb.RenameFolderResponse{Keys: keys}, nil
+}
+
+func (s *StorageServer) DeleteFolder(ctx context.Context, req *pb.DeleteFolderRequest) (*pb.DeleteFolderResponse, error) {
+	prefix, err := folderPrefix("path", req.GetPath(), false)
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	objects, err := s.Storage.GetAll(prefix)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot get files: %v", err))
+	}
+	if len(objects) == 0 {
+		return nil, logError(notFoundError("path", fmt.Sprintf("folder %s does not exist", req.GetPath())))
+	}
+
+	markers := make([]string, 0)
+	for _, object := range objects {
+		if store.IsHidden(object.GetKey()) {
+			markers = append(markers, object.GetKey())
+		}
+	}
+	if len(markers) < len(objects) {
+		if !req.GetRecursive() {
+			return nil, logError(invalidArgumentError("recursive", fmt.Sprintf("folder %s is not empty", req.GetPath())))
+		}
+		// like deleting by prefix, deleting the files must be confirmed first
+		if err := lib.VerifyToken(config.AppConfig.Deletion.ConfirmationSecret, prefix, req.GetConfirmationToken()); err != nil {
+			return nil, logError(invalidArgumentError("confirmation_token", err.Error()))
+		}
+	}
+
+	if s.Trash != nil {
+		// the folder markers are deleted rather than trashed, restoring a file restores its folders
+		if err = s.Trash.TrashAll(prefix); err == nil {
+			for _, marker := range markers {
+				if err = s.Storage.Delete(marker); err != nil {
+					break
+				}
+			}
+		}
+	} else {
+		err = s.Storage.DeleteAll(prefix)
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot delete folder: %v", err))
+	}
+	s.deleteVariants(prefix)
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return &pb.DeleteFolderResponse{}, nil
+}
+
+// folder returns the folder with its recursive size, as tracked by the usage tracker
+func (s *StorageServer) folder(prefix string) *pb.Folder {
+	usage := s.Usage.Aggregate(prefix)
+	return &pb.Folder{
+		Path:    strings.TrimSuffix(prefix, "/"),
+		Size:    usage.Bytes,
+		Objects: usage.Objects,
+	}
+}
+
+// folderPrefix validates the path of a folder and returns its prefix, ending with a slash.
+// The root folder, with an empty path and an empty prefix, is allowed if requested.
+func folderPrefix(field, path string, allowRoot bool) (string, error) {
+	if strings.Trim(path, "/") == "" {
+		if allowRoot {
+			return "", nil
+		}
+		return "", invalidArgumentError(field, "the root folder cannot be changed")
+	}
+
+	normalized, err := normalizeKey(field, path)
+	if err != nil {
+		return "", err
+	}
+	return normalized + "/", nil
+}
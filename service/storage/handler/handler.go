@@ -4,26 +4,50 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/compression"
 	"github.com/bogdanrat/web-server/service/storage/config"
+	"github.com/bogdanrat/web-server/service/storage/imaging"
 	"github.com/bogdanrat/web-server/service/storage/lib"
 	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"github.com/bogdanrat/web-server/service/storage/trash"
+	"github.com/bogdanrat/web-server/service/storage/usage"
+	"github.com/bogdanrat/web-server/service/storage/validation"
 	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"io"
 	"log"
+	"net/http"
 	"strings"
+	"time"
 )
 
 type StorageServer struct {
 	Storage store.Store
+	// Trash is nil if deleted files are not kept
+	Trash     *trash.Bin
+	Presigner store.Presigner
+	Usage     *usage.Tracker
+	// Images is nil if image processing is disabled
+	Images    *imaging.Processor
+	Validator *validation.Validator
+	// Compression is nil if the objects are not compressed
+	Compression *compression.Store
 }
 
-func New(storage store.Store) *StorageServer {
+func New(storage store.Store, trashBin *trash.Bin, presigner store.Presigner, usageTracker *usage.Tracker, images *imaging.Processor, validator *validation.Validator, compressedStore *compression.Store) *StorageServer {
 	return &StorageServer{
-		Storage: storage,
+		Storage:     storage,
+		Trash:       trashBin,
+		Presigner:   presigner,
+		Usage:       usageTracker,
+		Images:      images,
+		Validator:   validator,
+		Compression: compressedStore,
 	}
 }
 
@@ -35,21 +59,27 @@ func (s *StorageServer) UploadFile(stream pb.Storage_UploadFileServer) error {
 
 	fileSize := req.GetInfo().GetSize()
 	if fileSize > config.AppConfig.Upload.MaxFileSize {
-		errorStatus := status.New(codes.ResourceExhausted, "invalid file size")
-		details, err := errorStatus.WithDetails(&epb.BadRequest_FieldViolation{
-			Field:       "size",
-			Description: fmt.Sprintf("file size %s exceeds maximum size %s", lib.FormatSize(int(fileSize), 2), lib.FormatSize(int(config.AppConfig.Upload.MaxFileSize), 2)),
-		})
-		if err != nil {
-			return logError(errorStatus.Err())
-		}
-		return logError(details.Err())
+		return logError(fileSizeError(uint64(fileSize)))
 	}
 
-	fileName := req.GetInfo().GetFileName()
+	fileName, err := normalizeKey("file_name", req.GetInfo().GetFileName())
+	if err != nil {
+		return logError(err)
+	}
+	if err = s.Validator.CheckName(fileName); err != nil {
+		return logError(validationError(err))
+	}
+	owner := req.GetInfo().GetOwner()
+	// fail fast on the declared size, the actual size is checked once received
+	if err = s.Usage.Check(fileName, owner, uint64(fileSize)); err != nil {
+		return logError(quotaExceededError(err))
+	}
 	log.Printf("Request to upload %s\n", fileName)
 
 	fileData := bytes.Buffer{}
+	// the checksum is computed while the chunks are received
+	checksum := sha256.New()
+	writer := io.MultiWriter(&fileData, checksum)
 
 	for {
 		if err := contextError(stream.Context()); err != nil {
@@ -66,15 +96,36 @@ func (s *StorageServer) UploadFile(stream pb.Storage_UploadFileServer) error {
 		}
 
 		chunk := req.GetChunkData()
-		_, err = fileData.Write(chunk)
+		_, err = writer.Write(chunk)
 
 		if err != nil {
 			return logError(status.Errorf(codes.Internal, "cannot write chunk data: %v", err))
 		}
 	}
 
+	// the size is reserved until stored, so that concurrent uploads cannot exceed the quotas together
+	release, err := s.Usage.Reserve(fileName, owner, uint64(fileData.Len()))
+	if err != nil {
+		return logError(quotaExceededError(err))
+	}
+	defer release()
+
+	// the content is validated before it is committed to the store
+	contentType, err := s.Validator.Validate(fileName, req.GetInfo().GetContentType(), fileData.Bytes(), bytes.NewReader(fileData.Bytes()))
+	if err != nil {
+		return logError(validationError(err))
+	}
+
+	// the validated type is stored, never the declared one, which the client controls
+	metadata := &store.ObjectMetadata{
+		ContentType: contentType,
+		SHA256:      hex.EncodeToString(checksum.Sum(nil)),
+		Custom:      normalizeMetadata(req.GetInfo().GetMetadata()),
+		Owner:       owner,
+	}
+
 	reader := bytes.NewReader(fileData.Bytes())
-	err = s.Storage.Put(fileName, reader)
+	err = s.Storage.Put(fileName, reader, metadata)
 
 	if err != nil {
 		return logError(status.Errorf(codes.Internal, "cannot upload file: %v", err))
@@ -89,28 +140,81 @@ func (s *StorageServer) UploadFile(stream pb.Storage_UploadFileServer) error {
 	}
 
 	log.Printf("Uploaded %s, size: %d", fileName, fileSize)
+	s.generateThumbnails(fileName, metadata.ContentType)
 	return nil
 }
 
 func (s *StorageServer) GetFile(req *pb.GetFileRequest, stream pb.Storage_GetFileServer) error {
+	fileName, err := normalizeKey("file_name", req.GetFileName())
+	if err != nil {
+		return logError(err)
+	}
+
 	writer := &bytes.Buffer{}
-	if err := s.Storage.Get(req.GetFileName(), writer); err != nil {
+
+	if req.GetWidth() > 0 || req.GetHeight() > 0 {
+		return s.getVariant(fileName, req, stream)
+	}
+
+	// compressed files are sent as stored to the clients accepting their encoding
+	encoding := ""
+	if req.GetVersionId() != "" {
+		err = s.Storage.GetVersion(fileName, req.GetVersionId(), writer)
+	} else if s.Compression != nil && req.GetAcceptEncoding() != "" {
+		encoding, err = s.Compression.GetEncoded(fileName, req.GetAcceptEncoding(), writer)
+	} else {
+		err = s.Storage.Get(fileName, writer)
+	}
+
+	if err != nil {
+		if err == store.ErrVersionNotFound {
+			return logError(versionNotFoundError(fileName, req.GetVersionId()))
+		}
 		if strings.Contains(err.Error(), "404") {
-			errorStatus := status.New(codes.NotFound, "object does not exist")
-			details, err := errorStatus.WithDetails(&epb.BadRequest_FieldViolation{
-				Field:       "file_name",
-				Description: fmt.Sprintf("file %s does not exist", req.GetFileName()),
-			})
-			if err != nil {
-				return logError(errorStatus.Err())
-			}
-			return logError(details.Err())
+			return logError(fileNotFoundError(fileName))
 		}
 
 		return logError(status.Errorf(codes.Internal, "cannot get file: %v", err))
 	}
 
-	reader := bufio.NewReader(writer)
+	return sendFile(writer, encoding, stream)
+}
+
+// getVariant sends a resized variant of the image
+func (s *StorageServer) getVariant(fileName string, req *pb.GetFileRequest, stream pb.Storage_GetFileServer) error {
+	if s.Images == nil {
+		return logError(status.Errorf(codes.FailedPrecondition, "image processing is disabled"))
+	}
+	if req.GetVersionId() != "" {
+		return logError(invalidArgumentError("version_id", "previous versions cannot be resized"))
+	}
+
+	writer := &bytes.Buffer{}
+	_, err := s.Images.GetVariant(fileName, imaging.Options{
+		Width:  int(req.GetWidth()),
+		Height: int(req.GetHeight()),
+		Fit:    imaging.Fit(req.GetFit()),
+	}, writer)
+
+	if err != nil {
+		if optionsErr, ok := err.(*imaging.OptionsError); ok {
+			return logError(invalidArgumentError(optionsErr.Field, optionsErr.Description))
+		}
+		switch err {
+		case imaging.ErrNotFound:
+			return logError(fileNotFoundError(fileName))
+		case imaging.ErrUnsupportedImage, imaging.ErrImageTooLarge:
+			return logError(invalidArgumentError("file_name", fmt.Sprintf("cannot resize %s: %s", fileName, err)))
+		}
+		return logError(status.Errorf(codes.Internal, "cannot resize image: %v", err))
+	}
+
+	return sendFile(writer, "", stream)
+}
+
+// sendFile streams the file to the client, the first chunk holding its content encoding
+func sendFile(file *bytes.Buffer, contentEncoding string, stream pb.Storage_GetFileServer) error {
+	reader := bufio.NewReader(file)
 	// send file in chunks of 1 KB
 	buffer := make([]byte, 1024)
 
@@ -128,8 +232,10 @@ func (s *StorageServer) GetFile(req *pb.GetFileRequest, stream pb.Storage_GetFil
 		}
 
 		response := &pb.GetFileResponse{
-			ChunkData: buffer[:n],
+			ChunkData:       buffer[:n],
+			ContentEncoding: contentEncoding,
 		}
+		contentEncoding = ""
 		if err = stream.Send(response); err != nil {
 			return logError(status.Errorf(codes.Internal, "error sending file chunk: %v", err))
 		}
@@ -138,13 +244,186 @@ func (s *StorageServer) GetFile(req *pb.GetFileRequest, stream pb.Storage_GetFil
 	return nil
 }
 
+func (s *StorageServer) GetPresignedURL(ctx context.Context, req *pb.PresignedURLRequest) (*pb.PresignedURLResponse, error) {
+	key, err := normalizeKey("key", req.GetKey())
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	expiration := time.Second * time.Duration(config.AppConfig.Presign.Expiration)
+
+	var presignedURL string
+	switch strings.ToUpper(req.GetMethod()) {
+	case http.MethodPut:
+		if req.GetSize() > config.AppConfig.Upload.MaxFileSize {
+			return nil, logError(fileSizeError(uint64(req.GetSize())))
+		}
+		if err = s.Usage.Check(key, req.GetOwner(), uint64(req.GetSize())); err != nil {
+			return nil, logError(quotaExceededError(err))
+		}
+		// the upload lands in the quarantine, out of the clients' reach until CompleteUpload validates it
+		presignedURL, err = s.Presigner.PresignPut(store.QuarantineKey(key), req.GetContentType(), expiration)
+	case http.MethodGet:
+		presignedURL, err = s.Presigner.PresignGet(key, expiration)
+	default:
+		return nil, logError(invalidArgumentError("method", fmt.Sprintf("cannot presign %s requests", req.GetMethod())))
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot presign url: %v", err))
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return &pb.PresignedURLResponse{
+		Url:       presignedURL,
+		Method:    strings.ToUpper(req.GetMethod()),
+		ExpiresAt: time.Now().Add(expiration).Format(time.RFC3339),
+	}, nil
+}
+
+// CompleteUpload validates a file uploaded with a presigned url, computes its checksum and records its metadata,
+// as UploadFile does for the files uploaded through the service, then moves it from the quarantine to its key
+func (s *StorageServer) CompleteUpload(ctx context.Context, req *pb.CompleteUploadRequest) (*pb.CompleteUploadResponse, error) {
+	key, err := normalizeKey("key", req.GetKey())
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	// the upload is already stored, it is deleted if rejected
+	quarantineKey := store.QuarantineKey(key)
+	reject := func(err error, reason string) (*pb.CompleteUploadResponse, error) {
+		if deleteErr := s.Storage.Delete(quarantineKey); deleteErr != nil {
+			log.Printf("cannot delete %s upload %s: %s\n", reason, key, deleteErr)
+		}
+		return nil, logError(err)
+	}
+
+	// the upload is read once: it is checksummed and counted while validated, and a byte past the size limit
+	// is enough to reject it
+	checksum := sha256.New()
+	counter := &byteCounter{}
+	content := s.objectReader(quarantineKey)
+	defer content.Close()
+	upload := io.TeeReader(io.LimitReader(content, int64(config.AppConfig.Upload.MaxFileSize)+1), io.MultiWriter(checksum, counter))
+
+	// the leading bytes are enough to detect the content type
+	head := make([]byte, validation.SniffLength)
+	n, err := io.ReadFull(upload, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, logError(status.Errorf(codes.NotFound, "cannot get uploaded file: %v", err))
+	}
+	head = head[:n]
+
+	contentType, err := s.Validator.Validate(key, req.GetContentType(), head, io.MultiReader(bytes.NewReader(head), upload))
+	if err != nil {
+		return reject(validationError(err), "rejected")
+	}
+	// the scanner, if any, may stop before the end of the upload
+	if _, err = io.Copy(io.Discard, upload); err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot read uploaded file: %v", err))
+	}
+
+	if counter.count > uint64(config.AppConfig.Upload.MaxFileSize) {
+		return reject(fileSizeError(counter.count), "oversized")
+	}
+	release, err := s.Usage.Reserve(key, req.GetOwner(), counter.count)
+	if err != nil {
+		return reject(quotaExceededError(err), "over quota")
+	}
+	defer release()
+
+	// the validated type is stored, never the declared one, which the client controls
+	metadata := &store.ObjectMetadata{
+		ContentType: contentType,
+		SHA256:      hex.EncodeToString(checksum.Sum(nil)),
+		Custom:      normalizeMetadata(req.GetMetadata()),
+		Owner:       req.GetOwner(),
+	}
+
+	// the metadata is set first, so that the file is complete once it appears under its key
+	if err := s.Storage.SetMetadata(quarantineKey, metadata); err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot set metadata: %v", err))
+	}
+	if err := s.Storage.Move(quarantineKey, key); err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot move upload out of quarantine: %v", err))
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	log.Printf("Completed upload of %s, size: %d", key, counter.count)
+	s.generateThumbnails(key, metadata.ContentType)
+	return &pb.CompleteUploadResponse{
+		Object: &pb.StorageObject{
+			Key:          key,
+			LastModified: time.Now().Format(time.RFC3339),
+			Size:         counter.count,
+			ContentType:  metadata.ContentType,
+			Sha256:       metadata.SHA256,
+			Metadata:     metadata.Custom,
+			Owner:        metadata.Owner,
+		},
+	}, nil
+}
+
+func (s *StorageServer) GetUsage(ctx context.Context, req *pb.GetUsageRequest) (*pb.GetUsageResponse, error) {
+	ownerUsage := s.Usage.Owner(req.GetOwner())
+	response := &pb.GetUsageResponse{
+		Owner: &pb.Usage{
+			Bytes:      ownerUsage.Bytes,
+			Objects:    ownerUsage.Objects,
+			MaxBytes:   config.AppConfig.Quota.MaxBytesPerOwner,
+			MaxObjects: config.AppConfig.Quota.MaxObjectsPerOwner,
+		},
+	}
+
+	prefixes := s.Usage.Prefixes()
+	for _, prefix := range usage.SortedPrefixes(prefixes) {
+		prefixUsage := &pb.Usage{
+			Bytes:   prefixes[prefix].Bytes,
+			Objects: prefixes[prefix].Objects,
+		}
+		if quota, ok := s.Usage.PrefixQuota(prefix); ok {
+			prefixUsage.MaxBytes = quota.MaxBytes
+			prefixUsage.MaxObjects = quota.MaxObjects
+		}
+		response.Prefixes = append(response.Prefixes, &pb.PrefixUsage{
+			Prefix: prefix,
+			Usage:  prefixUsage,
+		})
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return response, nil
+}
+
 func (s *StorageServer) GetFiles(req *pb.GetFilesRequest, stream pb.Storage_GetFilesServer) error {
-	objects, err := s.Storage.GetAll()
+	prefix, err := normalizePrefix("prefix", req.GetPrefix())
+	if err != nil {
+		return logError(err)
+	}
+
+	var objects []*pb.StorageObject
+	if prefix != "" {
+		objects, err = s.Storage.GetAll(prefix)
+	} else {
+		objects, err = s.Storage.GetAll()
+	}
 	if err != nil {
 		return logError(status.Errorf(codes.Internal, "cannot get files: %v", err))
 	}
 
 	for _, object := range objects {
+		// listing a prefix also returns its folder markers
+		if store.IsHidden(object.GetKey()) {
+			continue
+		}
 		if err = contextError(stream.Context()); err != nil {
 			return logError(err)
 		}
@@ -161,9 +440,20 @@ func (s *StorageServer) GetFiles(req *pb.GetFilesRequest, stream pb.Storage_GetF
 }
 
 func (s *StorageServer) DeleteFile(ctx context.Context, req *pb.DeleteFileRequest) (*pb.DeleteFileResponse, error) {
-	if err := s.Storage.Delete(req.Key); err != nil {
+	key, err := normalizeKey("key", req.GetKey())
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	if s.Trash != nil {
+		err = s.Trash.Trash(key)
+	} else {
+		err = s.Storage.Delete(key)
+	}
+	if err != nil {
 		return nil, logError(status.Errorf(codes.Internal, "cannot delete: %v", err))
 	}
+	s.deleteVariants(key + "/")
 
 	if err := contextError(ctx); err != nil {
 		return nil, logError(err)
@@ -172,10 +462,45 @@ func (s *StorageServer) DeleteFile(ctx context.Context, req *pb.DeleteFileReques
 	return &pb.DeleteFileResponse{}, nil
 }
 
+func (s *StorageServer) ConfirmDeleteFiles(ctx context.Context, req *pb.ConfirmDeleteFilesRequest) (*pb.ConfirmDeleteFilesResponse, error) {
+	prefix, err := normalizePrefix("prefix", req.GetPrefix())
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	expiresAt := time.Now().Add(time.Second * time.Duration(config.AppConfig.Deletion.ConfirmationTTL))
+	token := lib.SignToken(config.AppConfig.Deletion.ConfirmationSecret, prefix, expiresAt)
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return &pb.ConfirmDeleteFilesResponse{
+		ConfirmationToken: token,
+		ExpiresAt:         expiresAt.Format(time.RFC3339),
+	}, nil
+}
+
 func (s *StorageServer) DeleteFiles(ctx context.Context, req *pb.DeleteFilesRequest) (*pb.DeleteFilesResponse, error) {
-	if err := s.Storage.DeleteAll(req.GetPrefix()); err != nil {
+	prefix, err := normalizePrefix("prefix", req.GetPrefix())
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	// deleting by prefix may wipe the entire store, so it must be confirmed first
+	if err := lib.VerifyToken(config.AppConfig.Deletion.ConfirmationSecret, prefix, req.GetConfirmationToken()); err != nil {
+		return nil, logError(invalidArgumentError("confirmation_token", err.Error()))
+	}
+
+	if s.Trash != nil {
+		err = s.Trash.TrashAll(prefix)
+	} else {
+		err = s.Storage.DeleteAll(prefix)
+	}
+	if err != nil {
 		return nil, logError(status.Errorf(codes.Internal, "cannot delete: %v", err))
 	}
+	s.deleteVariants(prefix)
 
 	if err := contextError(ctx); err != nil {
 		return nil, logError(err)
@@ -184,6 +509,274 @@ func (s *StorageServer) DeleteFiles(ctx context.Context, req *pb.DeleteFilesRequ
 	return &pb.DeleteFilesResponse{}, nil
 }
 
+func (s *StorageServer) ListVersions(ctx context.Context, req *pb.ListVersionsRequest) (*pb.ListVersionsResponse, error) {
+	key, err := normalizeKey("key", req.GetKey())
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	versions, err := s.Storage.ListVersions(key)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot list versions: %v", err))
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return &pb.ListVersionsResponse{
+		Versions: versions,
+	}, nil
+}
+
+func (s *StorageServer) RestoreVersion(ctx context.Context, req *pb.RestoreVersionRequest) (*pb.RestoreVersionResponse, error) {
+	key, err := normalizeKey("key", req.GetKey())
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	if err := s.Storage.RestoreVersion(key, req.GetVersionId()); err != nil {
+		if err == store.ErrVersionNotFound {
+			return nil, logError(versionNotFoundError(key, req.GetVersionId()))
+		}
+		return nil, logError(status.Errorf(codes.Internal, "cannot restore version: %v", err))
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	log.Printf("Restored version %s of %s\n", req.GetVersionId(), key)
+	return &pb.RestoreVersionResponse{}, nil
+}
+
+func (s *StorageServer) DeleteVersion(ctx context.Context, req *pb.DeleteVersionRequest) (*pb.DeleteVersionResponse, error) {
+	key, err := normalizeKey("key", req.GetKey())
+	if err != nil {
+		return nil, logError(err)
+	}
+
+	if err := s.Storage.DeleteVersion(key, req.GetVersionId()); err != nil {
+		if err == store.ErrVersionNotFound {
+			return nil, logError(versionNotFoundError(key, req.GetVersionId()))
+		}
+		return nil, logError(status.Errorf(codes.Internal, "cannot delete version: %v", err))
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return &pb.DeleteVersionResponse{}, nil
+}
+
+func (s *StorageServer) GetTrash(ctx context.Context, req *pb.GetTrashRequest) (*pb.GetTrashResponse, error) {
+	if s.Trash == nil {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "trash is disabled"))
+	}
+
+	objects, err := s.Trash.List()
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot get trash: %v", err))
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return &pb.GetTrashResponse{
+		Objects: objects,
+	}, nil
+}
+
+func (s *StorageServer) RestoreTrashed(ctx context.Context, req *pb.RestoreTrashedRequest) (*pb.RestoreTrashedResponse, error) {
+	if s.Trash == nil {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "trash is disabled"))
+	}
+
+	if err := s.Trash.Restore(req.GetTrashId(), req.GetOverwrite()); err != nil {
+		if err == trash.ErrInvalidTrashID {
+			return nil, logError(invalidArgumentError("trash_id", err.Error()))
+		}
+		if err == trash.ErrKeyExists {
+			return nil, logError(alreadyExistsError("trash_id", err.Error()))
+		}
+		return nil, logError(status.Errorf(codes.Internal, "cannot restore: %v", err))
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return &pb.RestoreTrashedResponse{}, nil
+}
+
+func (s *StorageServer) PurgeTrash(ctx context.Context, req *pb.PurgeTrashRequest) (*pb.PurgeTrashResponse, error) {
+	if s.Trash == nil {
+		return nil, logError(status.Errorf(codes.FailedPrecondition, "trash is disabled"))
+	}
+
+	// emptying the trash must be asked for explicitly, so that a missing trash id never purges everything
+	var err error
+	switch {
+	case req.GetAll() && req.GetTrashId() != "":
+		return nil, logError(invalidArgumentError("trash_id", "trash_id cannot be given along with all"))
+	case req.GetAll():
+		err = s.Trash.PurgeAll()
+	case req.GetTrashId() == "":
+		return nil, logError(invalidArgumentError("trash_id", "trash_id is required unless all is set"))
+	default:
+		err = s.Trash.Purge(req.GetTrashId())
+	}
+	if err != nil {
+		if err == trash.ErrInvalidTrashID {
+			return nil, logError(invalidArgumentError("trash_id", err.Error()))
+		}
+		return nil, logError(status.Errorf(codes.Internal, "cannot purge: %v", err))
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, logError(err)
+	}
+
+	return &pb.PurgeTrashResponse{}, nil
+}
+
+// objectReader streams the object from the store; the reader must be closed to release the stream
+func (s *StorageServer) objectReader(key string) *io.PipeReader {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(s.Storage.Get(key, writer))
+	}()
+	return reader
+}
+
+// generateThumbnails schedules the generation of the thumbnails of an uploaded image
+func (s *StorageServer) generateThumbnails(key, contentType string) {
+	if s.Images != nil {
+		s.Images.Enqueue(key, contentType)
+	}
+}
+
+// deleteVariants deletes the resized variants of the deleted images; they are regenerated if the images are restored
+func (s *StorageServer) deleteVariants(prefix string) {
+	if s.Images == nil {
+		return
+	}
+	if err := s.Images.DeleteVariants(prefix); err != nil {
+		log.Printf("cannot delete variants of %s: %s\n", prefix, err)
+	}
+}
+
+// normalizeKey validates the key received from the client, hidden keys such as the trashed files' are rejected
+func normalizeKey(field, key string) (string, error) {
+	normalized, err := store.NormalizeKey(key)
+	if err != nil {
+		return "", invalidArgumentError(field, fmt.Sprintf("invalid key %q", key))
+	}
+	return normalized, nil
+}
+
+func normalizePrefix(field, prefix string) (string, error) {
+	normalized, err := store.NormalizePrefix(prefix)
+	if err != nil {
+		return "", invalidArgumentError(field, fmt.Sprintf("invalid prefix %q", prefix))
+	}
+	return normalized, nil
+}
+
+func quotaExceededError(quotaErr error) error {
+	violation, ok := quotaErr.(*usage.QuotaError)
+	if !ok {
+		return status.Errorf(codes.Internal, "cannot check quota: %v", quotaErr)
+	}
+
+	errorStatus := status.New(codes.ResourceExhausted, "quota exceeded")
+	details, err := errorStatus.WithDetails(&epb.QuotaFailure{
+		Violations: []*epb.QuotaFailure_Violation{
+			{
+				Subject:     violation.Subject,
+				Description: violation.Description,
+			},
+		},
+	})
+	if err != nil {
+		return errorStatus.Err()
+	}
+	return details.Err()
+}
+
+func validationError(validationErr error) error {
+	switch err := validationErr.(type) {
+	case *validation.Error:
+		return invalidArgumentError(err.Field, err.Description)
+	case *validation.ThreatError:
+		return invalidArgumentError("content", fmt.Sprintf("file rejected, %s", err))
+	}
+	return status.Errorf(codes.Unavailable, "cannot validate file: %v", validationErr)
+}
+
+func fileSizeError(fileSize uint64) error {
+	errorStatus := status.New(codes.ResourceExhausted, "invalid file size")
+	details, err := errorStatus.WithDetails(&epb.BadRequest_FieldViolation{
+		Field:       "size",
+		Description: fmt.Sprintf("file size %s exceeds maximum size %s", lib.FormatSize(int(fileSize), 2), lib.FormatSize(int(config.AppConfig.Upload.MaxFileSize), 2)),
+	})
+	if err != nil {
+		return errorStatus.Err()
+	}
+	return details.Err()
+}
+
+func invalidArgumentError(field, description string) error {
+	errorStatus := status.New(codes.InvalidArgument, description)
+	details, err := errorStatus.WithDetails(&epb.BadRequest_FieldViolation{
+		Field:       field,
+		Description: description,
+	})
+	if err != nil {
+		return errorStatus.Err()
+	}
+	return details.Err()
+}
+
+func fileNotFoundError(fileName string) error {
+	errorStatus := status.New(codes.NotFound, "object does not exist")
+	details, err := errorStatus.WithDetails(&epb.BadRequest_FieldViolation{
+		Field:       "file_name",
+		Description: fmt.Sprintf("file %s does not exist", fileName),
+	})
+	if err != nil {
+		return errorStatus.Err()
+	}
+	return details.Err()
+}
+
+func versionNotFoundError(key, versionID string) error {
+	errorStatus := status.New(codes.NotFound, "version does not exist")
+	details, err := errorStatus.WithDetails(&epb.BadRequest_FieldViolation{
+		Field:       "version_id",
+		Description: fmt.Sprintf("version %s of file %s does not exist", versionID, key),
+	})
+	if err != nil {
+		return errorStatus.Err()
+	}
+	return details.Err()
+}
+
+// normalizeMetadata lower cases the metadata keys, since not all storage engines preserve their case
+func normalizeMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	normalized := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		normalized[strings.ToLower(key)] = value
+	}
+	return normalized
+}
+
 func contextError(ctx context.Context) error {
 	switch ctx.Err() {
 	case context.Canceled:
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	epb "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strings"
+)
+
+func (s *StorageServer) CopyFile(ctx context.Context, req *pb.CopyFileRequest) (*pb.CopyFileResponse, error) {
+	keys, err := s.transfer(ctx, "src_key", req.GetSrcKey(), "dst_key", req.GetDstKey(), req.GetOwner(), req.GetOverwrite(), false)
+	if err != nil {
+		return nil, logError(err)
+	}
+	return &pb.CopyFileResponse{Keys: keys}, nil
+}
+
+func (s *StorageServer) MoveFile(ctx context.Context, req *pb.MoveFileRequest) (*pb.MoveFileResponse, error) {
+	keys, err := s.transfer(ctx, "src_key", req.GetSrcKey(), "dst_key", req.GetDstKey(), "", req.GetOverwrite(), true)
+	if err != nil {
+		return nil, logError(err)
+	}
+	return &pb.MoveFileResponse{Keys: keys}, nil
+}
+
+// transfer copies or moves the files to the destination, returning their new keys. The fields name the keys in errors.
+// The copies are owned by the owner, unless empty, while the moved files keep their owners.
+// Prefix-wide transfers are not atomic: a failure leaves the files transferred so far at the destination.
+func (s *StorageServer) transfer(ctx context.Context, srcField, srcKey, dstField, dstKey, owner string, overwrite, move bool) ([]string, error) {
+	sources, keys, err := s.transferKeys(srcField, srcKey, dstField, dstKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if !overwrite {
+		for _, source := range sources {
+			// the folder markers are replaced by the markers of the same folders
+			if store.IsHidden(source.GetKey()) {
+				continue
+			}
+			if _, err := s.Storage.GetMetadata(keys[source.GetKey()]); err == nil {
+				return nil, alreadyExistsError(dstField, fmt.Sprintf("file %s already exists", keys[source.GetKey()]))
+			}
+		}
+	}
+	if err = s.Usage.CheckTransfer(keys, owner, move); err != nil {
+		return nil, quotaExceededError(err)
+	}
+
+	operation := "copy"
+	if move {
+		operation = "move"
+	}
+
+	transferred := make([]string, 0, len(sources))
+	for _, source := range sources {
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+
+		key := keys[source.GetKey()]
+		if move {
+			err = s.Storage.Move(source.GetKey(), key)
+		} else {
+			err = s.Storage.Copy(source.GetKey(), key, owner)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot %s %s after %d of %d files: %v", operation, source.GetKey(), len(transferred), len(sources), err)
+		}
+		if store.IsHidden(key) {
+			continue
+		}
+		transferred = append(transferred, key)
+
+		if move {
+			s.deleteVariants(source.GetKey() + "/")
+		}
+		s.generateThumbnails(key, source.GetContentType())
+	}
+
+	return transferred, nil
+}
+
+// transferKeys returns the files to transfer, sorted by key, and maps their keys to their keys at the destination.
+// A source key ending with a slash is a prefix, whose files are transferred under the destination prefix.
+func (s *StorageServer) transferKeys(srcField, srcKey, dstField, dstKey string) ([]*pb.StorageObject, map[string]string, error) {
+	isPrefix := strings.HasSuffix(srcKey, "/")
+
+	var err error
+	if isPrefix {
+		if srcKey, err = normalizePrefix(srcField, srcKey); err != nil {
+			return nil, nil, err
+		}
+		if !strings.HasSuffix(dstKey, "/") {
+			return nil, nil, invalidArgumentError(dstField, "the destination of a prefix must be a prefix ending with a slash")
+		}
+		if dstKey, err = normalizePrefix(dstField, dstKey); err != nil {
+			return nil, nil, err
+		}
+		if strings.HasPrefix(dstKey, srcKey) {
+			return nil, nil, invalidArgumentError(dstField, fmt.Sprintf("%s cannot be transferred into itself", srcKey))
+		}
+	} else {
+		if srcKey, err = normalizeKey(srcField, srcKey); err != nil {
+			return nil, nil, err
+		}
+		if dstKey, err = normalizeKey(dstField, dstKey); err != nil {
+			return nil, nil, err
+		}
+		if srcKey == dstKey {
+			return nil, nil, invalidArgumentError(dstField, "the destination must differ from the source")
+		}
+	}
+
+	objects, err := s.Storage.GetAll(srcKey)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "cannot get files: %v", err)
+	}
+
+	sources := make([]*pb.StorageObject, 0, len(objects))
+	keys := make(map[string]string, len(objects))
+	for _, object := range objects {
+		if isPrefix {
+			keys[object.GetKey()] = dstKey + strings.TrimPrefix(object.GetKey(), srcKey)
+		} else if object.GetKey() == srcKey {
+			keys[object.GetKey()] = dstKey
+		} else {
+			// the listing also returns the files whose keys start with the source key
+			continue
+		}
+		sources = append(sources, object)
+	}
+	if len(sources) == 0 {
+		return nil, nil, notFoundError(srcField, fmt.Sprintf("file %s does not exist", srcKey))
+	}
+	// a file transferred onto another file being transferred would be lost, e.g. moving a/b/ to a/ with a/b/b/x and a/b/x
+	for _, key := range keys {
+		if _, ok := keys[key]; ok {
+			return nil, nil, invalidArgumentError(dstField, fmt.Sprintf("%s would be replaced by another transferred file", key))
+		}
+	}
+
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].GetKey() < sources[j].GetKey()
+	})
+	return sources, keys, nil
+}
+
+func alreadyExistsError(field, description string) error {
+	errorStatus := status.New(codes.AlreadyExists, description)
+	details, err := errorStatus.WithDetails(&epb.BadRequest_FieldViolation{
+		Field:       field,
+		Description: description,
+	})
+	if err != nil {
+		return errorStatus.Err()
+	}
+	return details.Err()
+}
+
+func notFoundError(field, description string) error {
+	errorStatus := status.New(codes.NotFound, description)
+	details, err := errorStatus.WithDetails(&epb.BadRequest_FieldViolation{
+		Field:       field,
+		Description: description,
+	})
+	if err != nil {
+		return errorStatus.Err()
+	}
+	return details.Err()
+}
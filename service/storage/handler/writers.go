@@ -0,0 +1,11 @@
+package handler
+
+// byteCounter counts the bytes written to it
+type byteCounter struct {
+	count uint64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.count += uint64(len(p))
+	return len(p), nil
+}
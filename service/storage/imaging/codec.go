@@ -0,0 +1,71 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+const jpegQuality = 85
+
+var (
+	ErrUnsupportedImage = errors.New("unsupported image format")
+	ErrImageTooLarge    = errors.New("image is too large")
+)
+
+// contentTypes maps the content types of the supported images to their formats, as registered with the image package
+var contentTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// IsSupported checks whether images of the content type can be resized
+func IsSupported(contentType string) bool {
+	_, ok := contentTypes[contentType]
+	return ok
+}
+
+// ContentType returns the content type of the format
+func ContentType(format string) string {
+	return "image/" + format
+}
+
+// Decode decodes a supported image, rejecting the ones with more than maxPixels pixels before they are decoded.
+// Only the first frame of animated GIFs is decoded.
+func Decode(data []byte, maxPixels int) (image.Image, string, error) {
+	imageConfig, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrUnsupportedImage
+	}
+	if !IsSupported(ContentType(format)) {
+		return nil, "", ErrUnsupportedImage
+	}
+	if maxPixels > 0 && imageConfig.Width*imageConfig.Height > maxPixels {
+		return nil, "", ErrImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot decode %s image: %s", format, err)
+	}
+	return img, format, nil
+}
+
+// Encode encodes the image in the format it was decoded from
+func Encode(writer io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(writer, img, &jpeg.Options{Quality: jpegQuality})
+	case "png":
+		return png.Encode(writer, img)
+	case "gif":
+		return gif.Encode(writer, img, nil)
+	}
+	return ErrUnsupportedImage
+}
@@ -0,0 +1,252 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"image"
+	"io"
+	"log"
+)
+
+const (
+	// VariantsPrefix is the namespace of the resized images, stored as <prefix><key>/<width>x<height>-<fit>
+	VariantsPrefix = ".variants/"
+	// sourceMetadataKey records the version of the image a variant was generated from
+	sourceMetadataKey = "source"
+)
+
+var ErrNotFound = errors.New("image not found")
+
+// OptionsError describes the invalid option of a variant
+type OptionsError struct {
+	Field       string
+	Description string
+}
+
+func (e *OptionsError) Error() string {
+	return e.Description
+}
+
+// Options describes a resized variant of an image
+type Options struct {
+	Width  int
+	Height int
+	Fit    Fit
+}
+
+// VariantKey returns the key of the variant of the image
+func VariantKey(key string, options Options) string {
+	return fmt.Sprintf("%s%s/%dx%d-%s", VariantsPrefix, key, options.Width, options.Height, options.Fit)
+}
+
+// Processor resizes the stored images and caches the resized variants in the store. Variants are derived data,
+// they are regenerated whenever the image changes.
+type Processor struct {
+	Storage store.Store
+	Config  config.ImagesConfig
+
+	jobs chan string
+	// resizes bounds the variants generated at once on request, each holding a decoded image in memory
+	resizes chan struct{}
+}
+
+func NewProcessor(storage store.Store, imagesConfig config.ImagesConfig) *Processor {
+	return &Processor{
+		Storage: storage,
+		Config:  imagesConfig,
+		jobs:    make(chan string, imagesConfig.ThumbnailQueueSize),
+		resizes: make(chan struct{}, imagesConfig.MaxConcurrentResizes),
+	}
+}
+
+// Start starts the workers generating the thumbnails of the uploaded images
+func (p *Processor) Start() {
+	for i := 0; i < p.Config.ThumbnailWorkers; i++ {
+		go func() {
+			for key := range p.jobs {
+				if err := p.GenerateThumbnails(key); err != nil {
+					log.Printf("cannot generate thumbnails of %s: %s\n", key, err)
+				}
+			}
+		}()
+	}
+}
+
+// Enqueue schedules the generation of the thumbnails of an uploaded file; files which are not supported images are skipped
+func (p *Processor) Enqueue(key, contentType string) {
+	if !IsSupported(contentType) || len(p.Config.ThumbnailSizes) == 0 {
+		return
+	}
+
+	select {
+	case p.jobs <- key:
+	default:
+		// the thumbnails are generated on their first request instead
+		log.Printf("thumbnail queue is full, skipping %s\n", key)
+	}
+}
+
+// GenerateThumbnails generates the variants of the image with the configured thumbnail sizes
+func (p *Processor) GenerateThumbnails(key string) error {
+	source, err := p.find(key)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		return ErrNotFound
+	}
+
+	img, format, err := p.decode(key)
+	if err != nil {
+		return err
+	}
+
+	for _, size := range p.Config.ThumbnailSizes {
+		options, err := p.normalize(Options{Width: size.Width, Height: size.Height, Fit: FitContain})
+		if err != nil {
+			return err
+		}
+		if _, err = p.generate(source, img, format, options); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Generated %d thumbnails of %s\n", len(p.Config.ThumbnailSizes), key)
+	return nil
+}
+
+// GetVariant writes the resized image to the writer and returns its content type.
+// The variant is generated on the first request, then served from the store until the image changes.
+func (p *Processor) GetVariant(key string, options Options, writer io.Writer) (string, error) {
+	options, err := p.normalize(options)
+	if err != nil {
+		return "", err
+	}
+
+	source, err := p.find(key)
+	if err != nil {
+		return "", err
+	}
+	if source == nil {
+		return "", ErrNotFound
+	}
+	// images uploaded with a presigned url may have no content type until their upload is completed
+	if contentType := source.GetContentType(); contentType != "" && !IsSupported(contentType) {
+		return "", ErrUnsupportedImage
+	}
+
+	variantKey := VariantKey(key, options)
+	cached, err := p.find(variantKey)
+	if err != nil {
+		return "", err
+	}
+	if cached != nil && cached.GetMetadata()[sourceMetadataKey] == sourceVersion(source) {
+		return cached.GetContentType(), p.Storage.Get(variantKey, writer)
+	}
+
+	p.resizes <- struct{}{}
+	defer func() {
+		<-p.resizes
+	}()
+
+	img, format, err := p.decode(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := p.generate(source, img, format, options)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = writer.Write(data)
+	return ContentType(format), err
+}
+
+// DeleteVariants deletes the variants of the images with the given prefix
+func (p *Processor) DeleteVariants(prefix string) error {
+	return p.Storage.DeleteAll(VariantsPrefix + prefix)
+}
+
+// normalize validates the options; the fit of the variants keeping the aspect ratio is irrelevant,
+// so they share the same key
+func (p *Processor) normalize(options Options) (Options, error) {
+	for field, value := range map[string]int{"width": options.Width, "height": options.Height} {
+		if value < 0 || (p.Config.MaxDimension > 0 && value > p.Config.MaxDimension) {
+			return options, &OptionsError{
+				Field:       field,
+				Description: fmt.Sprintf("%s must be between 0 and %d", field, p.Config.MaxDimension),
+			}
+		}
+	}
+	if options.Width == 0 && options.Height == 0 {
+		return options, &OptionsError{Field: "width", Description: "width or height is required"}
+	}
+
+	fit, err := ParseFit(string(options.Fit))
+	if err != nil {
+		return options, &OptionsError{Field: "fit", Description: err.Error()}
+	}
+	if options.Width == 0 || options.Height == 0 {
+		fit = FitContain
+	}
+	options.Fit = fit
+	return options, nil
+}
+
+func (p *Processor) decode(key string) (image.Image, string, error) {
+	data := &bytes.Buffer{}
+	if err := p.Storage.Get(key, data); err != nil {
+		return nil, "", err
+	}
+
+	img, format, err := Decode(data.Bytes(), p.Config.MaxSourcePixels)
+	if err != nil {
+		return nil, "", err
+	}
+	return img, format, nil
+}
+
+// generate resizes the image and stores the variant, along with the version of the image it was generated from
+func (p *Processor) generate(source *pb.StorageObject, img image.Image, format string, options Options) ([]byte, error) {
+	data := &bytes.Buffer{}
+	if err := Encode(data, Resize(img, options.Width, options.Height, options.Fit), format); err != nil {
+		return nil, fmt.Errorf("cannot encode %s image: %s", format, err)
+	}
+
+	metadata := &store.ObjectMetadata{
+		ContentType: ContentType(format),
+		Custom: map[string]string{
+			sourceMetadataKey: sourceVersion(source),
+		},
+	}
+	if err := p.Storage.Put(VariantKey(source.GetKey(), options), bytes.NewReader(data.Bytes()), metadata); err != nil {
+		return nil, fmt.Errorf("cannot store variant: %s", err)
+	}
+	return data.Bytes(), nil
+}
+
+// find returns the object with the key, or nil if it does not exist
+func (p *Processor) find(key string) (*pb.StorageObject, error) {
+	objects, err := p.Storage.GetAll(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		if object.GetKey() == key {
+			return object, nil
+		}
+	}
+	return nil, nil
+}
+
+// sourceVersion identifies the content of the image, by its checksum if known
+func sourceVersion(source *pb.StorageObject) string {
+	if source.GetSha256() != "" {
+		return source.GetSha256()
+	}
+	return fmt.Sprintf("%s-%d", source.GetLastModified(), source.GetSize())
+}
@@ -0,0 +1,191 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// Fit defines how an image is scaled to a size with a different aspect ratio
+type Fit string
+
+const (
+	// FitContain scales the image to fit within the size, keeping its aspect ratio
+	FitContain Fit = "contain"
+	// FitCover scales the image to cover the size, keeping its aspect ratio, and crops what overflows around the center
+	FitCover Fit = "cover"
+	// FitFill stretches the image to the size
+	FitFill Fit = "fill"
+)
+
+// ParseFit returns the fit with the given name, FitContain if empty
+func ParseFit(name string) (Fit, error) {
+	switch fit := Fit(strings.ToLower(name)); fit {
+	case "":
+		return FitContain, nil
+	case FitContain, FitCover, FitFill:
+		return fit, nil
+	}
+	return "", fmt.Errorf("unknown fit %s", name)
+}
+
+// Resize scales the image to the given size. If the width or the height is 0, it is computed from the other,
+// keeping the aspect ratio, and the fit does not matter.
+func Resize(src image.Image, width, height int, fit Fit) *image.RGBA {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if srcWidth == 0 || srcHeight == 0 {
+		return image.NewRGBA(image.Rect(0, 0, 0, 0))
+	}
+
+	switch {
+	case width == 0:
+		width = maxInt(1, height*srcWidth/srcHeight)
+	case height == 0:
+		height = maxInt(1, width*srcHeight/srcWidth)
+	}
+
+	crop := bounds
+	switch fit {
+	case FitContain:
+		// the side overflowing the size is shrunk
+		if width*srcHeight > height*srcWidth {
+			width = maxInt(1, height*srcWidth/srcHeight)
+		} else {
+			height = maxInt(1, width*srcHeight/srcWidth)
+		}
+	case FitCover:
+		// the source is cropped to the aspect ratio of the size
+		if srcWidth*height > srcHeight*width {
+			cropWidth := maxInt(1, srcHeight*width/height)
+			x := bounds.Min.X + (srcWidth-cropWidth)/2
+			crop = image.Rect(x, bounds.Min.Y, x+cropWidth, bounds.Max.Y)
+		} else {
+			cropHeight := maxInt(1, srcWidth*height/width)
+			y := bounds.Min.Y + (srcHeight-cropHeight)/2
+			crop = image.Rect(bounds.Min.X, y, bounds.Max.X, y+cropHeight)
+		}
+	}
+
+	// premultiplied colors are averaged without darkening the edges of transparent areas
+	rgba := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, crop.Min, draw.Src)
+
+	// the triangle filter is separable: the rows are resampled, then the columns
+	return resampleVertical(resampleHorizontal(rgba, width), height)
+}
+
+// contribution is the weight of a source pixel in a destination pixel
+type contribution struct {
+	index  int
+	weight float64
+}
+
+// filterWeights computes the contributions of the source pixels to every destination pixel, using a triangle filter.
+// When downscaling, the filter is widened to cover all the source pixels under a destination pixel.
+func filterWeights(dstSize, srcSize int) [][]contribution {
+	scale := float64(srcSize) / float64(dstSize)
+	radius := math.Max(scale, 1)
+
+	weights := make([][]contribution, dstSize)
+	for i := range weights {
+		center := (float64(i) + 0.5) * scale
+		start := int(math.Floor(center - radius))
+		end := int(math.Ceil(center + radius))
+
+		total := 0.0
+		for j := start; j < end; j++ {
+			distance := math.Abs(float64(j)+0.5-center) / radius
+			if distance >= 1 {
+				continue
+			}
+			weight := 1 - distance
+			// the edge pixels are repeated beyond the borders
+			index := minInt(maxInt(j, 0), srcSize-1)
+			weights[i] = append(weights[i], contribution{index: index, weight: weight})
+			total += weight
+		}
+
+		if total == 0 {
+			weights[i] = []contribution{{index: minInt(int(center), srcSize-1), weight: 1}}
+			continue
+		}
+		for k := range weights[i] {
+			weights[i][k].weight /= total
+		}
+	}
+	return weights
+}
+
+func resampleHorizontal(src *image.RGBA, width int) *image.RGBA {
+	height := src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	weights := filterWeights(width, src.Bounds().Dx())
+
+	for y := 0; y < height; y++ {
+		srcRow := src.Pix[y*src.Stride:]
+		dstRow := dst.Pix[y*dst.Stride:]
+		for x, contributions := range weights {
+			var r, g, b, a float64
+			for _, c := range contributions {
+				pixel := srcRow[c.index*4 : c.index*4+4]
+				r += float64(pixel[0]) * c.weight
+				g += float64(pixel[1]) * c.weight
+				b += float64(pixel[2]) * c.weight
+				a += float64(pixel[3]) * c.weight
+			}
+			setPixel(dstRow[x*4:x*4+4], r, g, b, a)
+		}
+	}
+	return dst
+}
+
+func resampleVertical(src *image.RGBA, height int) *image.RGBA {
+	width := src.Bounds().Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	weights := filterWeights(height, src.Bounds().Dy())
+
+	for y, contributions := range weights {
+		dstRow := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			var r, g, b, a float64
+			for _, c := range contributions {
+				offset := c.index*src.Stride + x*4
+				pixel := src.Pix[offset : offset+4]
+				r += float64(pixel[0]) * c.weight
+				g += float64(pixel[1]) * c.weight
+				b += float64(pixel[2]) * c.weight
+				a += float64(pixel[3]) * c.weight
+			}
+			setPixel(dstRow[x*4:x*4+4], r, g, b, a)
+		}
+	}
+	return dst
+}
+
+func setPixel(pixel []uint8, r, g, b, a float64) {
+	pixel[0] = clamp(r)
+	pixel[1] = clamp(g)
+	pixel[2] = clamp(b)
+	pixel[3] = clamp(a)
+}
+
+func clamp(value float64) uint8 {
+	return uint8(math.Min(255, math.Max(0, value+0.5)))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -1,6 +1,8 @@
 package lib
 
 import (
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
@@ -56,3 +58,82 @@ func TryRemoveFile(filePath string) (err error) {
 	}
 	return
 }
+
+// WriteTempFile writes the content to a new file in tempDir and flushes it to disk,
+// returning the temporary file's name.
+func WriteTempFile(tempDir string, body io.Reader) (string, error) {
+	file, err := ioutil.TempFile(tempDir, "write-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(file, body)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// LinkTempFile creates a hard link to the file in tempDir, returning the link's name, or an empty name if the
+// file system does not support hard links.
+func LinkTempFile(tempDir, name string) (string, error) {
+	file, err := ioutil.TempFile(tempDir, "link-")
+	if err != nil {
+		return "", err
+	}
+	tempName := file.Name()
+	file.Close()
+	os.Remove(tempName)
+
+	if err = os.Link(name, tempName); err != nil {
+		return "", nil
+	}
+	return tempName, nil
+}
+
+// CommitFile atomically replaces name with the temporary file and flushes the directory entry,
+// so that after a crash name holds either its previous or its new content, never a truncated one.
+func CommitFile(tempName, name string) error {
+	if err := os.Rename(tempName, name); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// WriteFileAtomic writes the content to a temporary file in tempDir, then renames it to name.
+func WriteFileAtomic(tempDir, name string, body io.Reader) error {
+	tempName, err := WriteTempFile(tempDir, body)
+	if err != nil {
+		return err
+	}
+	return CommitFile(tempName, name)
+}
+
+// CleanDirectory removes all contents of the directory, returning how many entries were removed.
+func CleanDirectory(dirPath string) (int, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, entry := range entries {
+		if err = os.RemoveAll(filepath.Join(dirPath, entry.Name())); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
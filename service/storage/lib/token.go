@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignToken signs the subject along with the token's expiration time
+func SignToken(secret, subject string, expiresAt time.Time) string {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expires + "." + sign(secret, subject, expires)
+}
+
+// VerifyToken checks that the token was issued for the subject and has not expired
+func VerifyToken(secret, subject, token string) error {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed token")
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed token")
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(sign(secret, subject, parts[0]))) {
+		return fmt.Errorf("invalid token")
+	}
+	if time.Now().Unix() > expires {
+		return fmt.Errorf("token expired")
+	}
+	return nil
+}
+
+func sign(secret, subject, expires string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(subject + "|" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,394 @@
+package casstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"github.com/bogdanrat/web-server/service/storage/lib"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	blobsDirectory = "blobs"
+	tempDirectory  = "tmp"
+)
+
+// CASStore is a content-addressed disk store: the content of every object is stored once, in a blob named by its SHA-256
+// checksum, and objects with identical content share the same blob.
+type CASStore struct {
+	Path       string
+	Versioning bool
+	GCInterval time.Duration
+
+	mutex sync.RWMutex
+	index *index
+	// journal records the changes of the index since it was last saved
+	journal        *os.File
+	journalRecords int
+}
+
+func New(casConfig config.CASStorageConfig) store.Store {
+	return &CASStore{
+		Path:       casConfig.Path,
+		Versioning: casConfig.Versioning,
+		GCInterval: time.Second * time.Duration(casConfig.GCInterval),
+	}
+}
+
+func (s *CASStore) Init() error {
+	for _, dir := range []string{s.Path, filepath.Join(s.Path, blobsDirectory), s.tempPath()} {
+		if err := lib.CreateDirectory(dir); err != nil {
+			return err
+		}
+	}
+
+	// writes interrupted by a crash leave their temporary files behind
+	removed, err := lib.CleanDirectory(s.tempPath())
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("Removed %d orphaned temporary files\n", removed)
+	}
+
+	if err := s.loadIndex(); err != nil {
+		return fmt.Errorf("cannot load index: %s", err)
+	}
+
+	if s.GCInterval > 0 {
+		s.startGC()
+	}
+
+	log.Printf("Initialized Content-Addressed Storage Engine in %s\n", s.Path)
+	return nil
+}
+
+func (s *CASStore) tempPath() string {
+	return filepath.Join(s.Path, tempDirectory)
+}
+
+// blobPath shards the blobs by the first two characters of their hash, to keep directories small
+func (s *CASStore) blobPath(hash string) string {
+	return filepath.Join(s.Path, blobsDirectory, hash[:2], hash)
+}
+
+// writeBlob stores the content in a temporary file while hashing it, then moves it to its blob atomically.
+// If a blob with the same hash already exists, the temporary file is discarded.
+func (s *CASStore) writeBlob(body io.Reader) (string, int64, error) {
+	file, err := ioutil.TempFile(s.tempPath(), "blob")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(file.Name())
+
+	checksum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, checksum), body)
+	if err != nil {
+		file.Close()
+		return "", 0, err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return "", 0, err
+	}
+	if err = file.Close(); err != nil {
+		return "", 0, err
+	}
+
+	hash := hex.EncodeToString(checksum.Sum(nil))
+	name := s.blobPath(hash)
+	if exists, err := lib.FileExists(name); err != nil {
+		return "", 0, err
+	} else if exists {
+		// an unreferenced blob is reused: refresh it so that the collector does not delete it before it is referenced
+		now := time.Now()
+		if err = os.Chtimes(name, now, now); err != nil {
+			return "", 0, err
+		}
+		return hash, size, nil
+	}
+
+	if err = lib.CreateDirectory(filepath.Dir(name)); err != nil {
+		return "", 0, err
+	}
+	if err = os.Rename(file.Name(), name); err != nil {
+		return "", 0, err
+	}
+	return hash, size, nil
+}
+
+func (s *CASStore) Put(key string, body io.Reader, metadata *store.ObjectMetadata) error {
+	// the blob is written outside the lock; it cannot be collected before it is referenced, since the collector
+	// only deletes the blobs not modified within its interval
+	hash, size, err := s.writeBlob(body)
+	if err != nil {
+		return err
+	}
+
+	objectMetadata := &store.ObjectMetadata{}
+	if metadata != nil {
+		*objectMetadata = *metadata
+	}
+	// the checksum is the caller's, of the content it wrote: under encryption or compression the blob's hash differs
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.setCurrent(key, newObjectVersion(hash, size, objectMetadata))
+	return s.saveIndex(key)
+}
+
+// setCurrent makes the version the current version of the object, keeping or releasing the previous one
+func (s *CASStore) setCurrent(key string, version *objectVersion) {
+	entry, ok := s.index.Objects[key]
+	if !ok {
+		entry = &indexEntry{}
+		s.index.Objects[key] = entry
+	}
+
+	s.retain(version.Hash)
+	s.archiveCurrent(key, entry)
+	entry.Current = version
+}
+
+// archiveCurrent keeps the current version as a previous version if the object is versioned, or releases it.
+// Hidden objects, such as the trashed ones, are not versioned.
+func (s *CASStore) archiveCurrent(key string, entry *indexEntry) {
+	if entry.Current == nil {
+		return
+	}
+	if s.Versioning && !store.IsHidden(key) {
+		entry.Versions = append([]*objectVersion{entry.Current}, entry.Versions...)
+	} else {
+		s.release(entry.Current.Hash)
+	}
+	entry.Current = nil
+}
+
+func (s *CASStore) Get(key string, writer io.Writer) error {
+	s.mutex.RLock()
+	entry, ok := s.index.Objects[key]
+	if !ok || entry.Current == nil {
+		s.mutex.RUnlock()
+		return fmt.Errorf("file %s not found", key)
+	}
+	file, err := s.openBlob(entry.Current.Hash)
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+// openBlob opens the blob under the lock, so that the collector cannot delete it once released by a concurrent
+// write. The open blob remains readable if deleted afterwards.
+func (s *CASStore) openBlob(hash string) (*os.File, error) {
+	return os.Open(s.blobPath(hash))
+}
+
+func (s *CASStore) GetAll(prefix ...string) ([]*pb.StorageObject, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	objects := make([]*pb.StorageObject, 0)
+	for key, entry := range s.index.Objects {
+		if entry.Current == nil || !store.Listed(key, prefix...) {
+			continue
+		}
+		objects = append(objects, toStorageObject(key, entry.Current))
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (s *CASStore) List(prefix string) (*store.Listing, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	listing := store.NewListing()
+	prefixes := make(map[string]bool)
+	for key, entry := range s.index.Objects {
+		if entry.Current == nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if folder, ok := store.Delimit(prefix, key); ok {
+			if !prefixes[folder] && !store.IsHidden(folder) {
+				prefixes[folder] = true
+				listing.Prefixes = append(listing.Prefixes, folder)
+			}
+			continue
+		}
+		if !store.IsHidden(key) {
+			listing.Objects = append(listing.Objects, toStorageObject(key, entry.Current))
+		}
+	}
+
+	sort.Strings(listing.Prefixes)
+	sort.Slice(listing.Objects, func(i, j int) bool {
+		return listing.Objects[i].Key < listing.Objects[j].Key
+	})
+	return listing, nil
+}
+
+func toStorageObject(key string, version *objectVersion) *pb.StorageObject {
+	object := &pb.StorageObject{
+		Key:          key,
+		Size:         uint64(version.Size),
+		LastModified: version.LastModified.Format(time.RFC3339),
+	}
+	if metadata := version.Metadata; metadata != nil {
+		object.ContentType = metadata.ContentType
+		object.Sha256 = metadata.SHA256
+		object.Metadata = metadata.Custom
+		object.Owner = metadata.Owner
+	}
+	return object
+}
+
+func (s *CASStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.index.Objects[key]
+	if !ok || entry.Current == nil {
+		return nil
+	}
+
+	// trashed objects are purged for good
+	if s.Versioning && !store.IsHidden(key) {
+		s.archiveCurrent(key, entry)
+	} else {
+		s.release(entry.Current.Hash)
+		entry.Current = nil
+	}
+	if entry.Current == nil && len(entry.Versions) == 0 {
+		delete(s.index.Objects, key)
+	}
+
+	return s.saveIndex(key)
+}
+
+func (s *CASStore) DeleteAll(prefix ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := make([]string, 0)
+	for key, entry := range s.index.Objects {
+		if len(prefix) == 1 && !strings.HasPrefix(key, prefix[0]) {
+			continue
+		}
+		s.releaseEntry(entry)
+		delete(s.index.Objects, key)
+		deleted = append(deleted, key)
+	}
+
+	return s.saveIndex(deleted...)
+}
+
+func (s *CASStore) Move(srcKey, dstKey string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	src, ok := s.index.Objects[srcKey]
+	if !ok || src.Current == nil {
+		return fmt.Errorf("file %s not found", srcKey)
+	}
+
+	// the blob is referenced by the destination instead of the source, no content is copied
+	current := src.Current
+	src.Current = nil
+	if len(src.Versions) == 0 {
+		delete(s.index.Objects, srcKey)
+	}
+	s.setCurrent(dstKey, current)
+	s.release(current.Hash)
+
+	return s.saveIndex(srcKey, dstKey)
+}
+
+func (s *CASStore) Copy(srcKey, dstKey, owner string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	src, ok := s.index.Objects[srcKey]
+	if !ok || src.Current == nil {
+		return fmt.Errorf("file %s not found", srcKey)
+	}
+
+	// the copy references the same blob, no content is copied
+	var metadata *store.ObjectMetadata
+	if src.Current.Metadata != nil {
+		metadata = &store.ObjectMetadata{}
+		*metadata = *src.Current.Metadata
+		if src.Current.Metadata.Custom != nil {
+			metadata.Custom = make(map[string]string, len(src.Current.Metadata.Custom))
+			for key, value := range src.Current.Metadata.Custom {
+				metadata.Custom[key] = value
+			}
+		}
+	}
+	if owner != "" {
+		if metadata == nil {
+			metadata = &store.ObjectMetadata{}
+		}
+		metadata.Owner = owner
+	}
+	s.setCurrent(dstKey, newObjectVersion(src.Current.Hash, src.Current.Size, metadata))
+
+	return s.saveIndex(dstKey)
+}
+
+func (s *CASStore) GetMetadata(key string, versionID ...string) (*store.ObjectMetadata, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var version *objectVersion
+	if len(versionID) == 1 && versionID[0] != "" {
+		if version, _ = s.findVersion(key, versionID[0]); version == nil {
+			return nil, store.ErrVersionNotFound
+		}
+	} else if entry, ok := s.index.Objects[key]; ok {
+		version = entry.Current
+	}
+	if version == nil {
+		return nil, fmt.Errorf("file %s not found", key)
+	}
+
+	metadata := &store.ObjectMetadata{}
+	if version.Metadata != nil {
+		*metadata = *version.Metadata
+	}
+	return metadata, nil
+}
+
+func (s *CASStore) SetMetadata(key string, metadata *store.ObjectMetadata) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.index.Objects[key]
+	if !ok || entry.Current == nil {
+		return fmt.Errorf("file %s not found", key)
+	}
+
+	objectMetadata := *metadata
+	entry.Current.Metadata = &objectMetadata
+
+	return s.saveIndex(key)
+}
@@ -0,0 +1,104 @@
+package casstore
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *CASStore) startGC() {
+	ticker := time.NewTicker(s.GCInterval)
+
+	go func() {
+		for range ticker.C {
+			collected, err := s.CollectGarbage()
+			if err != nil {
+				log.Printf("could not collect garbage: %s\n", err)
+			}
+			if collected > 0 {
+				log.Printf("Collected %d unreferenced blobs\n", collected)
+			}
+		}
+	}()
+}
+
+// CollectGarbage deletes the blobs no longer referenced by any object, along with the leftover temporary files.
+// Blobs modified within the collection interval are kept, since they may be referenced by a write in progress.
+// The blobs are walked without the lock, which is only held to copy the reference counts and to delete each blob.
+func (s *CASStore) CollectGarbage() (int, error) {
+	s.mutex.RLock()
+	refCounts := make(map[string]int, len(s.index.RefCounts))
+	for hash, count := range s.index.RefCounts {
+		refCounts[hash] = count
+	}
+	s.mutex.RUnlock()
+
+	threshold := time.Now().Add(-s.GCInterval)
+	collected := 0
+
+	err := filepath.WalkDir(filepath.Join(s.Path, blobsDirectory), func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if refCounts[d.Name()] > 0 {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(threshold) {
+			return nil
+		}
+
+		removed, err := s.removeBlob(d.Name(), filePath, threshold)
+		if err != nil {
+			return err
+		}
+		if removed {
+			collected++
+		}
+		return nil
+	})
+	if err != nil {
+		return collected, err
+	}
+
+	entries, err := os.ReadDir(s.tempPath())
+	if err != nil {
+		return collected, err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(threshold) {
+			continue
+		}
+		_ = os.Remove(filepath.Join(s.tempPath(), entry.Name()))
+	}
+
+	return collected, nil
+}
+
+// removeBlob deletes the blob unless it was referenced or reused since the reference counts were copied
+func (s *CASStore) removeBlob(hash, filePath string, threshold time.Time) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.index.RefCounts[hash] > 0 {
+		return false, nil
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if info.ModTime().After(threshold) {
+		return false, nil
+	}
+	return true, os.Remove(filePath)
+}
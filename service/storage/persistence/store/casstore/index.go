@@ -0,0 +1,209 @@
+package casstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/bogdanrat/web-server/service/storage/lib"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	indexFileName = "index.json"
+	// journalFileName holds the changes of the index since it was last saved, one json record per line
+	journalFileName = "index.journal"
+	// maxJournalRecords is the number of changes after which the journal is compacted into the index
+	maxJournalRecords = 1000
+	// maxJournalRecordSize bounds a record, i.e. an object with all of its versions
+	maxJournalRecordSize = 16 * 1024 * 1024
+)
+
+// index maps the object keys to the blobs holding their content, and counts the references to every blob
+type index struct {
+	Objects   map[string]*indexEntry `json:"objects"`
+	RefCounts map[string]int         `json:"ref_counts"`
+}
+
+type indexEntry struct {
+	// Current is nil if the object was deleted while its previous versions are kept
+	Current *objectVersion `json:"current,omitempty"`
+	// Versions holds the previous versions, newest first
+	Versions []*objectVersion `json:"versions,omitempty"`
+}
+
+type objectVersion struct {
+	ID string `json:"id"`
+	// Hash addresses the blob, i.e. the content as stored, while the metadata's SHA256 is the checksum of the content
+	// written by the caller, which differs under encryption or compression
+	Hash         string                `json:"hash"`
+	Size         int64                 `json:"size"`
+	LastModified time.Time             `json:"last_modified"`
+	Metadata     *store.ObjectMetadata `json:"metadata,omitempty"`
+}
+
+func newObjectVersion(hash string, size int64, metadata *store.ObjectMetadata) *objectVersion {
+	now := time.Now()
+	return &objectVersion{
+		ID:           strconv.FormatInt(now.UnixNano(), 10),
+		Hash:         hash,
+		Size:         size,
+		LastModified: now,
+		Metadata:     metadata,
+	}
+}
+
+func newIndex() *index {
+	return &index{
+		Objects:   make(map[string]*indexEntry),
+		RefCounts: make(map[string]int),
+	}
+}
+
+// journalRecord is the state of an object after a change, nil if the object was deleted
+type journalRecord struct {
+	Key   string      `json:"key"`
+	Entry *indexEntry `json:"entry,omitempty"`
+}
+
+func (s *CASStore) indexPath() string {
+	return filepath.Join(s.Path, indexFileName)
+}
+
+func (s *CASStore) journalPath() string {
+	return filepath.Join(s.Path, journalFileName)
+}
+
+// loadIndex reads the last saved index, then replays the journal onto it
+func (s *CASStore) loadIndex() error {
+	idx := newIndex()
+	data, err := ioutil.ReadFile(s.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, idx); err != nil {
+			return err
+		}
+	}
+
+	journal, err := os.OpenFile(s.journalPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	records := 0
+	scanner := bufio.NewScanner(journal)
+	scanner.Buffer(make([]byte, 64*1024), maxJournalRecordSize)
+	for scanner.Scan() {
+		record := &journalRecord{}
+		// a crash may leave the last record half written, the change it records was not acknowledged
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			log.Printf("ignoring the end of the index journal: %s\n", err)
+			break
+		}
+		if record.Entry == nil {
+			delete(idx.Objects, record.Key)
+		} else {
+			idx.Objects[record.Key] = record.Entry
+		}
+		records++
+	}
+	if err = scanner.Err(); err != nil {
+		journal.Close()
+		return err
+	}
+
+	// the references are counted from the objects, the journal does not record them
+	idx.RefCounts = make(map[string]int)
+	for _, entry := range idx.Objects {
+		if entry.Current != nil {
+			idx.RefCounts[entry.Current.Hash]++
+		}
+		for _, version := range entry.Versions {
+			idx.RefCounts[version.Hash]++
+		}
+	}
+
+	s.index = idx
+	s.journal = journal
+	s.journalRecords = records
+	// the journal is compacted so that the replayed records, and a half written one, are not appended to
+	return s.compactIndex()
+}
+
+// saveIndex appends the state of the changed objects to the journal, compacting it into the index once it grows.
+// Appending keeps a write proportional to the change rather than to the whole index.
+func (s *CASStore) saveIndex(keys ...string) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, key := range keys {
+		record := &journalRecord{Key: key}
+		if entry, ok := s.index.Objects[key]; ok {
+			record.Entry = entry
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.journal.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	if err := s.journal.Sync(); err != nil {
+		return err
+	}
+
+	s.journalRecords += len(keys)
+	if s.journalRecords < maxJournalRecords {
+		return nil
+	}
+	return s.compactIndex()
+}
+
+// compactIndex saves the index atomically, so that a crash never leaves it half written, then empties the journal.
+// A crash in between replays the journal onto the saved index, which yields the same index.
+func (s *CASStore) compactIndex() error {
+	data, err := json.Marshal(s.index)
+	if err != nil {
+		return err
+	}
+	if err = lib.WriteFileAtomic(s.tempPath(), s.indexPath(), bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	if err = s.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = s.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.journalRecords = 0
+	return nil
+}
+
+func (s *CASStore) retain(hash string) {
+	s.index.RefCounts[hash]++
+}
+
+// release drops a reference to the blob; unreferenced blobs are deleted by the garbage collector
+func (s *CASStore) release(hash string) {
+	s.index.RefCounts[hash]--
+	if s.index.RefCounts[hash] <= 0 {
+		delete(s.index.RefCounts, hash)
+	}
+}
+
+func (s *CASStore) releaseEntry(entry *indexEntry) {
+	if entry.Current != nil {
+		s.release(entry.Current.Hash)
+	}
+	for _, version := range entry.Versions {
+		s.release(version.Hash)
+	}
+}
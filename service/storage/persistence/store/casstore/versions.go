@@ -0,0 +1,126 @@
+package casstore
+
+import (
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"io"
+	"time"
+)
+
+func (s *CASStore) ListVersions(key string) ([]*pb.ObjectVersion, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	versions := make([]*pb.ObjectVersion, 0)
+
+	entry, ok := s.index.Objects[key]
+	if !ok {
+		return versions, nil
+	}
+
+	if entry.Current != nil {
+		versions = append(versions, toObjectVersion(key, entry.Current, true))
+	}
+	for _, version := range entry.Versions {
+		versions = append(versions, toObjectVersion(key, version, false))
+	}
+	return versions, nil
+}
+
+func (s *CASStore) GetVersion(key, versionID string, writer io.Writer) error {
+	s.mutex.RLock()
+	version, _ := s.findVersion(key, versionID)
+	if version == nil {
+		s.mutex.RUnlock()
+		return store.ErrVersionNotFound
+	}
+	file, err := s.openBlob(version.Hash)
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+func (s *CASStore) RestoreVersion(key, versionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	version, isCurrent := s.findVersion(key, versionID)
+	if version == nil {
+		return store.ErrVersionNotFound
+	}
+	if isCurrent {
+		return nil
+	}
+
+	// the restored copy becomes the new current version, sharing the version's blob
+	restored := newObjectVersion(version.Hash, version.Size, version.Metadata)
+	s.setCurrent(key, restored)
+	return s.saveIndex(key)
+}
+
+func (s *CASStore) DeleteVersion(key, versionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	version, isCurrent := s.findVersion(key, versionID)
+	if version == nil {
+		return store.ErrVersionNotFound
+	}
+
+	entry := s.index.Objects[key]
+	s.release(version.Hash)
+
+	if isCurrent {
+		// the newest previous version becomes the current version
+		entry.Current = nil
+		if len(entry.Versions) > 0 {
+			entry.Current = entry.Versions[0]
+			entry.Versions = entry.Versions[1:]
+		}
+	} else {
+		for i, previous := range entry.Versions {
+			if previous.ID == versionID {
+				entry.Versions = append(entry.Versions[:i], entry.Versions[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if entry.Current == nil && len(entry.Versions) == 0 {
+		delete(s.index.Objects, key)
+	}
+	return s.saveIndex(key)
+}
+
+// findVersion returns the version with the given id, and whether it is the current version
+func (s *CASStore) findVersion(key, versionID string) (*objectVersion, bool) {
+	entry, ok := s.index.Objects[key]
+	if !ok {
+		return nil, false
+	}
+
+	if entry.Current != nil && entry.Current.ID == versionID {
+		return entry.Current, true
+	}
+	for _, version := range entry.Versions {
+		if version.ID == versionID {
+			return version, false
+		}
+	}
+	return nil, false
+}
+
+func toObjectVersion(key string, version *objectVersion, isLatest bool) *pb.ObjectVersion {
+	return &pb.ObjectVersion{
+		Key:          key,
+		VersionId:    version.ID,
+		LastModified: version.LastModified.Format(time.RFC3339),
+		Size:         uint64(version.Size),
+		IsLatest:     isLatest,
+	}
+}
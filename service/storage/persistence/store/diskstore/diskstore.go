@@ -3,25 +3,36 @@ package diskstore
 import (
 	"fmt"
 	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/config"
 	"github.com/bogdanrat/web-server/service/storage/lib"
 	"github.com/bogdanrat/web-server/service/storage/persistence/store"
 	"io"
 	"io/fs"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// tempDirectory holds the files being written, until they are renamed to their keys
+	tempDirectory = ".tmp"
+)
+
 type DiskStore struct {
 	Path string
+	// Versioning keeps the previous versions of overwritten and deleted files
+	Versioning bool
+	// versionMutex serializes the writes of the versioned files, whose version ids must not collide
+	versionMutex sync.Mutex
 }
 
-func New(path string) store.Store {
+func New(diskConfig config.DiskStorageConfig) store.Store {
 	return &DiskStore{
-		Path: path,
+		Path:       diskConfig.Path,
+		Versioning: diskConfig.Versioning,
 	}
 }
 
@@ -29,11 +40,32 @@ func (s *DiskStore) Init() error {
 	if err := lib.CreateDirectory(s.Path); err != nil {
 		return err
 	}
+
+	// writes interrupted by a crash leave their temporary files behind
+	if err := lib.CreateDirectory(s.tempPath()); err != nil {
+		return err
+	}
+	removed, err := lib.CleanDirectory(s.tempPath())
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("Removed %d orphaned temporary files\n", removed)
+	}
+
 	log.Printf("Initialized Disk Storage Engine in %s\n", s.Path)
 	return nil
 }
 
-func (s *DiskStore) Put(fileName string, body io.Reader) error {
+func (s *DiskStore) tempPath() string {
+	return filepath.Join(s.Path, tempDirectory)
+}
+
+func (s *DiskStore) Put(fileName string, body io.Reader, metadata *store.ObjectMetadata) error {
+	if err := store.CheckKey(fileName); err != nil {
+		return err
+	}
+
 	name := filepath.Join(s.Path, fileName)
 	dir := filepath.Dir(name)
 	// create path
@@ -41,23 +73,31 @@ func (s *DiskStore) Put(fileName string, body io.Reader) error {
 		return err
 	}
 
-	// create file
-	file, err := os.Create(name)
+	// the content is written to a temporary file first, so that a failed write never truncates the current version
+	tempName, err := lib.WriteTempFile(s.tempPath(), body)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer os.Remove(tempName)
 
-	// copy content
-	_, err = io.Copy(file, body)
+	err = s.commitVersion(fileName, func() error {
+		return lib.CommitFile(tempName, name)
+	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if metadata != nil {
+		return s.writeMetadata(fileName, metadata)
+	}
+	return s.deleteMetadata(fileName)
 }
 
 func (s *DiskStore) Get(fileName string, writer io.Writer) error {
+	if err := store.CheckKey(fileName); err != nil {
+		return err
+	}
+
 	name := filepath.Join(s.Path, fileName)
 	if exists, err := lib.FileExists(name); err != nil {
 		return err
@@ -79,28 +119,33 @@ func (s *DiskStore) Get(fileName string, writer io.Writer) error {
 	return nil
 }
 
-func (s *DiskStore) GetAll() ([]*pb.StorageObject, error) {
+func (s *DiskStore) GetAll(prefix ...string) ([]*pb.StorageObject, error) {
 	objects := make([]*pb.StorageObject, 0)
 
 	err := filepath.WalkDir(s.Path, func(filePath string, d fs.DirEntry, err error) error {
-		// avoid directories and hidden files (base == extension, e.g., .DS_Store)
-		if !d.IsDir() && path.Base(filePath) != filepath.Ext(filePath) {
-			file, err := os.Open(filePath)
+		// skip the metadata sidecar files, the previous versions and the files being written
+		if d.IsDir() && (d.Name() == metadataDirectory || d.Name() == versionsDirectory || d.Name() == tempDirectory) {
+			return filepath.SkipDir
+		}
+		// avoid directories; the hidden files, e.g. the folder markers, are left out by Listed unless a prefix is given
+		if !d.IsDir() {
+			// the key is the path relative to the storage path (e.g., data/images/a.png is images/a.png)
+			fileName, err := filepath.Rel(s.Path, filePath)
 			if err != nil {
 				return err
 			}
-			fileInfo, err := file.Stat()
+			fileName = filepath.ToSlash(fileName)
+			if !store.Listed(fileName, prefix...) {
+				return nil
+			}
+
+			fileInfo, err := d.Info()
 			if err != nil {
 				return err
 			}
-
-			// remove data/ from the file name
-			// s.Path is ./data so we take the base of data, which is 'data'
-			fileName := strings.Replace(filePath, path.Base(s.Path)+"/", "", 1)
-			object := &pb.StorageObject{
-				Key:          fileName,
-				Size:         uint64(fileInfo.Size()),
-				LastModified: fileInfo.ModTime().Format(time.RFC3339),
+			object, err := s.storageObject(fileName, fileInfo)
+			if err != nil {
+				return err
 			}
 			objects = append(objects, object)
 		}
@@ -112,22 +157,119 @@ func (s *DiskStore) GetAll() ([]*pb.StorageObject, error) {
 	}
 	return objects, nil
 }
+
+func (s *DiskStore) List(prefix string) (*store.Listing, error) {
+	listing := store.NewListing()
+	if prefix != "" {
+		if err := store.CheckKey(prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.Path, prefix))
+	if err != nil {
+		// nothing was stored under the prefix
+		if os.IsNotExist(err) {
+			return listing, nil
+		}
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// also skips the metadata, versions and temporary directories
+		fileName := prefix + entry.Name()
+		if store.IsHidden(fileName) {
+			continue
+		}
+		if entry.IsDir() {
+			listing.Prefixes = append(listing.Prefixes, fileName+"/")
+			continue
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		object, err := s.storageObject(fileName, fileInfo)
+		if err != nil {
+			return nil, err
+		}
+		listing.Objects = append(listing.Objects, object)
+	}
+	return listing, nil
+}
+
+func (s *DiskStore) storageObject(fileName string, fileInfo fs.FileInfo) (*pb.StorageObject, error) {
+	metadata, err := s.readMetadata(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.StorageObject{
+		Key:          fileName,
+		Size:         uint64(fileInfo.Size()),
+		LastModified: fileInfo.ModTime().Format(time.RFC3339),
+		ContentType:  metadata.ContentType,
+		Sha256:       metadata.SHA256,
+		Metadata:     metadata.Custom,
+		Owner:        metadata.Owner,
+	}, nil
+}
+
+// removeEmptyDirectories removes the directory and its parents left empty, so that they are not listed as folders
+func (s *DiskStore) removeEmptyDirectories(dir string) {
+	root := filepath.Clean(s.Path)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// fails on the first directory not empty
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
 func (s *DiskStore) Delete(fileName string) error {
+	if err := store.CheckKey(fileName); err != nil {
+		return err
+	}
+
 	name := filepath.Join(s.Path, fileName)
+	defer s.removeEmptyDirectories(filepath.Dir(name))
+
+	// trashed objects are purged for good
+	if s.versioned(fileName) {
+		s.versionMutex.Lock()
+		defer s.versionMutex.Unlock()
+		return s.archiveCurrentVersion(fileName)
+	}
+
 	if err := lib.TryRemoveFile(name); err != nil {
 		return err
 	}
-	return nil
+	return s.deleteMetadata(fileName)
 }
 func (s *DiskStore) DeleteAll(prefix ...string) error {
 	// if no prefix was supplied, we are going to delete every file in the storage path (i.d., ./data)
 	filesPath := s.Path
-	if len(prefix) == 1 {
+	if len(prefix) == 1 && prefix[0] != "" {
+		if err := store.CheckKey(prefix[0]); err != nil {
+			return err
+		}
 		filesPath = filepath.Join(s.Path, prefix[0])
+
+		if err := lib.TryRemoveFile(filepath.Join(s.Path, metadataDirectory, prefix[0])); err != nil {
+			return err
+		}
+		if err := lib.TryRemoveFile(filepath.Join(s.Path, versionsDirectory, prefix[0])); err != nil {
+			return err
+		}
 	}
 
 	dir, err := os.Open(filesPath)
 	if err != nil {
+		// nothing was stored under the prefix
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
 	defer dir.Close()
@@ -138,13 +280,127 @@ func (s *DiskStore) DeleteAll(prefix ...string) error {
 		return err
 	}
 
-	// remove all contents in dir
+	// remove all contents in dir. The metadata and versions directories go along with the files and are created again
+	// on write, but the files being written are kept.
 	for _, name := range names {
+		if filesPath == s.Path && name == tempDirectory {
+			continue
+		}
 		err := os.RemoveAll(filepath.Join(filesPath, name))
 		if err != nil {
 			return err
 		}
 	}
 
+	if filesPath != s.Path {
+		s.removeEmptyDirectories(filesPath)
+	}
 	return nil
 }
+
+func (s *DiskStore) Move(srcKey, dstKey string) error {
+	if err := store.CheckKey(srcKey); err != nil {
+		return err
+	}
+	if err := store.CheckKey(dstKey); err != nil {
+		return err
+	}
+
+	src := filepath.Join(s.Path, srcKey)
+	if exists, err := lib.FileExists(src); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("file %s not found", srcKey)
+	}
+
+	dst := filepath.Join(s.Path, dstKey)
+	if err := lib.CreateDirectory(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	err := s.commitVersion(dstKey, func() error {
+		return os.Rename(src, dst)
+	})
+	if err != nil {
+		return err
+	}
+	defer s.removeEmptyDirectories(filepath.Dir(src))
+
+	if err := lib.CreateDirectory(filepath.Dir(s.metadataPath(dstKey))); err != nil {
+		return err
+	}
+	if err := os.Rename(s.metadataPath(srcKey), s.metadataPath(dstKey)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskStore) Copy(srcKey, dstKey, owner string) error {
+	if err := store.CheckKey(srcKey); err != nil {
+		return err
+	}
+	if err := store.CheckKey(dstKey); err != nil {
+		return err
+	}
+
+	src := filepath.Join(s.Path, srcKey)
+	if exists, err := lib.FileExists(src); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("file %s not found", srcKey)
+	}
+	metadata, err := s.readMetadata(srcKey)
+	if err != nil {
+		return err
+	}
+	if owner != "" {
+		if metadata == nil {
+			metadata = &store.ObjectMetadata{}
+		}
+		metadata.Owner = owner
+	}
+
+	dst := filepath.Join(s.Path, dstKey)
+	if err := lib.CreateDirectory(filepath.Dir(dst)); err != nil {
+		return err
+	}
+
+	// the files are never modified in place, so the copy can share the content of the source through a hard link.
+	// Versioned copies get their own content instead, since versions are identified by their modification time.
+	tempName := ""
+	if !s.versioned(dstKey) {
+		tempName, err = lib.LinkTempFile(s.tempPath(), src)
+	}
+	if tempName == "" {
+		file, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		tempName, err = lib.WriteTempFile(s.tempPath(), file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	defer os.Remove(tempName)
+
+	err = s.commitVersion(dstKey, func() error {
+		return lib.CommitFile(tempName, dst)
+	})
+	if err != nil {
+		return err
+	}
+	return s.writeMetadata(dstKey, metadata)
+}
+
+func (s *DiskStore) SetMetadata(fileName string, metadata *store.ObjectMetadata) error {
+	if err := store.CheckKey(fileName); err != nil {
+		return err
+	}
+
+	if exists, err := lib.FileExists(filepath.Join(s.Path, fileName)); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("file %s not found", fileName)
+	}
+	return s.writeMetadata(fileName, metadata)
+}
@@ -0,0 +1,97 @@
+package diskstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/bogdanrat/web-server/service/storage/lib"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// metadataDirectory holds a sidecar json file for every stored object, mirroring the objects' paths
+	metadataDirectory = ".metadata"
+	metadataExtension = ".json"
+)
+
+func (s *DiskStore) metadataPath(fileName string) string {
+	return filepath.Join(s.Path, metadataDirectory, fileName+metadataExtension)
+}
+
+func (s *DiskStore) writeMetadata(fileName string, metadata *store.ObjectMetadata) error {
+	name := s.metadataPath(fileName)
+	if err := lib.CreateDirectory(filepath.Dir(name)); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return lib.WriteFileAtomic(s.tempPath(), name, bytes.NewReader(data))
+}
+
+// GetMetadata returns the metadata of the file, or of one of its archived versions
+func (s *DiskStore) GetMetadata(fileName string, versionID ...string) (*store.ObjectMetadata, error) {
+	if err := store.CheckKey(fileName); err != nil {
+		return nil, err
+	}
+
+	if len(versionID) == 1 && versionID[0] != "" {
+		if !validVersionID(versionID[0]) {
+			return nil, store.ErrVersionNotFound
+		}
+		isCurrent, err := s.isCurrentVersion(fileName, versionID[0])
+		if err != nil {
+			return nil, err
+		}
+		if !isCurrent {
+			name := s.versionPath(fileName, versionID[0])
+			if exists, err := lib.FileExists(name); err != nil {
+				return nil, err
+			} else if !exists {
+				return nil, store.ErrVersionNotFound
+			}
+			return readMetadataFile(name+metadataExtension, fileName)
+		}
+	}
+
+	if exists, err := lib.FileExists(filepath.Join(s.Path, fileName)); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, fmt.Errorf("file %s not found", fileName)
+	}
+	return s.readMetadata(fileName)
+}
+
+// readMetadata returns the object's metadata, guessing the content type from the extension if no sidecar file exists
+func (s *DiskStore) readMetadata(fileName string) (*store.ObjectMetadata, error) {
+	return readMetadataFile(s.metadataPath(fileName), fileName)
+}
+
+func readMetadataFile(metadataPath, fileName string) (*store.ObjectMetadata, error) {
+	metadata := &store.ObjectMetadata{}
+
+	data, err := ioutil.ReadFile(metadataPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	if metadata.ContentType == "" {
+		metadata.ContentType = mime.TypeByExtension(filepath.Ext(fileName))
+	}
+	return metadata, nil
+}
+
+func (s *DiskStore) deleteMetadata(fileName string) error {
+	return lib.TryRemoveFile(s.metadataPath(fileName))
+}
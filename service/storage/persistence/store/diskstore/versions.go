@@ -0,0 +1,306 @@
+package diskstore
+
+import (
+	"fmt"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/lib"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// versionsDirectory holds the previous versions of every object, under <versions>/<key>/<version id>
+	versionsDirectory = ".versions"
+)
+
+// versioned checks whether the previous versions of the file are kept; hidden files, such as the trashed ones, are not versioned
+func (s *DiskStore) versioned(fileName string) bool {
+	return s.Versioning && !store.IsHidden(fileName)
+}
+
+// versionID identifies a version by its modification time, which is preserved when the version is archived.
+// commitVersion keeps the modification times of the versions of a file distinct.
+func versionID(fileInfo os.FileInfo) string {
+	return strconv.FormatInt(fileInfo.ModTime().UnixNano(), 10)
+}
+
+// validVersionID checks the version id before it is used as a path segment
+func validVersionID(id string) bool {
+	_, err := strconv.ParseInt(id, 10, 64)
+	return err == nil
+}
+
+func (s *DiskStore) versionsPath(fileName string) string {
+	return filepath.Join(s.Path, versionsDirectory, fileName)
+}
+
+func (s *DiskStore) versionPath(fileName, versionID string) string {
+	return filepath.Join(s.versionsPath(fileName), versionID)
+}
+
+// currentVersion returns the file info of the current version, or nil if the file does not exist
+func (s *DiskStore) currentVersion(fileName string) (os.FileInfo, error) {
+	fileInfo, err := os.Stat(filepath.Join(s.Path, fileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return fileInfo, nil
+}
+
+// commitVersion archives the current version of the file, if versioned, then commits the new one, whose modification
+// time is moved past the newest archived version: versions written within the clock's resolution, or a moved file
+// older than the versions it replaces, would otherwise share or reorder their ids
+func (s *DiskStore) commitVersion(fileName string, commit func() error) error {
+	if !s.versioned(fileName) {
+		return commit()
+	}
+
+	s.versionMutex.Lock()
+	defer s.versionMutex.Unlock()
+
+	if err := s.archiveCurrentVersion(fileName); err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+
+	ids, err := s.archivedVersions(fileName)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	newest, _ := strconv.ParseInt(ids[0], 10, 64)
+
+	name := filepath.Join(s.Path, fileName)
+	current, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if current.ModTime().UnixNano() > newest {
+		return nil
+	}
+	stamp := time.Unix(0, newest+1)
+	return os.Chtimes(name, stamp, stamp)
+}
+
+// archiveCurrentVersion moves the current version of the file, along with its metadata, to the versions directory
+func (s *DiskStore) archiveCurrentVersion(fileName string) error {
+	current, err := s.currentVersion(fileName)
+	if err != nil || current == nil {
+		return err
+	}
+
+	if err = lib.CreateDirectory(s.versionsPath(fileName)); err != nil {
+		return err
+	}
+	// the versions archived before the ids were kept distinct may still collide
+	id := versionID(current)
+	for {
+		exists, err := lib.FileExists(s.versionPath(fileName, id))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			break
+		}
+		next, _ := strconv.ParseInt(id, 10, 64)
+		id = strconv.FormatInt(next+1, 10)
+	}
+	if err = os.Rename(filepath.Join(s.Path, fileName), s.versionPath(fileName, id)); err != nil {
+		return fmt.Errorf("cannot archive %s: %s", fileName, err)
+	}
+	if err = os.Rename(s.metadataPath(fileName), s.versionPath(fileName, id)+metadataExtension); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot archive metadata of %s: %s", fileName, err)
+	}
+	return nil
+}
+
+// archivedVersions returns the ids of the archived versions, newest first
+func (s *DiskStore) archivedVersions(fileName string) ([]string, error) {
+	entries, err := os.ReadDir(s.versionsPath(fileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), metadataExtension) {
+			continue
+		}
+		ids = append(ids, entry.Name())
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		first, _ := strconv.ParseInt(ids[i], 10, 64)
+		second, _ := strconv.ParseInt(ids[j], 10, 64)
+		return first > second
+	})
+	return ids, nil
+}
+
+func (s *DiskStore) ListVersions(fileName string) ([]*pb.ObjectVersion, error) {
+	if err := store.CheckKey(fileName); err != nil {
+		return nil, err
+	}
+
+	versions := make([]*pb.ObjectVersion, 0)
+
+	current, err := s.currentVersion(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		versions = append(versions, &pb.ObjectVersion{
+			Key:          fileName,
+			VersionId:    versionID(current),
+			LastModified: current.ModTime().Format(time.RFC3339),
+			Size:         uint64(current.Size()),
+			IsLatest:     true,
+		})
+	}
+
+	ids, err := s.archivedVersions(fileName)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		fileInfo, err := os.Stat(s.versionPath(fileName, id))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, &pb.ObjectVersion{
+			Key:          fileName,
+			VersionId:    id,
+			LastModified: fileInfo.ModTime().Format(time.RFC3339),
+			Size:         uint64(fileInfo.Size()),
+		})
+	}
+
+	return versions, nil
+}
+
+func (s *DiskStore) GetVersion(fileName, versionID string, writer io.Writer) error {
+	file, err := s.openVersion(fileName, versionID)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+func (s *DiskStore) RestoreVersion(fileName, versionID string) error {
+	if err := store.CheckKey(fileName); err != nil {
+		return err
+	}
+	if isCurrent, err := s.isCurrentVersion(fileName, versionID); err != nil || isCurrent {
+		return err
+	}
+
+	file, err := s.openVersion(fileName, versionID)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	metadata, err := readMetadataFile(s.versionPath(fileName, versionID)+metadataExtension, fileName)
+	if err != nil {
+		return err
+	}
+
+	// the restored copy becomes the new current version
+	return s.Put(fileName, file, metadata)
+}
+
+func (s *DiskStore) DeleteVersion(fileName, versionID string) error {
+	if err := store.CheckKey(fileName); err != nil {
+		return err
+	}
+	if !validVersionID(versionID) {
+		return store.ErrVersionNotFound
+	}
+
+	isCurrent, err := s.isCurrentVersion(fileName, versionID)
+	if err != nil {
+		return err
+	}
+
+	if !isCurrent {
+		name := s.versionPath(fileName, versionID)
+		if exists, err := lib.FileExists(name); err != nil {
+			return err
+		} else if !exists {
+			return store.ErrVersionNotFound
+		}
+		if err = lib.TryRemoveFile(name); err != nil {
+			return err
+		}
+		return lib.TryRemoveFile(name + metadataExtension)
+	}
+
+	if err = lib.TryRemoveFile(filepath.Join(s.Path, fileName)); err != nil {
+		return err
+	}
+	if err = s.deleteMetadata(fileName); err != nil {
+		return err
+	}
+
+	// the newest archived version becomes the current version
+	ids, err := s.archivedVersions(fileName)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	if err = os.Rename(s.versionPath(fileName, ids[0]), filepath.Join(s.Path, fileName)); err != nil {
+		return err
+	}
+	if err = os.Rename(s.versionPath(fileName, ids[0])+metadataExtension, s.metadataPath(fileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskStore) isCurrentVersion(fileName, id string) (bool, error) {
+	current, err := s.currentVersion(fileName)
+	if err != nil || current == nil {
+		return false, err
+	}
+	return versionID(current) == id, nil
+}
+
+func (s *DiskStore) openVersion(fileName, versionID string) (*os.File, error) {
+	if err := store.CheckKey(fileName); err != nil {
+		return nil, err
+	}
+	if !validVersionID(versionID) {
+		return nil, store.ErrVersionNotFound
+	}
+
+	name := s.versionPath(fileName, versionID)
+	if isCurrent, err := s.isCurrentVersion(fileName, versionID); err != nil {
+		return nil, err
+	} else if isCurrent {
+		name = filepath.Join(s.Path, fileName)
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, store.ErrVersionNotFound
+		}
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// maxKeyLength is the longest key accepted by S3
+const maxKeyLength = 1024
+
+var ErrInvalidKey = errors.New("invalid object key")
+
+// NormalizeKey validates a key received from a client and returns its canonical form: slash separated, without
+// leading slashes, dot segments or duplicate separators. The segments reserved to the service (e.g. .trash) are
+// rejected, see IsHidden.
+func NormalizeKey(key string) (string, error) {
+	if len(key) > maxKeyLength || strings.IndexFunc(key, unicode.IsControl) != -1 {
+		return "", ErrInvalidKey
+	}
+
+	key = strings.TrimLeft(strings.ReplaceAll(key, "\\", "/"), "/")
+	if key == "" {
+		return "", ErrInvalidKey
+	}
+
+	key = path.Clean(key)
+	for _, segment := range strings.Split(key, "/") {
+		// "." is left by Clean only for an empty key, ".." only for the segments escaping the store's root
+		if segment == "." || segment == ".." || reservedNames[segment] {
+			return "", ErrInvalidKey
+		}
+	}
+	return key, nil
+}
+
+// NormalizePrefix is NormalizeKey for prefixes: the empty prefix is allowed and a trailing slash is kept
+func NormalizePrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+
+	normalized, err := NormalizeKey(prefix)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(prefix, "/") {
+		normalized += "/"
+	}
+	return normalized, nil
+}
+
+// CheckKey verifies that a key, joined to a directory, cannot point outside of it.
+// Unlike NormalizeKey, it accepts the keys used internally, such as the trashed objects' keys.
+func CheckKey(key string) error {
+	if key == "" || strings.ContainsRune(key, 0) || filepath.IsAbs(key) || path.IsAbs(key) {
+		return ErrInvalidKey
+	}
+	for _, segment := range strings.FieldsFunc(key, func(r rune) bool { return r == '/' || r == filepath.Separator }) {
+		if segment == ".." {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
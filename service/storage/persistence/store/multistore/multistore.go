@@ -0,0 +1,413 @@
+package multistore
+
+import (
+	"fmt"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"hash/fnv"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ColdStorageClass is the storage class of the objects in the cold tier, unless their engine reports its own
+const ColdStorageClass = "COLD"
+
+// lockStripes is the number of locks serializing the changes to the keys, shared by the keys with the same hash
+const lockStripes = 64
+
+// MultiStore composes storage engines. The objects are written to the primary, then replicated asynchronously to the
+// secondaries, which serve the reads when the primary cannot. The objects older than the tier age move from the primary
+// to the cold tier, from which they are read until overwritten; their previous versions stay in the primary.
+type MultiStore struct {
+	Primary     store.Store
+	Secondaries []store.Store
+	// Cold is nil if tiering is disabled
+	Cold              store.Store
+	TierAge           time.Duration
+	TierInterval      time.Duration
+	ReconcileInterval time.Duration
+
+	replications chan *replication
+	locks        [lockStripes]sync.Mutex
+
+	// the secondaries lag behind the tiers by the changes waiting for replication, or dropped until the reconciliation
+	mutex     sync.Mutex
+	pending   map[string]int
+	deletions int
+	diverged  bool
+}
+
+func New(primary store.Store, secondaries []store.Store, cold store.Store, multiConfig config.MultiStorageConfig) store.Store {
+	return &MultiStore{
+		Primary:           primary,
+		Secondaries:       secondaries,
+		Cold:              cold,
+		TierAge:           time.Second * time.Duration(multiConfig.TierAge),
+		TierInterval:      time.Second * time.Duration(multiConfig.TierInterval),
+		ReconcileInterval: time.Second * time.Duration(multiConfig.ReconcileInterval),
+		replications:      make(chan *replication, multiConfig.ReplicationQueueSize),
+		pending:           make(map[string]int),
+	}
+}
+
+func (s *MultiStore) Init() error {
+	for _, storage := range s.stores() {
+		if err := storage.Init(); err != nil {
+			return err
+		}
+	}
+
+	if len(s.Secondaries) > 0 {
+		s.startReplication()
+		if s.ReconcileInterval > 0 {
+			s.startReconciliation()
+		}
+	}
+	if s.Cold != nil && s.TierAge > 0 && s.TierInterval > 0 {
+		s.startTiering()
+	}
+
+	log.Printf("Initialized Multi Storage Engine with %d secondaries\n", len(s.Secondaries))
+	return nil
+}
+
+func (s *MultiStore) stores() []store.Store {
+	stores := []store.Store{s.Primary}
+	if s.Cold != nil {
+		stores = append(stores, s.Cold)
+	}
+	return append(stores, s.Secondaries...)
+}
+
+// lock serializes the changes to the keys with the tiering and the reconciliation, and returns the unlocking function
+func (s *MultiStore) lock(keys ...string) func() {
+	stripes := make([]int, 0, len(keys))
+	locked := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(key))
+		stripe := int(hash.Sum32() % lockStripes)
+		if !locked[stripe] {
+			locked[stripe] = true
+			stripes = append(stripes, stripe)
+		}
+	}
+	// always locking in the same order avoids deadlocks
+	sort.Ints(stripes)
+
+	for _, stripe := range stripes {
+		s.locks[stripe].Lock()
+	}
+	return func() {
+		for _, stripe := range stripes {
+			s.locks[stripe].Unlock()
+		}
+	}
+}
+
+// lockAll serializes a change to any key, e.g. deleting a prefix
+func (s *MultiStore) lockAll() func() {
+	for i := range s.locks {
+		s.locks[i].Lock()
+	}
+	return func() {
+		for i := range s.locks {
+			s.locks[i].Unlock()
+		}
+	}
+}
+
+// holds reports whether the engine holds the current version of the object
+func holds(storage store.Store, key string) bool {
+	if storage == nil {
+		return false
+	}
+	_, err := storage.GetMetadata(key)
+	return err == nil
+}
+
+// read reads the object from the tier holding it, or from a secondary holding it if it is up to date,
+// e.g. if the primary is unavailable
+func (s *MultiStore) read(key string, read func(store.Store) error) error {
+	if holds(s.Primary, key) {
+		return read(s.Primary)
+	}
+	if holds(s.Cold, key) {
+		return read(s.Cold)
+	}
+	if s.replicated(key) {
+		for _, secondary := range s.Secondaries {
+			if holds(secondary, key) {
+				return read(secondary)
+			}
+		}
+	}
+	return fmt.Errorf("file %s not found", key)
+}
+
+// clearCold deletes the object from the cold tier, once it was written to the primary
+func (s *MultiStore) clearCold(key string) error {
+	if !holds(s.Cold, key) {
+		return nil
+	}
+	return s.Cold.Delete(key)
+}
+
+// warm copies an object from the cold tier to the primary, where all the changes are made
+func (s *MultiStore) warm(key string) error {
+	if holds(s.Primary, key) || !holds(s.Cold, key) {
+		return nil
+	}
+	return transfer(s.Cold, key, s.Primary, key)
+}
+
+// transfer copies the object and its metadata from an engine to another, under the destination key
+func transfer(src store.Store, srcKey string, dst store.Store, dstKey string) error {
+	return transferAs(src, srcKey, dst, dstKey, "")
+}
+
+// transferAs writes the object to the destination, owned by the owner unless empty
+func transferAs(src store.Store, srcKey string, dst store.Store, dstKey string, owner string) error {
+	metadata, err := src.GetMetadata(srcKey)
+	if err != nil {
+		return err
+	}
+	if owner != "" {
+		if metadata == nil {
+			metadata = &store.ObjectMetadata{}
+		}
+		metadata.Owner = owner
+	}
+
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	go func() {
+		writer.CloseWithError(src.Get(srcKey, writer))
+	}()
+
+	return dst.Put(dstKey, reader, metadata)
+}
+
+func (s *MultiStore) Put(key string, body io.Reader, metadata *store.ObjectMetadata) error {
+	unlock := s.lock(key)
+	defer unlock()
+
+	if err := s.Primary.Put(key, body, metadata); err != nil {
+		return err
+	}
+	defer s.replicate(key)
+	return s.clearCold(key)
+}
+
+func (s *MultiStore) Get(key string, writer io.Writer) error {
+	return s.read(key, func(storage store.Store) error {
+		return storage.Get(key, writer)
+	})
+}
+
+// GetAll and List merge the tiers, falling back to the secondaries if the primary cannot list its objects
+
+func (s *MultiStore) GetAll(prefix ...string) ([]*pb.StorageObject, error) {
+	objects, err := s.Primary.GetAll(prefix...)
+	if err != nil {
+		for _, secondary := range s.Secondaries {
+			if objects, secondaryErr := secondary.GetAll(prefix...); secondaryErr == nil {
+				return objects, nil
+			}
+		}
+		return nil, err
+	}
+	if s.Cold == nil {
+		return objects, nil
+	}
+
+	cold, err := s.Cold.GetAll(prefix...)
+	if err != nil {
+		return nil, err
+	}
+	return mergeObjects(objects, cold), nil
+}
+
+func (s *MultiStore) List(prefix string) (*store.Listing, error) {
+	listing, err := s.Primary.List(prefix)
+	if err != nil {
+		for _, secondary := range s.Secondaries {
+			if listing, secondaryErr := secondary.List(prefix); secondaryErr == nil {
+				return listing, nil
+			}
+		}
+		return nil, err
+	}
+	if s.Cold == nil {
+		return listing, nil
+	}
+
+	cold, err := s.Cold.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	listing.Objects = mergeObjects(listing.Objects, cold.Objects)
+	prefixes := make(map[string]bool, len(listing.Prefixes))
+	for _, folder := range listing.Prefixes {
+		prefixes[folder] = true
+	}
+	for _, folder := range cold.Prefixes {
+		if !prefixes[folder] {
+			listing.Prefixes = append(listing.Prefixes, folder)
+		}
+	}
+	sort.Strings(listing.Prefixes)
+	return listing, nil
+}
+
+// mergeObjects adds the cold objects to the primary's, sorted by key. An object in both tiers is read from the primary.
+func mergeObjects(objects, cold []*pb.StorageObject) []*pb.StorageObject {
+	keys := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		keys[object.GetKey()] = true
+	}
+	for _, object := range cold {
+		if keys[object.GetKey()] {
+			continue
+		}
+		if object.StorageClass == "" {
+			object.StorageClass = ColdStorageClass
+		}
+		objects = append(objects, object)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects
+}
+
+func (s *MultiStore) Delete(key string) error {
+	unlock := s.lock(key)
+	defer unlock()
+	defer s.replicate(key)
+
+	if err := s.Primary.Delete(key); err != nil {
+		return err
+	}
+	return s.clearCold(key)
+}
+
+func (s *MultiStore) DeleteAll(prefix ...string) error {
+	unlock := s.lockAll()
+	defer unlock()
+	defer s.replicateDeletion(prefix...)
+
+	if err := s.Primary.DeleteAll(prefix...); err != nil {
+		return err
+	}
+	if s.Cold != nil {
+		return s.Cold.DeleteAll(prefix...)
+	}
+	return nil
+}
+
+func (s *MultiStore) Move(srcKey, dstKey string) error {
+	unlock := s.lock(srcKey, dstKey)
+	defer unlock()
+
+	if err := s.warm(srcKey); err != nil {
+		return err
+	}
+	if err := s.Primary.Move(srcKey, dstKey); err != nil {
+		return err
+	}
+	defer s.replicate(srcKey, dstKey)
+
+	if err := s.clearCold(srcKey); err != nil {
+		return err
+	}
+	return s.clearCold(dstKey)
+}
+
+func (s *MultiStore) Copy(srcKey, dstKey, owner string) error {
+	unlock := s.lock(srcKey, dstKey)
+	defer unlock()
+
+	if holds(s.Primary, srcKey) {
+		if err := s.Primary.Copy(srcKey, dstKey, owner); err != nil {
+			return err
+		}
+	} else if holds(s.Cold, srcKey) {
+		// the copy is a new object, written to the primary
+		if err := transferAs(s.Cold, srcKey, s.Primary, dstKey, owner); err != nil {
+			return err
+		}
+	} else {
+		return fmt.Errorf("file %s not found", srcKey)
+	}
+	defer s.replicate(dstKey)
+
+	return s.clearCold(dstKey)
+}
+
+func (s *MultiStore) SetMetadata(key string, metadata *store.ObjectMetadata) error {
+	unlock := s.lock(key)
+	defer unlock()
+
+	storage := s.Primary
+	if !holds(s.Primary, key) && holds(s.Cold, key) {
+		storage = s.Cold
+	}
+	if err := storage.SetMetadata(key, metadata); err != nil {
+		return err
+	}
+	s.replicate(key)
+	return nil
+}
+
+func (s *MultiStore) GetMetadata(key string, versionID ...string) (*store.ObjectMetadata, error) {
+	if len(versionID) == 1 && versionID[0] != "" {
+		return s.Primary.GetMetadata(key, versionID...)
+	}
+
+	var metadata *store.ObjectMetadata
+	err := s.read(key, func(storage store.Store) error {
+		var err error
+		metadata, err = storage.GetMetadata(key)
+		return err
+	})
+	return metadata, err
+}
+
+// The previous versions are kept by the primary only
+
+func (s *MultiStore) ListVersions(key string) ([]*pb.ObjectVersion, error) {
+	return s.Primary.ListVersions(key)
+}
+
+func (s *MultiStore) GetVersion(key, versionID string, writer io.Writer) error {
+	return s.Primary.GetVersion(key, versionID, writer)
+}
+
+func (s *MultiStore) RestoreVersion(key, versionID string) error {
+	unlock := s.lock(key)
+	defer unlock()
+
+	if err := s.Primary.RestoreVersion(key, versionID); err != nil {
+		return err
+	}
+	defer s.replicate(key)
+	return s.clearCold(key)
+}
+
+func (s *MultiStore) DeleteVersion(key, versionID string) error {
+	unlock := s.lock(key)
+	defer unlock()
+
+	if err := s.Primary.DeleteVersion(key, versionID); err != nil {
+		return err
+	}
+	s.replicate(key)
+	return nil
+}
@@ -0,0 +1,239 @@
+package multistore
+
+import (
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"log"
+	"time"
+)
+
+// replication is a change to apply to the secondaries: the keys are copied from the tier holding them, or deleted if
+// no tier does, and the prefixes of a deletion are deleted
+type replication struct {
+	keys     []string
+	deletion bool
+	prefix   []string
+}
+
+// replicate queues the keys for replication. The changes are dropped when the queue is full, until the reconciliation.
+func (s *MultiStore) replicate(keys ...string) {
+	s.enqueue(&replication{keys: keys})
+}
+
+func (s *MultiStore) replicateDeletion(prefix ...string) {
+	s.enqueue(&replication{deletion: true, prefix: prefix})
+}
+
+func (s *MultiStore) enqueue(change *replication) {
+	if len(s.Secondaries) == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case s.replications <- change:
+		s.track(change, 1)
+	default:
+		s.diverged = true
+		log.Println("replication queue full, the change is left to the reconciliation")
+	}
+}
+
+// track counts the changes waiting for replication, s.mutex must be held
+func (s *MultiStore) track(change *replication, delta int) {
+	if change.deletion {
+		s.deletions += delta
+		return
+	}
+	for _, key := range change.keys {
+		s.pending[key] += delta
+		if s.pending[key] == 0 {
+			delete(s.pending, key)
+		}
+	}
+}
+
+// replicated reports whether the secondaries are up to date with the changes made to the object
+func (s *MultiStore) replicated(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.diverged && s.deletions == 0 && s.pending[key] == 0
+}
+
+// startReplication applies the changes in order, with a single worker. A failed change is left to the reconciliation.
+func (s *MultiStore) startReplication() {
+	go func() {
+		for change := range s.replications {
+			failed := false
+			for _, secondary := range s.Secondaries {
+				if err := s.apply(secondary, change); err != nil {
+					log.Printf("could not replicate: %s\n", err)
+					failed = true
+				}
+			}
+
+			s.mutex.Lock()
+			s.track(change, -1)
+			s.diverged = s.diverged || failed
+			s.mutex.Unlock()
+		}
+	}()
+}
+
+func (s *MultiStore) apply(secondary store.Store, change *replication) error {
+	if change.deletion {
+		return secondary.DeleteAll(change.prefix...)
+	}
+	for _, key := range change.keys {
+		if err := s.sync(secondary, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sync makes the secondary hold the current version of the object, or delete it
+func (s *MultiStore) sync(secondary store.Store, key string) error {
+	if holds(s.Primary, key) {
+		return transfer(s.Primary, key, secondary, key)
+	}
+	if holds(s.Cold, key) {
+		return transfer(s.Cold, key, secondary, key)
+	}
+	if holds(secondary, key) {
+		return secondary.Delete(key)
+	}
+	return nil
+}
+
+func (s *MultiStore) startReconciliation() {
+	ticker := time.NewTicker(s.ReconcileInterval)
+
+	go func() {
+		for range ticker.C {
+			repaired, err := s.Reconcile()
+			if err != nil {
+				log.Printf("could not reconcile: %s\n", err)
+			}
+			if repaired > 0 {
+				log.Printf("Repaired %d diverging objects\n", repaired)
+			}
+		}
+	}()
+}
+
+// Reconcile repairs the divergence of the engines, e.g. the changes dropped or failed by the replication: the objects in
+// both tiers are deleted from the cold tier, and the secondaries are made to hold the objects of the tiers.
+func (s *MultiStore) Reconcile() (int, error) {
+	// the changes made from now on are either replicated or repaired
+	s.mutex.Lock()
+	diverged := s.diverged
+	s.diverged = false
+	s.mutex.Unlock()
+
+	repaired, err := s.reconcile()
+	if err != nil {
+		s.mutex.Lock()
+		s.diverged = s.diverged || diverged
+		s.mutex.Unlock()
+	}
+	return repaired, err
+}
+
+func (s *MultiStore) reconcile() (int, error) {
+	objects, err := allObjects(s.Primary)
+	if err != nil {
+		return 0, err
+	}
+
+	repaired := 0
+	if s.Cold != nil {
+		cold, err := allObjects(s.Cold)
+		if err != nil {
+			return repaired, err
+		}
+		for key, object := range cold {
+			if _, ok := objects[key]; !ok {
+				objects[key] = object
+				continue
+			}
+			if err = s.repair(key, func() error { return s.clearCold(key) }); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+
+	for _, secondary := range s.Secondaries {
+		replicas, err := allObjects(secondary)
+		if err != nil {
+			return repaired, err
+		}
+
+		for key, object := range objects {
+			if replica, ok := replicas[key]; ok && !diverges(object, replica) {
+				continue
+			}
+			if err = s.repair(key, func() error { return s.sync(secondary, key) }); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+		for key := range replicas {
+			if _, ok := objects[key]; ok {
+				continue
+			}
+			if err = s.repair(key, func() error { return s.sync(secondary, key) }); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+
+	return repaired, nil
+}
+
+// repair applies a repair to the key, which may have changed since it was listed
+func (s *MultiStore) repair(key string, repair func() error) error {
+	unlock := s.lock(key)
+	defer unlock()
+	return repair()
+}
+
+// diverges compares the objects by checksum, or by size if an engine does not report checksums
+func diverges(object, replica *pb.StorageObject) bool {
+	if object.GetSha256() != "" && replica.GetSha256() != "" {
+		return object.GetSha256() != replica.GetSha256()
+	}
+	return object.GetSize() != replica.GetSize()
+}
+
+// allObjects returns all objects of the engine by key, including the hidden ones, e.g. the trash and the folder markers.
+// GetAll without a prefix leaves the hidden objects out, while GetAll with a prefix returns all objects under it.
+func allObjects(storage store.Store) (map[string]*pb.StorageObject, error) {
+	listing, err := storage.List("")
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := storage.GetAll(".")
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[string]*pb.StorageObject)
+	for _, object := range append(listing.Objects, hidden...) {
+		objects[object.GetKey()] = object
+	}
+	for _, folder := range listing.Prefixes {
+		folderObjects, err := storage.GetAll(folder)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range folderObjects {
+			objects[object.GetKey()] = object
+		}
+	}
+	return objects, nil
+}
@@ -0,0 +1,79 @@
+package multistore
+
+import (
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"log"
+	"time"
+)
+
+func (s *MultiStore) startTiering() {
+	ticker := time.NewTicker(s.TierInterval)
+
+	go func() {
+		for range ticker.C {
+			tiered, err := s.Tier()
+			if err != nil {
+				log.Printf("could not tier objects: %s\n", err)
+			}
+			if tiered > 0 {
+				log.Printf("Moved %d objects to the cold tier\n", tiered)
+			}
+		}
+	}()
+}
+
+// Tier moves the objects last modified before the tier age from the primary to the cold tier.
+// The hidden objects, e.g. the trashed ones, stay in the primary.
+func (s *MultiStore) Tier() (int, error) {
+	objects, err := allObjects(s.Primary)
+	if err != nil {
+		return 0, err
+	}
+
+	threshold := time.Now().Add(-s.TierAge)
+	tiered := 0
+	for key, object := range objects {
+		if store.IsHidden(key) {
+			continue
+		}
+		lastModified, err := time.Parse(time.RFC3339, object.GetLastModified())
+		if err != nil || lastModified.After(threshold) {
+			continue
+		}
+
+		moved, err := s.tier(key, object.GetLastModified())
+		if err != nil {
+			return tiered, err
+		}
+		if moved {
+			tiered++
+		}
+	}
+	return tiered, nil
+}
+
+// tier moves the object to the cold tier, unless it was modified since it was listed
+func (s *MultiStore) tier(key, lastModified string) (bool, error) {
+	unlock := s.lock(key)
+	defer unlock()
+
+	objects, err := s.Primary.GetAll(key)
+	if err != nil {
+		return false, err
+	}
+	current := false
+	for _, object := range objects {
+		if object.GetKey() == key {
+			current = object.GetLastModified() == lastModified
+			break
+		}
+	}
+	if !current {
+		return false, nil
+	}
+
+	if err = transfer(s.Primary, key, s.Cold, key); err != nil {
+		return false, err
+	}
+	return true, s.Primary.Delete(key)
+}
@@ -0,0 +1,441 @@
+// Package s3fake serves an in-memory S3 API over HTTP, so that the S3 store can be exercised offline through the sdk.
+// It covers the operations used by the store, except versioning, and does not check the request signatures.
+package s3fake
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metadataHeaderPrefix = "X-Amz-Meta-"
+	// defaultPageSize is the number of keys listed at once, as on S3
+	defaultPageSize = 1000
+)
+
+type object struct {
+	body         []byte
+	contentType  string
+	metadata     map[string]string
+	lastModified time.Time
+}
+
+func (o *object) etag() string {
+	sum := md5.Sum(o.body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Server holds the buckets, to be addressed by path, e.g. http://127.0.0.1:1234/bucket/key
+type Server struct {
+	*httptest.Server
+	// PageSize bounds the keys listed at once, so that the pagination can be exercised with a few objects
+	PageSize int
+
+	mutex   sync.Mutex
+	buckets map[string]map[string]*object
+	uploads map[string]*upload
+	nextID  int
+}
+
+// NewServer starts a server, to be closed by the caller
+func NewServer() *Server {
+	s := &Server{
+		PageSize: defaultPageSize,
+		buckets:  make(map[string]map[string]*object),
+		uploads:  make(map[string]*upload),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucketName, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucketName, key = path[:i], path[i+1:]
+	}
+	query := r.URL.Query()
+
+	if key == "" {
+		s.serveBucket(w, r, bucketName, query)
+		return
+	}
+
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && has(query, "uploads"):
+		s.createUpload(w, r, bucketName, key)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		s.uploadPart(w, r, query)
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		s.completeUpload(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copyObject(w, r, bucket, key)
+	case r.Method == http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		stored := newObject(body, r.Header)
+		bucket[key] = stored
+		w.Header().Set("ETag", stored.etag())
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		stored, ok := bucket[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		writeHeaders(w, stored)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(stored.body)
+		}
+	case r.Method == http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *Server) serveBucket(w http.ResponseWriter, r *http.Request, bucketName string, query url.Values) {
+	bucket, ok := s.buckets[bucketName]
+	if !ok && r.Method != http.MethodPut {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPut && has(query, "versioning"):
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	case r.Method == http.MethodPut:
+		if ok {
+			writeError(w, http.StatusConflict, "BucketAlreadyOwnedByYou")
+			return
+		}
+		s.buckets[bucketName] = make(map[string]*object)
+		w.Header().Set("Location", "/"+bucketName)
+	case r.Method == http.MethodHead:
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		s.listObjects(w, bucketName, bucket, query, query.Get("continuation-token"), true)
+	case r.Method == http.MethodGet:
+		s.listObjects(w, bucketName, bucket, query, query.Get("marker"), false)
+	case r.Method == http.MethodPost && has(query, "delete"):
+		deleteObjects(w, r, bucket)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+type listedObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	KeyCount              int    `xml:",omitempty"`
+	IsTruncated           bool
+	NextContinuationToken string         `xml:",omitempty"`
+	NextMarker            string         `xml:",omitempty"`
+	Contents              []listedObject `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listObjects lists the keys after the marker, sorted, grouping them by the delimiter if any
+func (s *Server) listObjects(w http.ResponseWriter, bucketName string, bucket map[string]*object, query url.Values, marker string, v2 bool) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	pageSize := s.PageSize
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil && maxKeys > 0 && maxKeys < pageSize {
+		pageSize = maxKeys
+	}
+
+	keys := make([]string, 0, len(bucket))
+	for key := range bucket {
+		// a marker ending with the delimiter is a listed folder, whose keys are skipped
+		skipped := delimiter != "" && strings.HasSuffix(marker, delimiter) && strings.HasPrefix(key, marker)
+		if strings.HasPrefix(key, prefix) && key > marker && !skipped {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := &listBucketResult{Name: bucketName, Prefix: prefix, Delimiter: delimiter}
+	seen := make(map[string]bool)
+	last := ""
+	for _, key := range keys {
+		if len(result.Contents)+len(result.CommonPrefixes) == pageSize {
+			result.IsTruncated = true
+			break
+		}
+		last = key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				folder := key[:len(prefix)+i+len(delimiter)]
+				last = folder
+				if !seen[folder] {
+					seen[folder] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: folder})
+				}
+				continue
+			}
+		}
+		stored := bucket[key]
+		result.Contents = append(result.Contents, listedObject{
+			Key:          key,
+			LastModified: stored.lastModified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         stored.etag(),
+			Size:         len(stored.body),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	if result.IsTruncated {
+		if v2 {
+			result.NextContinuationToken = last
+		} else {
+			result.NextMarker = last
+		}
+	}
+	if v2 {
+		result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	}
+	writeXML(w, result)
+}
+
+type deleteRequest struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []struct {
+		Key string
+	} `xml:"Deleted"`
+}
+
+func deleteObjects(w http.ResponseWriter, r *http.Request, bucket map[string]*object) {
+	request := &deleteRequest{}
+	if err := xml.NewDecoder(r.Body).Decode(request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	result := &deleteResult{}
+	for _, deleted := range request.Objects {
+		delete(bucket, deleted.Key)
+		result.Deleted = append(result.Deleted, struct{ Key string }{Key: deleted.Key})
+	}
+	writeXML(w, result)
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string
+	LastModified string
+}
+
+// copyObject copies the source's metadata, unless the request replaces it
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, bucket map[string]*object, key string) {
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	i := strings.Index(source, "/")
+	if i < 0 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	sourceBucket, ok := s.buckets[source[:i]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	stored, ok := sourceBucket[source[i+1:]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	copied := newObject(stored.body, r.Header)
+	if !strings.EqualFold(r.Header.Get("X-Amz-Metadata-Directive"), "REPLACE") {
+		copied.contentType = stored.contentType
+		copied.metadata = stored.metadata
+	}
+	bucket[key] = copied
+
+	writeXML(w, &copyObjectResult{
+		ETag:         copied.etag(),
+		LastModified: copied.lastModified.Format("2006-01-02T15:04:05.000Z"),
+	})
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+// upload is a multipart upload, with the headers of its creation, which hold the object's metadata
+type upload struct {
+	header http.Header
+	parts  map[int][]byte
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, bucketName, key string) {
+	s.nextID++
+	uploadID := strconv.Itoa(s.nextID)
+	s.uploads[uploadID] = &upload{header: r.Header, parts: make(map[int][]byte)}
+
+	writeXML(w, &initiateMultipartUploadResult{Bucket: bucketName, Key: key, UploadId: uploadID})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values) {
+	pending, ok := s.uploads[query.Get("uploadId")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	pending.parts[number] = body
+	sum := md5.Sum(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Key     string
+	ETag    string
+}
+
+// completeUpload joins the parts into the object
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, bucket map[string]*object, key, uploadID string) {
+	pending, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	request := &completeMultipartUpload{}
+	if err := xml.NewDecoder(r.Body).Decode(request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	body := &bytes.Buffer{}
+	for _, part := range request.Parts {
+		data, ok := pending.parts[part.PartNumber]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		body.Write(data)
+	}
+	delete(s.uploads, uploadID)
+
+	stored := newObject(body.Bytes(), pending.header)
+	bucket[key] = stored
+	writeXML(w, &completeMultipartUploadResult{Key: key, ETag: stored.etag()})
+}
+
+// has reports whether the query has the parameter, e.g. ?uploads, which has no value
+func has(query url.Values, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
+func newObject(body []byte, header http.Header) *object {
+	stored := &object{
+		body:         body,
+		contentType:  header.Get("Content-Type"),
+		metadata:     make(map[string]string),
+		lastModified: time.Now().UTC(),
+	}
+	for name := range header {
+		if strings.HasPrefix(name, metadataHeaderPrefix) {
+			stored.metadata[name] = header.Get(name)
+		}
+	}
+	return stored
+}
+
+func writeHeaders(w http.ResponseWriter, stored *object) {
+	for name, value := range stored.metadata {
+		w.Header().Set(name, value)
+	}
+	if stored.contentType != "" {
+		w.Header().Set("Content-Type", stored.contentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(stored.body)))
+	w.Header().Set("ETag", stored.etag())
+	w.Header().Set("Last-Modified", stored.lastModified.Format(http.TimeFormat))
+}
+
+func writeXML(w http.ResponseWriter, value interface{}) {
+	body, err := xml.Marshal(value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	_, _ = fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
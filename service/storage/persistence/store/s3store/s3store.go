@@ -1,57 +1,88 @@
 package s3store
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
 	"github.com/bogdanrat/web-server/service/storage/config"
 	"github.com/bogdanrat/web-server/service/storage/persistence/store"
-	"github.com/rlmcpherson/s3gof3r"
 	"io"
 	"log"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	sha256MetadataKey = "sha256"
+	ownerMetadataKey  = "owner"
+	// encryptionMetadataKey holds the json encoded envelope of the objects encrypted at rest
+	encryptionMetadataKey = "encryption"
+	// compressionMetadataKey holds the json encoded encoding of the objects stored compressed
+	compressionMetadataKey = "compression"
+	// customMetadataPrefix keeps the user-defined metadata apart from the metadata set by the store
+	customMetadataPrefix = "custom-"
+	// headConcurrency bounds the metadata requests made at once when listing
+	headConcurrency = 16
+)
+
 type S3Store struct {
-	S3           *s3.S3
-	S3Gofer      *s3gof3r.S3 // provides fast, parallelized, streaming access to Amazon S3
-	Bucket       *s3gof3r.Bucket
-	Config       *s3gof3r.Config
-	UploaderPool sync.Pool
-	Session      *session.Session
+	// S3 is the single client of all operations, an interface so that the store can run against an in-process fake
+	S3               s3iface.S3API
+	Bucket           string
+	BucketVersioning bool
+	UploaderPool     sync.Pool
 }
 
+// New creates a store on AWS S3, or on an S3-compatible service (e.g. MinIO) if an endpoint is configured.
+// The static credentials, if configured, replace the session's.
 func New(sess *session.Session, s3Config config.S3Config) store.Store {
-	storage := &S3Store{}
-	storage.Session = sess
-	storage.S3 = s3.New(sess)
-
-	creds, _ := sess.Config.Credentials.Get()
-
-	storage.S3Gofer = s3gof3r.New(s3Config.Domain, s3gof3r.Keys{
-		AccessKey: creds.AccessKeyID,
-		SecretKey: creds.SecretAccessKey,
-	})
+	clientConfig := aws.NewConfig().
+		WithMaxRetries(s3Config.MaxAttempts - 1).
+		WithHTTPClient(&http.Client{
+			// includes connection time, any redirects, and reading the response body
+			Timeout: time.Second * time.Duration(s3Config.Timeout),
+		})
+	if s3Config.Endpoint != "" {
+		clientConfig = clientConfig.WithEndpoint(s3Config.Endpoint)
+	}
+	// S3-compatible services usually address the buckets by path, e.g. http://localhost:9000/bucket/key
+	if s3Config.ForcePathStyle {
+		clientConfig = clientConfig.WithS3ForcePathStyle(true)
+	}
+	if s3Config.AccessKeyID != "" {
+		clientConfig = clientConfig.WithCredentials(credentials.NewStaticCredentials(s3Config.AccessKeyID, s3Config.SecretAccessKey, ""))
+	}
 
-	storage.Bucket = storage.S3Gofer.Bucket(s3Config.Bucket)
+	return NewWithClient(s3.New(sess, clientConfig), s3Config)
+}
 
-	storage.Config = s3gof3r.DefaultConfig
-	storage.Config.Concurrency = s3Config.Concurrency                             // number of parts to get or put concurrently
-	storage.Config.PartSize = int64(s3Config.PartSize)                            // initial part size in bytes to use for multipart gets or put
-	storage.Config.NTry = s3Config.MaxAttempts                                    // maximum attempts for each part
-	storage.Config.Client.Timeout = time.Second * time.Duration(s3Config.Timeout) // includes connection time, any redirects, and reading the response body
+// NewWithClient creates a store using the client, e.g. a fake
+func NewWithClient(client s3iface.S3API, s3Config config.S3Config) store.Store {
+	storage := &S3Store{
+		S3:               client,
+		Bucket:           s3Config.Bucket,
+		BucketVersioning: s3Config.BucketVersioning,
+	}
 
 	storage.UploaderPool = sync.Pool{
 		New: func() interface{} {
-			uploader := s3manager.NewUploader(storage.Session)
-			// The number of goroutines to spin up in parallel per call to Upload when sending parts
-			uploader.Concurrency = s3Config.Concurrency
-			return uploader
+			return s3manager.NewUploaderWithClient(storage.S3, func(uploader *s3manager.Uploader) {
+				// The number of goroutines to spin up in parallel per call to Upload when sending parts
+				uploader.Concurrency = s3Config.Concurrency
+				if int64(s3Config.PartSize) > s3manager.MinUploadPartSize {
+					uploader.PartSize = int64(s3Config.PartSize)
+				}
+			})
 		},
 	}
 
@@ -61,7 +92,7 @@ func New(sess *session.Session, s3Config config.S3Config) store.Store {
 func (s *S3Store) Init() error {
 	_, err := s.S3.HeadBucket(
 		&s3.HeadBucketInput{
-			Bucket: aws.String(s.Bucket.Name),
+			Bucket: aws.String(s.Bucket),
 		},
 	)
 
@@ -74,7 +105,7 @@ func (s *S3Store) Init() error {
 				if err != nil {
 					return err
 				}
-				log.Printf("S3 Bucket created at location: %s\n", *output.Location)
+				log.Printf("S3 Bucket created at location: %s\n", aws.StringValue(output.Location))
 			}
 		} else {
 			return err
@@ -83,28 +114,28 @@ func (s *S3Store) Init() error {
 		log.Println("S3 Bucket already exists. Skipping bucket creation.")
 	}
 
-	log.Printf("Initialized S3 Storage Engine in %s\n", s.Bucket.Name)
+	log.Printf("Initialized S3 Storage Engine in %s\n", s.Bucket)
 	return nil
 }
 
 func (s *S3Store) createBucket() (*s3.CreateBucketOutput, error) {
 	output, err := s.S3.CreateBucket(&s3.CreateBucketInput{
-		Bucket: aws.String(s.Bucket.Name),
+		Bucket: aws.String(s.Bucket),
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	err = s.S3.WaitUntilBucketExists(&s3.HeadBucketInput{
-		Bucket: aws.String(s.Bucket.Name),
+		Bucket: aws.String(s.Bucket),
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	if config.AppConfig.AWS.S3.BucketVersioning {
+	if s.BucketVersioning {
 		_, err = s.S3.PutBucketVersioning(&s3.PutBucketVersioningInput{
-			Bucket: aws.String(s.Bucket.Name),
+			Bucket: aws.String(s.Bucket),
 			VersioningConfiguration: &s3.VersioningConfiguration{
 				Status: aws.String("Enabled"),
 			},
@@ -117,17 +148,25 @@ func (s *S3Store) createBucket() (*s3.CreateBucketOutput, error) {
 	return output, nil
 }
 
-func (s *S3Store) Put(key string, body io.Reader) error {
+func (s *S3Store) Put(key string, body io.Reader, metadata *store.ObjectMetadata) error {
 	// Get() first checks if there are any available instances within the pool to return. If not, calls New() to create a new one.
 	uploader := s.UploaderPool.Get().(*s3manager.Uploader)
 	// Put(): place the instance back in the pool for use by other processes.
 	defer s.UploaderPool.Put(uploader)
 
-	_, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s.Bucket.Name),
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
 		Body:   body,
-	})
+	}
+	if metadata != nil {
+		if metadata.ContentType != "" {
+			input.ContentType = aws.String(metadata.ContentType)
+		}
+		input.Metadata = toS3Metadata(metadata)
+	}
+
+	_, err := uploader.Upload(input)
 	if err != nil {
 		return err
 	}
@@ -135,52 +174,125 @@ func (s *S3Store) Put(key string, body io.Reader) error {
 }
 
 func (s *S3Store) Get(key string, writer io.Writer) error {
-	// GetReader() provides a reader and downloads data using parallel ranged get requests.
-	// Data from the requests are ordered and written sequentially.
-	reader, _, err := s.Bucket.GetReader(key, s.Config)
+	output, err := s.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
+	defer output.Body.Close()
 
-	if _, err = io.Copy(writer, reader); err != nil {
-		return err
+	_, err = io.Copy(writer, output.Body)
+	return err
+}
+
+func (s *S3Store) GetAll(prefix ...string) ([]*pb.StorageObject, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
 	}
-	return nil
+	if len(prefix) == 1 {
+		input.Prefix = aws.String(prefix[0])
+	}
+
+	items := make([]*s3.Object, 0)
+	err := s.S3.ListObjectsV2Pages(input, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range output.Contents {
+			if store.Listed(*item.Key, prefix...) {
+				items = append(items, item)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.storageObjects(items), nil
 }
 
-func (s *S3Store) GetAll() ([]*pb.StorageObject, error) {
-	output, err := s.S3.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(s.Bucket.Name),
+func (s *S3Store) List(prefix string) (*store.Listing, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.Bucket),
+		Delimiter: aws.String("/"),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	listing := store.NewListing()
+	items := make([]*s3.Object, 0)
+	err := s.S3.ListObjectsV2Pages(input, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, commonPrefix := range output.CommonPrefixes {
+			if folder := aws.StringValue(commonPrefix.Prefix); !store.IsHidden(folder) {
+				listing.Prefixes = append(listing.Prefixes, folder)
+			}
+		}
+		for _, item := range output.Contents {
+			if !store.IsHidden(*item.Key) {
+				items = append(items, item)
+			}
+		}
+		return true
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	objects := make([]*pb.StorageObject, 0)
+	listing.Objects = append(listing.Objects, s.storageObjects(items)...)
+	return listing, nil
+}
+
+// storageObjects converts the listed items, fetching their metadata concurrently since listing does not return it.
+// An object whose metadata cannot be fetched is still listed, without it, rather than failing the whole listing.
+func (s *S3Store) storageObjects(items []*s3.Object) []*pb.StorageObject {
+	objects := make([]*pb.StorageObject, len(items))
+	semaphore := make(chan struct{}, headConcurrency)
+	wg := &sync.WaitGroup{}
 
-	for _, item := range output.Contents {
-		objects = append(objects, &pb.StorageObject{
+	for i, item := range items {
+		objects[i] = &pb.StorageObject{
 			Key:          *item.Key,
 			Size:         uint64(*item.Size),
 			LastModified: item.LastModified.Format(time.RFC3339),
-			StorageClass: *item.StorageClass,
-		})
+			StorageClass: aws.StringValue(item.StorageClass),
+		}
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(object *pb.StorageObject) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			metadata, err := s.GetMetadata(object.Key)
+			if err != nil {
+				log.Printf("could not get metadata of %s: %s", object.Key, err)
+				return
+			}
+			object.ContentType = metadata.ContentType
+			object.Sha256 = metadata.SHA256
+			object.Metadata = metadata.Custom
+			object.Owner = metadata.Owner
+		}(objects[i])
 	}
+	wg.Wait()
 
-	return objects, nil
+	return objects
 }
 
 func (s *S3Store) Delete(fileName string) error {
-	if err := s.Bucket.Delete(fileName); err != nil {
-		return err
-	}
-	return nil
+	_, err := s.S3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(fileName),
+	})
+	return err
 }
 
 func (s *S3Store) DeleteAll(prefix ...string) error {
 	input := &s3.ListObjectsInput{
-		Bucket: aws.String(s.Bucket.Name),
+		Bucket: aws.String(s.Bucket),
 	}
 	if len(prefix) == 1 {
 		input.Prefix = aws.String(prefix[0])
@@ -189,8 +301,157 @@ func (s *S3Store) DeleteAll(prefix ...string) error {
 	iter := s3manager.NewDeleteListIterator(s.S3, input)
 
 	if err := s3manager.NewBatchDeleteWithClient(s.S3).Delete(aws.BackgroundContext(), iter); err != nil {
-		return fmt.Errorf("unable to delete objects from bucket %s: %v", s.Bucket.Name, err)
+		return fmt.Errorf("unable to delete objects from bucket %s: %v", s.Bucket, err)
 	}
 
 	return nil
 }
+
+func (s *S3Store) Move(srcKey, dstKey string) error {
+	// S3 has no rename: the object is copied, along with its metadata, then deleted
+	if err := s.Copy(srcKey, dstKey, ""); err != nil {
+		return err
+	}
+	return s.Delete(srcKey)
+}
+
+func (s *S3Store) Copy(srcKey, dstKey, owner string) error {
+	// the copy is made server-side, the metadata is copied along with the content
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(s.Bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(url.PathEscape(s.Bucket + "/" + srcKey)),
+	}
+	if owner != "" {
+		metadata, err := s.GetMetadata(srcKey)
+		if err != nil {
+			return err
+		}
+		metadata.Owner = owner
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+		input.Metadata = toS3Metadata(metadata)
+		if metadata.ContentType != "" {
+			input.ContentType = aws.String(metadata.ContentType)
+		}
+	}
+
+	_, err := s.S3.CopyObject(input)
+	return err
+}
+
+func (s *S3Store) SetMetadata(key string, metadata *store.ObjectMetadata) error {
+	// the metadata of an S3 object cannot be changed in place: the object is copied onto itself, replacing it
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.Bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(url.PathEscape(s.Bucket + "/" + key)),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		Metadata:          toS3Metadata(metadata),
+	}
+	if metadata.ContentType != "" {
+		input.ContentType = aws.String(metadata.ContentType)
+	}
+
+	_, err := s.S3.CopyObject(input)
+	return err
+}
+
+func (s *S3Store) PresignPut(key, contentType string, expiration time.Duration) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+	// the client must then send the same Content-Type header
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+
+	request, _ := s.S3.PutObjectRequest(input)
+	return request.Presign(expiration)
+}
+
+func (s *S3Store) PresignGet(key string, expiration time.Duration) (string, error) {
+	request, _ := s.S3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	return request.Presign(expiration)
+}
+
+// GetMetadata reads the metadata of the object, or of the given version, with a HEAD request
+func (s *S3Store) GetMetadata(key string, versionID ...string) (*store.ObjectMetadata, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+	if len(versionID) == 1 && versionID[0] != "" {
+		input.VersionId = aws.String(versionID[0])
+	}
+
+	head, err := s.S3.HeadObject(input)
+	if err != nil {
+		if input.VersionId != nil {
+			return nil, versionError(err)
+		}
+		return nil, err
+	}
+
+	metadata := fromS3Metadata(head.Metadata)
+	metadata.ContentType = aws.StringValue(head.ContentType)
+	return metadata, nil
+}
+
+// toS3Metadata converts the metadata to S3 user-defined metadata (x-amz-meta-* headers)
+func toS3Metadata(metadata *store.ObjectMetadata) map[string]*string {
+	s3Metadata := make(map[string]*string)
+	for key, value := range metadata.Custom {
+		s3Metadata[customMetadataPrefix+strings.ToLower(key)] = aws.String(value)
+	}
+	if metadata.SHA256 != "" {
+		s3Metadata[sha256MetadataKey] = aws.String(metadata.SHA256)
+	}
+	if metadata.Owner != "" {
+		s3Metadata[ownerMetadataKey] = aws.String(metadata.Owner)
+	}
+	if metadata.Encryption != nil {
+		if envelope, err := json.Marshal(metadata.Encryption); err == nil {
+			s3Metadata[encryptionMetadataKey] = aws.String(string(envelope))
+		}
+	}
+	if metadata.Compression != nil {
+		if compression, err := json.Marshal(metadata.Compression); err == nil {
+			s3Metadata[compressionMetadataKey] = aws.String(string(compression))
+		}
+	}
+	return s3Metadata
+}
+
+func fromS3Metadata(s3Metadata map[string]*string) *store.ObjectMetadata {
+	metadata := &store.ObjectMetadata{}
+	for key, value := range s3Metadata {
+		// the sdk returns canonical header keys, e.g. X-Amz-Meta-Custom-Author is returned as Custom-Author
+		key = strings.ToLower(key)
+		switch {
+		case key == sha256MetadataKey:
+			metadata.SHA256 = aws.StringValue(value)
+		case key == ownerMetadataKey:
+			metadata.Owner = aws.StringValue(value)
+		case key == encryptionMetadataKey:
+			envelope := &store.EncryptionMetadata{}
+			if err := json.Unmarshal([]byte(aws.StringValue(value)), envelope); err == nil {
+				metadata.Encryption = envelope
+			}
+		case key == compressionMetadataKey:
+			compression := &store.CompressionMetadata{}
+			if err := json.Unmarshal([]byte(aws.StringValue(value)), compression); err == nil {
+				metadata.Compression = compression
+			}
+		case strings.HasPrefix(key, customMetadataPrefix):
+			if metadata.Custom == nil {
+				metadata.Custom = make(map[string]string)
+			}
+			metadata.Custom[strings.TrimPrefix(key, customMetadataPrefix)] = aws.StringValue(value)
+		}
+	}
+	return metadata
+}
@@ -0,0 +1,208 @@
+package s3store
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store/s3store/s3fake"
+)
+
+// newTestStore returns a store on a fake S3, listing two keys at once to exercise the pagination
+func newTestStore(t *testing.T) store.Store {
+	server := s3fake.NewServer()
+	server.PageSize = 2
+	t.Cleanup(server.Close)
+
+	sess, err := session.NewSession(aws.NewConfig().WithRegion("us-east-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := New(sess, config.S3Config{
+		Endpoint:        server.URL,
+		ForcePathStyle:  true,
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+		Bucket:          "test",
+		Concurrency:     1,
+		MaxAttempts:     1,
+		Timeout:         5,
+	})
+	if err = storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func put(t *testing.T, storage store.Store, key, content string, metadata *store.ObjectMetadata) {
+	t.Helper()
+	if err := storage.Put(key, strings.NewReader(content), metadata); err != nil {
+		t.Fatalf("cannot put %s: %s", key, err)
+	}
+}
+
+func get(t *testing.T, storage store.Store, key string) string {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	if err := storage.Get(key, buffer); err != nil {
+		t.Fatalf("cannot get %s: %s", key, err)
+	}
+	return buffer.String()
+}
+
+func TestPutGet(t *testing.T) {
+	storage := newTestStore(t)
+	put(t, storage, "docs/a.txt", "hello", &store.ObjectMetadata{
+		ContentType: "text/plain",
+		SHA256:      "abc",
+		Owner:       "john@doe.com",
+		Custom:      map[string]string{"author": "John"},
+	})
+
+	if content := get(t, storage, "docs/a.txt"); content != "hello" {
+		t.Errorf("got content %q, want hello", content)
+	}
+
+	metadata, err := storage.GetMetadata("docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.ContentType != "text/plain" || metadata.SHA256 != "abc" || metadata.Owner != "john@doe.com" || metadata.Custom["author"] != "John" {
+		t.Errorf("got metadata %+v", metadata)
+	}
+
+	if _, err = storage.GetMetadata("docs/missing.txt"); err == nil {
+		t.Error("got the metadata of a missing object")
+	}
+}
+
+func TestGetAllAndList(t *testing.T) {
+	storage := newTestStore(t)
+	for _, key := range []string{"a.txt", "docs/b.txt", "docs/c.txt", "docs/d.txt", "docs/sub/e.txt", "img/f.png"} {
+		put(t, storage, key, key, &store.ObjectMetadata{Owner: "john@doe.com"})
+	}
+
+	objects, err := storage.GetAll("docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 4 {
+		t.Fatalf("got %d objects under docs/, want 4", len(objects))
+	}
+	for _, object := range objects {
+		if object.GetOwner() != "john@doe.com" || object.GetSize() != uint64(len(object.GetKey())) {
+			t.Errorf("got object %+v", object)
+		}
+	}
+
+	listing, err := storage.List("docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Objects) != 3 || len(listing.Prefixes) != 1 || listing.Prefixes[0] != "docs/sub/" {
+		t.Errorf("got %d objects and prefixes %v, want 3 objects and docs/sub/", len(listing.Objects), listing.Prefixes)
+	}
+}
+
+func TestCopyMoveAndSetMetadata(t *testing.T) {
+	storage := newTestStore(t)
+	put(t, storage, "a.txt", "hello", &store.ObjectMetadata{ContentType: "text/plain", Owner: "john@doe.com"})
+
+	if err := storage.Copy("a.txt", "b.txt", "jane@doe.com"); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := storage.GetMetadata("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.Owner != "jane@doe.com" || copied.ContentType != "text/plain" {
+		t.Errorf("got copy metadata %+v", copied)
+	}
+	if source, _ := storage.GetMetadata("a.txt"); source == nil || source.Owner != "john@doe.com" {
+		t.Errorf("got source metadata %+v", source)
+	}
+
+	if err = storage.Move("b.txt", "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if content := get(t, storage, "c.txt"); content != "hello" {
+		t.Errorf("got moved content %q, want hello", content)
+	}
+	if _, err = storage.GetMetadata("b.txt"); err == nil {
+		t.Error("the moved object is still at its source")
+	}
+
+	err = storage.SetMetadata("c.txt", &store.ObjectMetadata{ContentType: "text/markdown", Custom: map[string]string{"tag": "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := storage.GetMetadata("c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.ContentType != "text/markdown" || metadata.Custom["tag"] != "x" || metadata.Owner != "" {
+		t.Errorf("got metadata %+v", metadata)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	storage := newTestStore(t)
+	for _, key := range []string{"a.txt", "docs/b.txt", "docs/c.txt", "docs/d.txt"} {
+		put(t, storage, key, key, nil)
+	}
+
+	if err := storage.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DeleteAll("docs/"); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := storage.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("got %d objects after deleting them all", len(objects))
+	}
+}
+
+func TestLargeUpload(t *testing.T) {
+	storage := newTestStore(t)
+	// larger than a part, uploaded in multiple parts
+	content := strings.Repeat("x", 6*1024*1024)
+	put(t, storage, "large.bin", content, &store.ObjectMetadata{Owner: "john@doe.com"})
+
+	if got := get(t, storage, "large.bin"); got != content {
+		t.Errorf("got %d bytes, want %d", len(got), len(content))
+	}
+	if metadata, err := storage.GetMetadata("large.bin"); err != nil || metadata.Owner != "john@doe.com" {
+		t.Errorf("got metadata %+v, error %v", metadata, err)
+	}
+}
+
+func TestPresignGet(t *testing.T) {
+	storage := newTestStore(t)
+	put(t, storage, "a.txt", "hello", nil)
+
+	presigned, err := storage.(store.Presigner).PresignGet("a.txt", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.Get(presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("got status %d and body %q", response.StatusCode, body)
+	}
+}
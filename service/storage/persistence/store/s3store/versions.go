@@ -0,0 +1,103 @@
+package s3store
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+)
+
+func (s *S3Store) ListVersions(key string) ([]*pb.ObjectVersion, error) {
+	versions := make([]*pb.ObjectVersion, 0)
+
+	err := s.S3.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(key),
+	}, func(output *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range output.Versions {
+			// the prefix also matches other keys, e.g. file.txt matches file.txt.bak
+			if aws.StringValue(version.Key) != key {
+				continue
+			}
+			versions = append(versions, &pb.ObjectVersion{
+				Key:          key,
+				VersionId:    aws.StringValue(version.VersionId),
+				LastModified: aws.TimeValue(version.LastModified).Format(time.RFC3339),
+				Size:         uint64(aws.Int64Value(version.Size)),
+				IsLatest:     aws.BoolValue(version.IsLatest),
+			})
+		}
+		for _, marker := range output.DeleteMarkers {
+			if aws.StringValue(marker.Key) != key {
+				continue
+			}
+			versions = append(versions, &pb.ObjectVersion{
+				Key:            key,
+				VersionId:      aws.StringValue(marker.VersionId),
+				LastModified:   aws.TimeValue(marker.LastModified).Format(time.RFC3339),
+				IsLatest:       aws.BoolValue(marker.IsLatest),
+				IsDeleteMarker: true,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC3339 timestamps sort chronologically
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].LastModified > versions[j].LastModified
+	})
+	return versions, nil
+}
+
+func (s *S3Store) GetVersion(key, versionID string, writer io.Writer) error {
+	output, err := s.S3.GetObject(&s3.GetObjectInput{
+		Bucket:    aws.String(s.Bucket),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return versionError(err)
+	}
+	defer output.Body.Close()
+
+	_, err = io.Copy(writer, output.Body)
+	return err
+}
+
+func (s *S3Store) RestoreVersion(key, versionID string) error {
+	// copying a version onto its own key creates a new current version with the same content and metadata
+	_, err := s.S3.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(s.Bucket),
+		Key:        aws.String(key),
+		CopySource: aws.String(url.PathEscape(s.Bucket+"/"+key) + "?versionId=" + url.QueryEscape(versionID)),
+	})
+	return versionError(err)
+}
+
+func (s *S3Store) DeleteVersion(key, versionID string) error {
+	// deleting a specific version removes it permanently, no delete marker is created
+	_, err := s.S3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket:    aws.String(s.Bucket),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	})
+	return versionError(err)
+}
+
+func versionError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "NoSuchVersion", s3.ErrCodeNoSuchKey, "InvalidArgument":
+			return store.ErrVersionNotFound
+		}
+	}
+	return err
+}
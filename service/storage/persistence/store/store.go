@@ -1,15 +1,160 @@
 package store
 
 import (
+	"errors"
 	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
 	"io"
+	"strings"
+	"time"
 )
 
 type Store interface {
 	Init() error
-	Put(key string, body io.Reader) error
+	Put(key string, body io.Reader, metadata *ObjectMetadata) error
 	Get(key string, writer io.Writer) error
-	GetAll() ([]*pb.StorageObject, error)
+	// GetAll returns the objects with the given prefix, or all objects outside the hidden namespaces if no prefix is given
+	GetAll(prefix ...string) ([]*pb.StorageObject, error)
+	// List returns the objects directly under the prefix, which is empty or ends with a slash, and its sub-folders
+	List(prefix string) (*Listing, error)
 	Delete(fileName string) error
 	DeleteAll(prefix ...string) error
+	// Move renames an object, along with its metadata
+	Move(srcKey, dstKey string) error
+	// Copy duplicates an object, along with its metadata. The copy is owned by the owner, unless empty.
+	Copy(srcKey, dstKey, owner string) error
+	// SetMetadata replaces the metadata of an existing object
+	SetMetadata(key string, metadata *ObjectMetadata) error
+	// GetMetadata returns the metadata of the object, or of the given version of the object
+	GetMetadata(key string, versionID ...string) (*ObjectMetadata, error)
+
+	// ListVersions returns all versions of the object, newest first
+	ListVersions(key string) ([]*pb.ObjectVersion, error)
+	GetVersion(key, versionID string, writer io.Writer) error
+	// RestoreVersion makes a copy of the version the current version of the object
+	RestoreVersion(key, versionID string) error
+	DeleteVersion(key, versionID string) error
+}
+
+// TrashPrefix is the namespace of the deleted objects, which are kept until purged
+const TrashPrefix = ".trash/"
+
+// QuarantinePrefix is the namespace of the uploads made with presigned urls, which are moved to their keys only once
+// validated, see QuarantineKey
+const QuarantinePrefix = ".uploads/"
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// IsTrashed checks whether the key belongs to the trash namespace
+func IsTrashed(key string) bool {
+	return strings.HasPrefix(key, TrashPrefix)
+}
+
+// QuarantineKey returns the key under which the presigned upload of the key is stored until validated
+func QuarantineKey(key string) string {
+	return QuarantinePrefix + key
+}
+
+// reservedNames are the key segments reserved to the service: its namespaces, the folder markers and the directories
+// of the disk store's own data
+var reservedNames = map[string]bool{
+	".trash":    true,
+	".uploads":  true,
+	".variants": true,
+	".folder":   true,
+	".tmp":      true,
+	".metadata": true,
+	".versions": true,
+}
+
+// IsHidden checks whether the key belongs to a namespace reserved to the service, such as the trash, or has a segment
+// reserved to the service, such as the folder markers. Hidden objects are not versioned and cannot be addressed by
+// clients, see NormalizeKey.
+func IsHidden(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if reservedNames[segment] {
+			return true
+		}
+	}
+	return false
+}
+
+// FolderMarker names the empty object marking a folder, so that a folder is kept once its files are deleted
+const FolderMarker = ".folder"
+
+// Listing is the result of a listing delimited by slashes
+type Listing struct {
+	// Objects are the objects directly under the prefix, outside the hidden namespaces
+	Objects []*pb.StorageObject
+	// Prefixes are the prefixes of the sub-folders, ending with a slash
+	Prefixes []string
+}
+
+func NewListing() *Listing {
+	return &Listing{
+		Objects:  make([]*pb.StorageObject, 0),
+		Prefixes: make([]string, 0),
+	}
+}
+
+// Delimit returns the prefix of the sub-folder holding the key, if the key is not directly under the prefix
+func Delimit(prefix, key string) (string, bool) {
+	rest := strings.TrimPrefix(key, prefix)
+	if i := strings.Index(rest, "/"); i != -1 {
+		return prefix + rest[:i+1], true
+	}
+	return "", false
+}
+
+// Listed checks whether an object is returned by GetAll for the given prefix
+func Listed(key string, prefix ...string) bool {
+	if len(prefix) == 1 && prefix[0] != "" {
+		return strings.HasPrefix(key, prefix[0])
+	}
+	return !IsHidden(key)
+}
+
+// Sizer is implemented by the stores knowing the sizes of their objects without reading them
+type Sizer interface {
+	// Size returns the size of the object, false if unknown
+	Size(key string) (uint64, bool)
+}
+
+// Presigner is implemented by the stores able to issue urls giving direct, time-limited access to their objects
+type Presigner interface {
+	PresignPut(key, contentType string, expiration time.Duration) (string, error)
+	PresignGet(key string, expiration time.Duration) (string, error)
+}
+
+// ObjectMetadata describes the content of a stored object
+type ObjectMetadata struct {
+	ContentType string `json:"content_type,omitempty"`
+	// SHA256 is the hex encoded checksum of the content
+	SHA256 string `json:"sha256,omitempty"`
+	// Custom holds the user-defined metadata
+	Custom map[string]string `json:"metadata,omitempty"`
+	// Owner is the user who uploaded the object
+	Owner string `json:"owner,omitempty"`
+	// Encryption is set for the objects encrypted at rest
+	Encryption *EncryptionMetadata `json:"encryption,omitempty"`
+	// Compression is set for the objects stored compressed
+	Compression *CompressionMetadata `json:"compression,omitempty"`
+}
+
+// EncryptionMetadata describes the envelope of an encrypted object: its content is encrypted with a data key,
+// which is stored wrapped by a master key
+type EncryptionMetadata struct {
+	// KeyID identifies the master key wrapping the data key
+	KeyID string `json:"key_id"`
+	// WrappedKey is the encrypted data key, base64 encoded
+	WrappedKey string `json:"wrapped_key"`
+	// ChunkSize is the size of the plaintext chunks encrypted separately
+	ChunkSize int `json:"chunk_size"`
+}
+
+// CompressionMetadata describes the encoding of a compressed object
+type CompressionMetadata struct {
+	// Encoding is the content coding of the stored content, e.g. gzip
+	Encoding string `json:"encoding"`
+	// Size is the size of the content before compression
+	Size int64 `json:"size"`
 }
@@ -0,0 +1,110 @@
+package presign
+
+import (
+	"fmt"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"github.com/bogdanrat/web-server/service/storage/lib"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// ObjectsPath is where the storage service's http server serves the presigned urls
+	ObjectsPath = "/storage/objects"
+	tokenParam  = "token"
+)
+
+// LocalPresigner issues signed urls served by the storage service itself, for stores that cannot presign urls (e.g., disk)
+type LocalPresigner struct {
+	Storage store.Store
+	BaseURL string
+	Secret  string
+}
+
+func NewLocal(storage store.Store, presignConfig config.PresignConfig) *LocalPresigner {
+	return &LocalPresigner{
+		Storage: storage,
+		BaseURL: strings.TrimSuffix(presignConfig.BaseURL, "/"),
+		Secret:  presignConfig.Secret,
+	}
+}
+
+func (p *LocalPresigner) PresignPut(key, contentType string, expiration time.Duration) (string, error) {
+	return p.presign(http.MethodPut, key, expiration), nil
+}
+
+func (p *LocalPresigner) PresignGet(key string, expiration time.Duration) (string, error) {
+	return p.presign(http.MethodGet, key, expiration), nil
+}
+
+func (p *LocalPresigner) presign(method, key string, expiration time.Duration) string {
+	token := lib.SignToken(p.Secret, method+" "+key, time.Now().Add(expiration))
+	objectURL := &url.URL{
+		Path:     path.Join(ObjectsPath, key),
+		RawQuery: url.Values{tokenParam: []string{token}}.Encode(),
+	}
+	return p.BaseURL + objectURL.String()
+}
+
+// RegisterRoutes serves the presigned urls
+func (p *LocalPresigner) RegisterRoutes(router gin.IRouter) {
+	router.PUT(ObjectsPath+"/*key", p.putObject)
+	router.GET(ObjectsPath+"/*key", p.getObject)
+}
+
+func (p *LocalPresigner) putObject(c *gin.Context) {
+	key, ok := p.authorize(c, http.MethodPut)
+	if !ok {
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, int64(config.AppConfig.Upload.MaxFileSize))
+	metadata := &store.ObjectMetadata{
+		ContentType: c.GetHeader("Content-Type"),
+	}
+	if err := p.Storage.Put(key, body, metadata); err != nil {
+		log.Printf("cannot upload %s: %s\n", key, err)
+		c.String(http.StatusInternalServerError, fmt.Sprintf("cannot upload file: %s", err))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (p *LocalPresigner) getObject(c *gin.Context) {
+	key, ok := p.authorize(c, http.MethodGet)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+path.Base(key))
+	if err := p.Storage.Get(key, c.Writer); err != nil {
+		c.String(http.StatusNotFound, fmt.Sprintf("cannot get file: %s", err))
+		return
+	}
+}
+
+func (p *LocalPresigner) authorize(c *gin.Context, method string) (string, bool) {
+	// the quarantine is the only hidden namespace the urls address, the token then tells whether it is signed for it
+	key := strings.TrimLeft(c.Param("key"), "/")
+	quarantined := strings.HasPrefix(key, store.QuarantinePrefix)
+	key, err := store.NormalizeKey(strings.TrimPrefix(key, store.QuarantinePrefix))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	if quarantined {
+		key = store.QuarantineKey(key)
+	}
+	if err := lib.VerifyToken(p.Secret, method+" "+key, c.Query(tokenParam)); err != nil {
+		c.String(http.StatusForbidden, err.Error())
+		return "", false
+	}
+	return key, true
+}
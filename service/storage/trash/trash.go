@@ -0,0 +1,173 @@
+package trash
+
+import (
+	"errors"
+	"fmt"
+	pb "github.com/bogdanrat/web-server/contracts/proto/storage_service"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidTrashID = errors.New("invalid trash id")
+	// ErrKeyExists is returned when restoring an object whose original key was reused since it was trashed
+	ErrKeyExists = errors.New("a file already exists at the original key")
+)
+
+// Bin keeps the deleted objects under the store's trash namespace, as <trash prefix><deletion time>/<key>,
+// until they are restored or purged.
+type Bin struct {
+	Storage   store.Store
+	Retention time.Duration
+}
+
+func New(storage store.Store, retention time.Duration) *Bin {
+	return &Bin{
+		Storage:   storage,
+		Retention: retention,
+	}
+}
+
+// Trash moves the object to the trash
+func (b *Bin) Trash(key string) error {
+	trashID := fmt.Sprintf("%d/%s", time.Now().UnixNano(), key)
+	if err := b.Storage.Move(key, store.TrashPrefix+trashID); err != nil {
+		return fmt.Errorf("cannot move %s to trash: %s", key, err)
+	}
+	return nil
+}
+
+// TrashAll moves all objects with the given prefix to the trash
+func (b *Bin) TrashAll(prefix string) error {
+	objects, err := b.Storage.GetAll(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		// an empty prefix lists the objects outside the hidden namespaces only
+		if store.IsHidden(object.GetKey()) {
+			continue
+		}
+		if err = b.Trash(object.GetKey()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bin) List() ([]*pb.TrashedObject, error) {
+	objects, err := b.Storage.GetAll(store.TrashPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	trashed := make([]*pb.TrashedObject, 0, len(objects))
+	for _, object := range objects {
+		trashID := strings.TrimPrefix(object.GetKey(), store.TrashPrefix)
+		key, deletedAt, err := parseTrashID(trashID)
+		if err != nil {
+			log.Printf("skipping trashed object %s: %s\n", object.GetKey(), err)
+			continue
+		}
+
+		trashed = append(trashed, &pb.TrashedObject{
+			TrashId:   trashID,
+			Key:       key,
+			Size:      object.GetSize(),
+			DeletedAt: deletedAt.Format(time.RFC3339),
+			ExpiresAt: deletedAt.Add(b.Retention).Format(time.RFC3339),
+		})
+	}
+	return trashed, nil
+}
+
+// Restore moves the object back to its original key, replacing the file stored there since only if overwrite is set
+func (b *Bin) Restore(trashID string, overwrite bool) error {
+	key, _, err := parseTrashID(trashID)
+	if err != nil {
+		return err
+	}
+	if !overwrite {
+		if _, err = b.Storage.GetMetadata(key); err == nil {
+			return ErrKeyExists
+		}
+	}
+	return b.Storage.Move(store.TrashPrefix+trashID, key)
+}
+
+// Purge permanently deletes the object from the trash
+func (b *Bin) Purge(trashID string) error {
+	if _, _, err := parseTrashID(trashID); err != nil {
+		return err
+	}
+	return b.Storage.Delete(store.TrashPrefix + trashID)
+}
+
+// PurgeAll permanently deletes every object in the trash
+func (b *Bin) PurgeAll() error {
+	objects, err := b.List()
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err = b.Purge(object.GetTrashId()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeExpired permanently deletes the objects kept longer than the retention period
+func (b *Bin) PurgeExpired() (int, error) {
+	objects, err := b.List()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, object := range objects {
+		expiresAt, err := time.Parse(time.RFC3339, object.GetExpiresAt())
+		if err != nil || time.Now().Before(expiresAt) {
+			continue
+		}
+		if err = b.Purge(object.GetTrashId()); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// StartPurger purges the expired objects periodically
+func (b *Bin) StartPurger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for range ticker.C {
+			purged, err := b.PurgeExpired()
+			if err != nil {
+				log.Printf("could not purge trash: %s\n", err)
+			}
+			if purged > 0 {
+				log.Printf("Purged %d expired objects from trash\n", purged)
+			}
+		}
+	}()
+}
+
+func parseTrashID(trashID string) (string, time.Time, error) {
+	parts := strings.SplitN(trashID, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", time.Time{}, ErrInvalidTrashID
+	}
+
+	deletedAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, ErrInvalidTrashID
+	}
+	return parts[1], time.Unix(0, deletedAt), nil
+}
@@ -0,0 +1,151 @@
+package usage
+
+import (
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"io"
+)
+
+// Store keeps the tracker up to date with the changes made through the wrapped store
+type Store struct {
+	store.Store
+	Tracker *Tracker
+}
+
+func NewStore(storage store.Store, tracker *Tracker) store.Store {
+	return &Store{
+		Store:   storage,
+		Tracker: tracker,
+	}
+}
+
+// Init initializes the wrapped store, then computes the usage of its objects
+func (s *Store) Init() error {
+	if err := s.Store.Init(); err != nil {
+		return err
+	}
+	return s.Tracker.Rebuild(s.Store)
+}
+
+func (s *Store) Put(key string, body io.Reader, metadata *store.ObjectMetadata) error {
+	counter := &countingReader{reader: body}
+	if err := s.Store.Put(key, counter, metadata); err != nil {
+		return err
+	}
+	// like Rebuild, only the trashed objects are tracked among the hidden ones, e.g. not the folder markers
+	if store.IsHidden(key) && !store.IsTrashed(key) {
+		return nil
+	}
+
+	owner := ""
+	if metadata != nil {
+		owner = metadata.Owner
+	}
+	s.Tracker.Set(key, owner, counter.count)
+	return nil
+}
+
+func (s *Store) Delete(key string) error {
+	if err := s.Store.Delete(key); err != nil {
+		return err
+	}
+	s.Tracker.Remove(key)
+	return nil
+}
+
+func (s *Store) DeleteAll(prefix ...string) error {
+	if err := s.Store.DeleteAll(prefix...); err != nil {
+		return err
+	}
+
+	if len(prefix) == 1 {
+		s.Tracker.RemovePrefix(prefix[0])
+	} else {
+		s.Tracker.RemovePrefix("")
+	}
+	return nil
+}
+
+func (s *Store) Move(srcKey, dstKey string) error {
+	if err := s.Store.Move(srcKey, dstKey); err != nil {
+		return err
+	}
+	s.Tracker.Move(srcKey, dstKey)
+	return nil
+}
+
+func (s *Store) Copy(srcKey, dstKey, owner string) error {
+	if err := s.Store.Copy(srcKey, dstKey, owner); err != nil {
+		return err
+	}
+	s.Tracker.Copy(srcKey, dstKey, owner)
+	return nil
+}
+
+// Size returns the tracked size of the object
+func (s *Store) Size(key string) (uint64, bool) {
+	return s.Tracker.Size(key)
+}
+
+// SetMetadata may change the owner of an object, e.g. when completing an upload made with a presigned url
+func (s *Store) SetMetadata(key string, metadata *store.ObjectMetadata) error {
+	if err := s.Store.SetMetadata(key, metadata); err != nil {
+		return err
+	}
+	// the content is unchanged, unless not tracked yet, e.g. uploaded with a presigned url
+	if size, ok := s.Tracker.Size(key); ok {
+		s.Tracker.Set(key, metadata.Owner, size)
+		return nil
+	}
+	return s.refresh(key)
+}
+
+func (s *Store) RestoreVersion(key, versionID string) error {
+	if err := s.Store.RestoreVersion(key, versionID); err != nil {
+		return err
+	}
+	return s.refresh(key)
+}
+
+func (s *Store) DeleteVersion(key, versionID string) error {
+	if err := s.Store.DeleteVersion(key, versionID); err != nil {
+		return err
+	}
+	return s.refresh(key)
+}
+
+// refresh reads the current size and owner of the object from the wrapped store. Its versions are listed rather than
+// all objects with its key as prefix, which the disk store finds by walking the whole store.
+func (s *Store) refresh(key string) error {
+	versions, err := s.Store.ListVersions(key)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		if !version.GetIsLatest() {
+			continue
+		}
+		if version.GetIsDeleteMarker() {
+			break
+		}
+		metadata, err := s.Store.GetMetadata(key)
+		if err != nil {
+			return err
+		}
+		s.Tracker.Set(key, metadata.Owner, version.GetSize())
+		return nil
+	}
+	s.Tracker.Remove(key)
+	return nil
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += uint64(n)
+	return n, err
+}
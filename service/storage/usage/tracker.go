@@ -0,0 +1,441 @@
+package usage
+
+import (
+	"fmt"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"github.com/bogdanrat/web-server/service/storage/lib"
+	"github.com/bogdanrat/web-server/service/storage/persistence/store"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Usage struct {
+	Bytes   uint64
+	Objects uint64
+}
+
+// QuotaError describes the quota an upload would exceed
+type QuotaError struct {
+	// Subject is the owner or the prefix whose quota is exceeded, e.g. owner:john@doe.com or prefix:img
+	Subject     string
+	Description string
+}
+
+func (e *QuotaError) Error() string {
+	return e.Description
+}
+
+type object struct {
+	owner string
+	size  uint64
+}
+
+// Tracker keeps the bytes and object counts of every owner and top-level prefix.
+// Trashed objects still count towards their owner's usage, until purged.
+type Tracker struct {
+	Quotas config.QuotaConfig
+
+	mutex    sync.RWMutex
+	objects  map[string]object
+	owners   map[string]*Usage
+	prefixes map[string]*Usage
+	// reservedOwners and reservedPrefixes hold the usage of the uploads being stored, see Reserve
+	reservedOwners   map[string]*Usage
+	reservedPrefixes map[string]*Usage
+}
+
+func NewTracker(quotas config.QuotaConfig) *Tracker {
+	return &Tracker{
+		Quotas:           quotas,
+		objects:          make(map[string]object),
+		owners:           make(map[string]*Usage),
+		prefixes:         make(map[string]*Usage),
+		reservedOwners:   make(map[string]*Usage),
+		reservedPrefixes: make(map[string]*Usage),
+	}
+}
+
+// Rebuild recomputes the usage from all the objects in the store
+func (t *Tracker) Rebuild(storage store.Store) error {
+	objects, err := storage.GetAll()
+	if err != nil {
+		return err
+	}
+	trashed, err := storage.GetAll(store.TrashPrefix)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.objects = make(map[string]object)
+	t.owners = make(map[string]*Usage)
+	t.prefixes = make(map[string]*Usage)
+	for _, storageObject := range append(objects, trashed...) {
+		t.set(storageObject.GetKey(), storageObject.GetOwner(), storageObject.GetSize())
+	}
+	return nil
+}
+
+// Set records the current size and owner of the object
+func (t *Tracker) Set(key, owner string, size uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.set(key, owner, size)
+}
+
+func (t *Tracker) set(key, owner string, size uint64) {
+	t.remove(key)
+
+	t.objects[key] = object{owner: owner, size: size}
+	add(t.owners, owner, size)
+	add(t.prefixes, prefixOf(key), size)
+}
+
+func (t *Tracker) Remove(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.remove(key)
+}
+
+func (t *Tracker) remove(key string) {
+	existing, ok := t.objects[key]
+	if !ok {
+		return
+	}
+
+	delete(t.objects, key)
+	subtract(t.owners, existing.owner, existing.size)
+	subtract(t.prefixes, prefixOf(key), existing.size)
+}
+
+// RemovePrefix removes all objects with the given prefix, or all objects if the prefix is empty
+func (t *Tracker) RemovePrefix(prefix string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key := range t.objects {
+		if strings.HasPrefix(key, prefix) {
+			t.remove(key)
+		}
+	}
+}
+
+// Move transfers the usage of an object to its new key
+func (t *Tracker) Move(srcKey, dstKey string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	existing, ok := t.objects[srcKey]
+	if !ok {
+		return
+	}
+	t.remove(srcKey)
+	t.set(dstKey, existing.owner, existing.size)
+}
+
+// Size returns the size of the object, false if it is not tracked
+func (t *Tracker) Size(key string) (uint64, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	existing, ok := t.objects[key]
+	return existing.size, ok
+}
+
+// Copy records the usage of a copy of an object, owned by the owner, or by the owner of the source if empty
+func (t *Tracker) Copy(srcKey, dstKey, owner string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	existing, ok := t.objects[srcKey]
+	if !ok {
+		return
+	}
+	if owner == "" {
+		owner = existing.owner
+	}
+	t.set(dstKey, owner, existing.size)
+}
+
+// Aggregate returns the usage of the objects with the given prefix, outside the hidden namespaces
+func (t *Tracker) Aggregate(prefix string) Usage {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	aggregate := Usage{}
+	for key, existing := range t.objects {
+		if strings.HasPrefix(key, prefix) && !store.IsHidden(key) {
+			aggregate.Bytes += existing.size
+			aggregate.Objects++
+		}
+	}
+	return aggregate
+}
+
+func (t *Tracker) Owner(owner string) Usage {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return get(t.owners, owner)
+}
+
+// Prefixes returns the usage of every prefix holding objects or having a quota, sorted by prefix
+func (t *Tracker) Prefixes() map[string]Usage {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	prefixes := make(map[string]Usage)
+	for prefix, usage := range t.prefixes {
+		prefixes[prefix] = *usage
+	}
+	for _, quota := range t.Quotas.Prefixes {
+		prefixes[quota.Prefix] = get(t.prefixes, quota.Prefix)
+	}
+	return prefixes
+}
+
+// SortedPrefixes returns the prefixes of Prefixes in order
+func SortedPrefixes(prefixes map[string]Usage) []string {
+	sorted := make([]string, 0, len(prefixes))
+	for prefix := range prefixes {
+		sorted = append(sorted, prefix)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// PrefixQuota returns the quota of the prefix, if any
+func (t *Tracker) PrefixQuota(prefix string) (config.PrefixQuotaConfig, bool) {
+	for _, quota := range t.Quotas.Prefixes {
+		if quota.Prefix == prefix {
+			return quota, true
+		}
+	}
+	return config.PrefixQuotaConfig{}, false
+}
+
+// Check verifies that storing an object of the given size under the key does not exceed the owner's or the prefix's quota.
+// An existing object with the same key is replaced, so its usage is not counted.
+func (t *Tracker) Check(key, owner string, size uint64) error {
+	if !t.Quotas.Enabled {
+		return nil
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.check(key, owner, size)
+}
+
+// Reserve checks the quotas like Check, then holds the size against them until released, so that concurrent uploads
+// cannot exceed the quotas together. The reservation must be released once the object is stored, or failed to be.
+func (t *Tracker) Reserve(key, owner string, size uint64) (func(), error) {
+	if !t.Quotas.Enabled {
+		return func() {}, nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err := t.check(key, owner, size); err != nil {
+		return nil, err
+	}
+
+	prefix := prefixOf(key)
+	add(t.reservedOwners, owner, size)
+	add(t.reservedPrefixes, prefix, size)
+
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			subtract(t.reservedOwners, owner, size)
+			subtract(t.reservedPrefixes, prefix, size)
+		})
+	}, nil
+}
+
+func (t *Tracker) check(key, owner string, size uint64) error {
+	existing, exists := t.objects[key]
+
+	ownerUsage := reserved(t.owners, t.reservedOwners, owner)
+	if exists && existing.owner == owner {
+		ownerUsage.Bytes -= existing.size
+		ownerUsage.Objects--
+	}
+	if err := exceeds(fmt.Sprintf("owner:%s", owner), ownerUsage, size, t.Quotas.MaxBytesPerOwner, t.Quotas.MaxObjectsPerOwner); err != nil {
+		return err
+	}
+
+	prefix := prefixOf(key)
+	quota, ok := t.PrefixQuota(prefix)
+	if !ok {
+		return nil
+	}
+	prefixUsage := reserved(t.prefixes, t.reservedPrefixes, prefix)
+	if exists {
+		prefixUsage.Bytes -= existing.size
+		prefixUsage.Objects--
+	}
+	return exceeds(fmt.Sprintf("prefix:%s", prefix), prefixUsage, size, quota.MaxBytes, quota.MaxObjects)
+}
+
+// CheckTransfer verifies that copying, or moving, the objects to their new keys does not exceed the owners' or the
+// prefixes' quotas. The keys map the source keys to the destination keys; existing destination objects are replaced.
+// Only the quotas whose usage grows are checked, so that moving objects out of an exceeded prefix is allowed.
+// The copies are charged to the owner, unless empty; the moved objects keep their owners.
+func (t *Tracker) CheckTransfer(keys map[string]string, owner string, move bool) error {
+	if !t.Quotas.Enabled {
+		return nil
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	owners := make(map[string]*delta)
+	prefixes := make(map[string]*delta)
+	for srcKey, dstKey := range keys {
+		src, ok := t.objects[srcKey]
+		if !ok {
+			continue
+		}
+		if existing, exists := t.objects[dstKey]; exists {
+			deltaOf(owners, existing.owner).subtract(existing.size)
+			deltaOf(prefixes, prefixOf(dstKey)).subtract(existing.size)
+		}
+		dstOwner := src.owner
+		if move {
+			deltaOf(owners, src.owner).subtract(src.size)
+			deltaOf(prefixes, prefixOf(srcKey)).subtract(src.size)
+		} else if owner != "" {
+			dstOwner = owner
+		}
+		deltaOf(owners, dstOwner).add(src.size)
+		deltaOf(prefixes, prefixOf(dstKey)).add(src.size)
+	}
+
+	for owner, change := range owners {
+		subject := fmt.Sprintf("owner:%s", owner)
+		if err := change.exceeds(subject, reserved(t.owners, t.reservedOwners, owner), t.Quotas.MaxBytesPerOwner, t.Quotas.MaxObjectsPerOwner); err != nil {
+			return err
+		}
+	}
+	for prefix, change := range prefixes {
+		quota, ok := t.PrefixQuota(prefix)
+		if !ok {
+			continue
+		}
+		subject := fmt.Sprintf("prefix:%s", prefix)
+		if err := change.exceeds(subject, reserved(t.prefixes, t.reservedPrefixes, prefix), quota.MaxBytes, quota.MaxObjects); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delta is the change of the usage of an owner or a prefix
+type delta struct {
+	bytes   int64
+	objects int64
+}
+
+func deltaOf(deltas map[string]*delta, name string) *delta {
+	change, ok := deltas[name]
+	if !ok {
+		change = &delta{}
+		deltas[name] = change
+	}
+	return change
+}
+
+func (d *delta) add(size uint64) {
+	d.bytes += int64(size)
+	d.objects++
+}
+
+func (d *delta) subtract(size uint64) {
+	d.bytes -= int64(size)
+	d.objects--
+}
+
+// exceeds checks the usage after the change against the limits, if the change grows it
+func (d *delta) exceeds(subject string, usage Usage, maxBytes, maxObjects uint64) error {
+	if d.bytes > 0 && maxBytes > 0 && int64(usage.Bytes)+d.bytes > int64(maxBytes) {
+		return &QuotaError{
+			Subject: subject,
+			Description: fmt.Sprintf("storage quota of %s exceeded: %s used of %s", subject,
+				lib.FormatSize(int(usage.Bytes), 2), lib.FormatSize(int(maxBytes), 2)),
+		}
+	}
+	if d.objects > 0 && maxObjects > 0 && int64(usage.Objects)+d.objects > int64(maxObjects) {
+		return &QuotaError{
+			Subject:     subject,
+			Description: fmt.Sprintf("object quota of %s exceeded: %d objects of %d", subject, usage.Objects, maxObjects),
+		}
+	}
+	return nil
+}
+
+func exceeds(subject string, usage Usage, size, maxBytes, maxObjects uint64) error {
+	if maxBytes > 0 && usage.Bytes+size > maxBytes {
+		return &QuotaError{
+			Subject: subject,
+			Description: fmt.Sprintf("storage quota of %s exceeded: %s used of %s", subject,
+				lib.FormatSize(int(usage.Bytes), 2), lib.FormatSize(int(maxBytes), 2)),
+		}
+	}
+	if maxObjects > 0 && usage.Objects+1 > maxObjects {
+		return &QuotaError{
+			Subject:     subject,
+			Description: fmt.Sprintf("object quota of %s exceeded: %d objects of %d", subject, usage.Objects, maxObjects),
+		}
+	}
+	return nil
+}
+
+// prefixOf returns the top-level prefix of the key, e.g. img for img/photo.png, or an empty string for top-level keys
+func prefixOf(key string) string {
+	if i := strings.Index(key, "/"); i != -1 {
+		return key[:i]
+	}
+	return ""
+}
+
+func get(usages map[string]*Usage, name string) Usage {
+	if usage, ok := usages[name]; ok {
+		return *usage
+	}
+	return Usage{}
+}
+
+// reserved returns the usage along with the reservations of the uploads being stored
+func reserved(usages, reservations map[string]*Usage, name string) Usage {
+	usage := get(usages, name)
+	reservation := get(reservations, name)
+	usage.Bytes += reservation.Bytes
+	usage.Objects += reservation.Objects
+	return usage
+}
+
+func add(usages map[string]*Usage, name string, size uint64) {
+	usage, ok := usages[name]
+	if !ok {
+		usage = &Usage{}
+		usages[name] = usage
+	}
+	usage.Bytes += size
+	usage.Objects++
+}
+
+func subtract(usages map[string]*Usage, name string, size uint64) {
+	usage, ok := usages[name]
+	if !ok {
+		return
+	}
+	usage.Bytes -= size
+	usage.Objects--
+	if usage.Objects == 0 {
+		delete(usages, name)
+	}
+}
@@ -0,0 +1,119 @@
+package validation
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks streamed to clamd, which must not exceed its StreamMaxLength
+const clamdChunkSize = 64 * 1024
+
+// ClamAVScanner scans the content with a clamd daemon, or any server implementing its protocol, using the INSTREAM command
+type ClamAVScanner struct {
+	// Network is tcp or unix
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+func NewClamAV(scannerConfig config.ScannerConfig) *ClamAVScanner {
+	return &ClamAVScanner{
+		Network: scannerConfig.Network,
+		Address: scannerConfig.Address,
+		Timeout: time.Second * time.Duration(scannerConfig.Timeout),
+	}
+}
+
+// Ping checks that clamd is reachable
+func (s *ClamAVScanner) Ping() error {
+	reply, err := s.command("PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected clamd reply: %s", reply)
+	}
+	return nil
+}
+
+func (s *ClamAVScanner) Scan(content io.Reader) error {
+	reply, err := s.command("INSTREAM", content)
+	if err != nil {
+		return err
+	}
+
+	// the replies are e.g. "stream: OK", "stream: Eicar-Signature FOUND" or "INSTREAM size limit exceeded. ERROR"
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return &ThreatError{Signature: signature}
+	case strings.HasSuffix(reply, " OK"):
+		return nil
+	}
+	return fmt.Errorf("clamd error: %s", reply)
+}
+
+// command sends a null-terminated command, followed by the content if any, and returns the reply of clamd
+func (s *ClamAVScanner) command(name string, content io.Reader) (string, error) {
+	conn, err := net.DialTimeout(s.Network, s.Address, s.Timeout)
+	if err != nil {
+		return "", fmt.Errorf("cannot connect to clamd: %s", err)
+	}
+	defer conn.Close()
+
+	if s.Timeout > 0 {
+		if err = conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err = conn.Write([]byte("z" + name + "\x00")); err != nil {
+		return "", fmt.Errorf("cannot send %s command: %s", name, err)
+	}
+	if content != nil {
+		if err = writeChunks(conn, content); err != nil {
+			return "", fmt.Errorf("cannot stream content to clamd: %s", err)
+		}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("cannot read clamd reply: %s", err)
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// writeChunks streams the content as chunks prefixed by their length, in network byte order, and terminated by an empty chunk
+func writeChunks(writer io.Writer, content io.Reader) error {
+	buffer := make([]byte, clamdChunkSize)
+	length := make([]byte, 4)
+
+	for {
+		n, err := content.Read(buffer)
+		if n > 0 {
+			binary.BigEndian.PutUint32(length, uint32(n))
+			if _, err := writer.Write(length); err != nil {
+				return err
+			}
+			if _, err := writer.Write(buffer[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	binary.BigEndian.PutUint32(length, 0)
+	_, err := writer.Write(length)
+	return err
+}
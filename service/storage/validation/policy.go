@@ -0,0 +1,110 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"strings"
+)
+
+// Error describes why an upload was rejected
+type Error struct {
+	Field       string
+	Description string
+}
+
+func (e *Error) Error() string {
+	return e.Description
+}
+
+// Policy decides which uploads are accepted, based on their extension and on their sniffed content
+type Policy struct {
+	Config config.ValidationConfig
+}
+
+func NewPolicy(validationConfig config.ValidationConfig) *Policy {
+	return &Policy{
+		Config: validationConfig,
+	}
+}
+
+// CheckName verifies the extension of the file, before its content is received
+func (p *Policy) CheckName(fileName string) error {
+	if len(p.Config.AllowedExtensions) == 0 {
+		return nil
+	}
+
+	extension := Extension(fileName)
+	for _, allowed := range p.Config.AllowedExtensions {
+		if strings.EqualFold(extension, allowed) {
+			return nil
+		}
+	}
+	return &Error{
+		Field:       "file_name",
+		Description: fmt.Sprintf("files with extension %q are not allowed", extension),
+	}
+}
+
+// Check verifies the file name, the content type declared by the client, if any, and the leading bytes of the content,
+// and returns the content type of the file
+func (p *Policy) Check(fileName, declared string, head []byte) (string, error) {
+	if err := p.CheckName(fileName); err != nil {
+		return "", err
+	}
+
+	extension := Extension(fileName)
+	expected := ExtensionType(extension)
+	sniffed := Sniff(head)
+
+	if p.Config.RejectMismatched {
+		if !matches(extension, expected, sniffed) {
+			return "", &Error{
+				Field:       "content",
+				Description: fmt.Sprintf("content of type %s does not match extension %q", sniffed, extension),
+			}
+		}
+		if declared = mediaType(declared); declared != octetStream && !matches(extension, declared, sniffed) {
+			return "", &Error{
+				Field:       "content_type",
+				Description: fmt.Sprintf("content of type %s does not match declared type %s", sniffed, declared),
+			}
+		}
+	}
+
+	// the sniffed type is preferred, unless it is too generic, e.g. text/plain for a csv file
+	contentType := sniffed
+	if expected != "" && matches(extension, expected, sniffed) && (sniffed == octetStream || sniffed == zipArchive || isText(sniffed)) {
+		contentType = expected
+	}
+
+	for _, denied := range p.Config.DeniedContentTypes {
+		if matchesPattern(denied, sniffed) || matchesPattern(denied, contentType) {
+			return "", &Error{
+				Field:       "content",
+				Description: fmt.Sprintf("files of type %s are not allowed", sniffed),
+			}
+		}
+	}
+
+	if len(p.Config.AllowedContentTypes) == 0 {
+		return contentType, nil
+	}
+	for _, allowed := range p.Config.AllowedContentTypes {
+		if matchesPattern(allowed, contentType) {
+			return contentType, nil
+		}
+	}
+	return "", &Error{
+		Field:       "content",
+		Description: fmt.Sprintf("files of type %s are not allowed", contentType),
+	}
+}
+
+// matchesPattern matches a content type against a pattern, which may end with a wildcard subtype, e.g. image/*
+func matchesPattern(pattern, contentType string) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == contentType
+}
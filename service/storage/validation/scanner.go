@@ -0,0 +1,33 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"io"
+)
+
+// Scanner inspects the content of the uploads before they are stored, e.g. for malware
+type Scanner interface {
+	// Scan returns a *ThreatError if the content must be rejected
+	Scan(content io.Reader) error
+}
+
+// ThreatError reports the threat found by a scanner
+type ThreatError struct {
+	Signature string
+}
+
+func (e *ThreatError) Error() string {
+	return fmt.Sprintf("threat detected: %s", e.Signature)
+}
+
+// NewScanner returns the scanner of the configured engine, or nil if scanning is disabled
+func NewScanner(scannerConfig config.ScannerConfig) (Scanner, error) {
+	switch scannerConfig.Engine {
+	case "":
+		return nil, nil
+	case "clamav":
+		return NewClamAV(scannerConfig), nil
+	}
+	return nil, fmt.Errorf("unknown scanner engine %s", scannerConfig.Engine)
+}
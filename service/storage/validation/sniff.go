@@ -0,0 +1,166 @@
+package validation
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// SniffLength is the number of leading bytes needed to detect the content type
+const SniffLength = 512
+
+const (
+	octetStream = "application/octet-stream"
+	zipArchive  = "application/zip"
+)
+
+// executables are detected by their magic numbers, which http.DetectContentType does not recognize
+var executables = []struct {
+	magic       []byte
+	contentType string
+}{
+	{[]byte("MZ"), "application/x-msdownload"},
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte("\xfe\xed\xfa\xce"), "application/x-mach-binary"},
+	{[]byte("\xfe\xed\xfa\xcf"), "application/x-mach-binary"},
+	{[]byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("#!"), "text/x-shellscript"},
+}
+
+// signatureTypes are recognized by http.DetectContentType from their signatures: files with these types and
+// any other content are mismatched
+var signatureTypes = map[string]bool{
+	"image/x-icon":                  true,
+	"image/bmp":                     true,
+	"image/gif":                     true,
+	"image/webp":                    true,
+	"image/png":                     true,
+	"image/jpeg":                    true,
+	"audio/basic":                   true,
+	"audio/aiff":                    true,
+	"audio/mpeg":                    true,
+	"application/ogg":               true,
+	"audio/midi":                    true,
+	"video/avi":                     true,
+	"audio/wave":                    true,
+	"video/mp4":                     true,
+	"video/webm":                    true,
+	"font/ttf":                      true,
+	"font/otf":                      true,
+	"font/collection":               true,
+	"font/woff":                     true,
+	"font/woff2":                    true,
+	"application/vnd.ms-fontobject": true,
+	"application/pdf":               true,
+	"application/postscript":        true,
+	"application/x-gzip":            true,
+	zipArchive:                      true,
+	"application/x-rar-compressed":  true,
+	"application/wasm":              true,
+}
+
+// extensionTypes complements the types known to the mime package, which depend on the system's tables
+var extensionTypes = map[string]string{
+	".csv":  "text/csv",
+	".txt":  "text/plain",
+	".md":   "text/markdown",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+	".ico":  "image/x-icon",
+	".pdf":  "application/pdf",
+	".zip":  zipArchive,
+	".gz":   "application/x-gzip",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".epub": "application/epub+zip",
+	".jar":  "application/java-archive",
+	".exe":  "application/x-msdownload",
+	".dll":  "application/x-msdownload",
+	".sh":   "text/x-shellscript",
+}
+
+// zipContainers are the formats stored as zip archives, which are sniffed as application/zip
+var zipContainers = map[string]bool{
+	".docx": true,
+	".xlsx": true,
+	".pptx": true,
+	".odt":  true,
+	".ods":  true,
+	".odp":  true,
+	".epub": true,
+	".jar":  true,
+	".apk":  true,
+}
+
+// Sniff detects the content type from the leading bytes of the content, without parameters (e.g. text/plain)
+func Sniff(head []byte) string {
+	for _, executable := range executables {
+		if bytes.HasPrefix(head, executable.magic) {
+			return executable.contentType
+		}
+	}
+	return mediaType(http.DetectContentType(head))
+}
+
+// Extension returns the lower cased extension of the file name, e.g. .png
+func Extension(fileName string) string {
+	return strings.ToLower(path.Ext(fileName))
+}
+
+// ExtensionType returns the content type expected for the extension, or an empty string if unknown
+func ExtensionType(extension string) string {
+	if contentType, ok := extensionTypes[extension]; ok {
+		return contentType
+	}
+	return mediaType(mime.TypeByExtension(extension))
+}
+
+// matches checks whether the sniffed content is compatible with the type expected for the extension
+func matches(extension, expected, sniffed string) bool {
+	switch {
+	case expected == "" || expected == sniffed:
+		return true
+	case isText(sniffed):
+		// text is only sniffed as plain text, html or xml
+		return isText(expected)
+	case sniffed == zipArchive:
+		return zipContainers[extension]
+	case sniffed == octetStream:
+		// the content has no known signature, it cannot be one of the formats that have one
+		return !signatureTypes[expected]
+	}
+	return false
+}
+
+// isText checks whether the content type is a text based format
+func isText(contentType string) bool {
+	switch contentType {
+	case "application/json", "application/xml", "application/javascript":
+		return true
+	}
+	return strings.HasPrefix(contentType, "text/") || strings.HasSuffix(contentType, "+xml") || strings.HasSuffix(contentType, "+json")
+}
+
+func mediaType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	parsed, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return parsed
+}
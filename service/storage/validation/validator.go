@@ -0,0 +1,59 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/bogdanrat/web-server/service/storage/config"
+	"io"
+	"log"
+)
+
+// Validator checks the uploads against the policy, then scans them
+type Validator struct {
+	Policy *Policy
+	// Scanner is nil if scanning is disabled
+	Scanner Scanner
+	// FailOpen accepts the uploads the scanner could not scan
+	FailOpen bool
+}
+
+func New(validationConfig config.ValidationConfig) (*Validator, error) {
+	scanner, err := NewScanner(validationConfig.Scanner)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Validator{
+		Policy:   NewPolicy(validationConfig),
+		Scanner:  scanner,
+		FailOpen: validationConfig.Scanner.FailOpen,
+	}, nil
+}
+
+// CheckName verifies the file name before the content is received
+func (v *Validator) CheckName(fileName string) error {
+	return v.Policy.CheckName(fileName)
+}
+
+// Validate checks the leading bytes of the content against the policy, then scans the whole content,
+// and returns the content type of the file. The errors are *Error and *ThreatError for rejected files.
+func (v *Validator) Validate(fileName, declaredContentType string, head []byte, content io.Reader) (string, error) {
+	contentType, err := v.Policy.Check(fileName, declaredContentType, head)
+	if err != nil {
+		return "", err
+	}
+
+	if v.Scanner == nil {
+		return contentType, nil
+	}
+	if err = v.Scanner.Scan(content); err != nil {
+		if _, ok := err.(*ThreatError); ok {
+			return "", err
+		}
+		if v.FailOpen {
+			log.Printf("cannot scan %s, accepting it unscanned: %s\n", fileName, err)
+			return contentType, nil
+		}
+		return "", fmt.Errorf("cannot scan %s: %s", fileName, err)
+	}
+	return contentType, nil
+}